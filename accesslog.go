@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// accessLogger writes one line per request, either as JSON or in the Apache
+// combined format. Both carry the same fields.
+type accessLogger struct {
+	mu       sync.Mutex
+	w        io.Writer
+	combined bool
+	buf      []byte
+}
+
+func newAccessLogger(w io.Writer, format string) *accessLogger {
+	return &accessLogger{w: w, combined: format == "combined"}
+}
+
+type accessLogEntry struct {
+	RemoteAddr string `json:"remote_addr"`
+	Time       string `json:"time"`
+	Method     string `json:"method"`
+	URI        string `json:"uri"`
+	Proto      string `json:"proto"`
+	Status     int    `json:"status"`
+	Size       int    `json:"size"`
+	Referer    string `json:"referer"`
+	UserAgent  string `json:"user_agent"`
+}
+
+// log writes the line of r, which started at t. t is written in its own
+// location.
+func (l *accessLogger) log(r *http.Request, status, size int, t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.combined {
+		b, _ := json.Marshal(accessLogEntry{
+			RemoteAddr: r.RemoteAddr,
+			Time:       t.Format(time.RFC3339Nano),
+			Method:     r.Method,
+			URI:        r.RequestURI,
+			Proto:      r.Proto,
+			Status:     status,
+			Size:       size,
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+		})
+		l.w.Write(append(b, '\n'))
+		return
+	}
+
+	// host - - [time] "request" status size "referer" "user agent", with
+	// "-" for a zero size and the headers that are missing.
+	b := l.buf[:0]
+	b = append(b, r.RemoteAddr...)
+	b = append(b, " - - ["...)
+	b = t.AppendFormat(b, "02/Jan/2006:15:04:05 -0700")
+	b = append(b, "] "...)
+	b = strconv.AppendQuote(b, r.Method+" "+r.RequestURI+" "+r.Proto)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(status), 10)
+	b = append(b, ' ')
+	if size == 0 {
+		b = append(b, '-')
+	} else {
+		b = strconv.AppendInt(b, int64(size), 10)
+	}
+	b = append(b, ' ')
+	b = strconv.AppendQuote(b, orDash(r.Referer()))
+	b = append(b, ' ')
+	b = strconv.AppendQuote(b, orDash(r.UserAgent()))
+	b = append(b, '\n')
+	l.w.Write(b)
+	l.buf = b
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
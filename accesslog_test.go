@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	at := time.Date(2024, 2, 3, 14, 5, 6, 0, time.FixedZone("", -3*60*60))
+	tests := []struct {
+		name         string
+		target       string
+		header       map[string]string
+		status, size int
+		wantCombined string
+		wantJSON     accessLogEntry
+	}{
+		{
+			name:         "full",
+			target:       "/clientes/1/extrato?pretty=1",
+			header:       map[string]string{"Referer": "http://dash/", "User-Agent": "curl/8.5"},
+			status:       200,
+			size:         153,
+			wantCombined: `10.0.0.1:5000 - - [03/Feb/2024:14:05:06 -0300] "GET /clientes/1/extrato?pretty=1 HTTP/1.1" 200 153 "http://dash/" "curl/8.5"` + "\n",
+			wantJSON: accessLogEntry{
+				RemoteAddr: "10.0.0.1:5000", Time: "2024-02-03T14:05:06-03:00", Method: "GET", URI: "/clientes/1/extrato?pretty=1",
+				Proto: "HTTP/1.1", Status: 200, Size: 153, Referer: "http://dash/", UserAgent: "curl/8.5",
+			},
+		},
+		{
+			name:         "no body or headers",
+			target:       "/clientes/6/extrato",
+			status:       404,
+			wantCombined: `10.0.0.1:5000 - - [03/Feb/2024:14:05:06 -0300] "GET /clientes/6/extrato HTTP/1.1" 404 - "-" "-"` + "\n",
+			wantJSON: accessLogEntry{
+				RemoteAddr: "10.0.0.1:5000", Time: "2024-02-03T14:05:06-03:00", Method: "GET", URI: "/clientes/6/extrato",
+				Proto: "HTTP/1.1", Status: 404,
+			},
+		},
+		{
+			name:         "quotes escaped",
+			target:       "/",
+			header:       map[string]string{"User-Agent": `say "hi"`},
+			status:       200,
+			size:         2,
+			wantCombined: `10.0.0.1:5000 - - [03/Feb/2024:14:05:06 -0300] "GET / HTTP/1.1" 200 2 "-" "say \"hi\""` + "\n",
+			wantJSON: accessLogEntry{
+				RemoteAddr: "10.0.0.1:5000", Time: "2024-02-03T14:05:06-03:00", Method: "GET", URI: "/",
+				Proto: "HTTP/1.1", Status: 200, Size: 2, UserAgent: `say "hi"`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.target, nil)
+			r.RemoteAddr = "10.0.0.1:5000"
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+
+			var combined bytes.Buffer
+			newAccessLogger(&combined, "combined").log(r, tt.status, tt.size, at)
+			if got := combined.String(); got != tt.wantCombined {
+				t.Errorf("combined line:\n got %q\nwant %q", got, tt.wantCombined)
+			}
+
+			var js bytes.Buffer
+			newAccessLogger(&js, "json").log(r, tt.status, tt.size, at)
+			var got accessLogEntry
+			if err := json.Unmarshal(js.Bytes(), &got); err != nil {
+				t.Fatalf("decoding %q: %v", js.String(), err)
+			}
+			if got != tt.wantJSON {
+				t.Errorf("json line = %+v, want %+v", got, tt.wantJSON)
+			}
+		})
+	}
+}
+
+func TestAccessLogRequests(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"combined", `^192\.0\.2\.1:1234 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [-+]\d{4}\] "POST /clientes/1/transacoes HTTP/1\.1" 200 30 "-" "-"$`},
+		{"json", `^\{"remote_addr":"192\.0\.2\.1:1234","time":"[^"]+","method":"POST","uri":"/clientes/1/transacoes","proto":"HTTP/1\.1","status":200,"size":30,"referer":"","user_agent":""\}$`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			s := newTestServer(t, testConfig(), newFakeStore())
+			var buf bytes.Buffer
+			s.accessLog = newAccessLogger(&buf, tt.format)
+
+			w := do(s, "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			line, ok := strings.CutSuffix(buf.String(), "\n")
+			if !ok || strings.Contains(line, "\n") {
+				t.Fatalf("logged %q, want a single line", buf.String())
+			}
+			if !regexp.MustCompile(tt.want).MatchString(line) {
+				t.Errorf("logged %q, want it to match %s", line, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AuditEntry records one credit or debit attempt.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	CustomerID int       `json:"customer_id"`
+	Amount     int       `json:"amount"`
+	Type       string    `json:"type"`
+	// Balance is the balance after the operation, or the unchanged balance
+	// when it was rejected.
+	Balance int `json:"balance"`
+	// Status is one of "applied", "rejected" (business rules, including the
+	// transaction cap), "invalid" (refused before reaching the store),
+	// "duplicate" (answered with the result of an identical operation),
+	// "buffered" (a credit kept until the database is reachable) or "error".
+	Status string `json:"status"`
+	// Error is the error, or for "invalid" the validation failure reason.
+	Error string `json:"error,omitempty"`
+}
+
+// AuditLogger writes AuditEntry values as JSON lines to a writer. A nil
+// AuditLogger, the audit log being off, discards them.
+type AuditLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	// now is when entries happen, in the configured location.
+	now func() time.Time
+}
+
+func NewAuditLogger(w io.Writer, now func() time.Time) *AuditLogger {
+	return &AuditLogger{enc: json.NewEncoder(w), now: now}
+}
+
+func (l *AuditLogger) Log(e AuditEntry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(e)
+}
+
+// record logs the outcome of a credit or debit.
+func (l *AuditLogger) record(customerID, value int, typ string, res TransactionResult, err error) {
+	if l == nil {
+		return
+	}
+	l.Log(newAuditEntry(l.now(), customerID, value, typ, res, err))
+}
+
+// auditInvalid logs a transaction to the customer of r refused by validation
+// for reason. The fields of tr that couldn't be decoded are left zero.
+func (s *Server) auditInvalid(r *http.Request, tr *transactionRequest, reason string) {
+	if s.audit == nil {
+		return
+	}
+	customerID, _ := parseCustomerID(r.PathValue("id"))
+	s.audit.Log(AuditEntry{
+		Time:       s.audit.now(),
+		CustomerID: customerID,
+		Amount:     tr.Value,
+		Type:       tr.Type,
+		Status:     "invalid",
+		Error:      reason,
+	})
+}
+
+func newAuditEntry(at time.Time, customerID, value int, typ string, res TransactionResult, err error) AuditEntry {
+	e := AuditEntry{
+		Time:       at,
+		CustomerID: customerID,
+		Amount:     value,
+		Type:       typ,
+		Balance:    res.Balance,
+		Status:     "applied",
+	}
+	switch {
+	case errors.Is(err, errCreditBuffered):
+		e.Status = "buffered"
+	case errors.Is(err, errTransactionLimit):
+		e.Status = "rejected"
+		e.Error = err.Error()
+	case err != nil:
+		e.Status = "error"
+		e.Error = err.Error()
+	case res.Duplicate:
+		e.Status = "duplicate"
+	case !res.Applied:
+		e.Status = "rejected"
+	}
+	return e
+}
+
+// auditStore is a Store that writes every credit and debit, whatever its
+// outcome, to an AuditLogger. It goes on top of every other store so the
+// attempts they turn away are recorded too.
+type auditStore struct {
+	Store
+	log *AuditLogger
+}
+
+func (s *auditStore) Credit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	res, err := s.Store.Credit(ctx, customerID, value, desc)
+	s.log.record(customerID, value, "c", res, err)
+	return res, err
+}
+
+func (s *auditStore) Debit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	res, err := s.Store.Debit(ctx, customerID, value, desc)
+	s.log.record(customerID, value, "d", res, err)
+	return res, err
+}
+
+func (s *auditStore) ApplyIfBalance(ctx context.Context, customerID, value int, typ, desc string, expected int) (TransactionResult, error) {
+	res, err := s.Store.ApplyIfBalance(ctx, customerID, value, typ, desc, expected)
+	s.log.record(customerID, value, typ, res, err)
+	return res, err
+}
+
+func (s *auditStore) BeginBatch(ctx context.Context) (Batch, error) {
+	b, err := s.Store.BeginBatch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &auditBatch{Batch: b, log: s.log}, nil
+}
+
+var errBatchRolledBack = errors.New("batch rolled back")
+
+// auditBatch holds the entries of applied operations until the batch is
+// committed or rolled back, since only then is their outcome known.
+type auditBatch struct {
+	Batch
+	log     *AuditLogger
+	pending []AuditEntry
+}
+
+func (b *auditBatch) Apply(ctx context.Context, customerID, value int, typ, desc string) (TransactionResult, error) {
+	res, err := b.Batch.Apply(ctx, customerID, value, typ, desc)
+	e := newAuditEntry(b.log.now(), customerID, value, typ, res, err)
+	if e.Status == "applied" {
+		b.pending = append(b.pending, e)
+	} else {
+		b.log.Log(e)
+	}
+	return res, err
+}
+
+func (b *auditBatch) Commit(ctx context.Context) error {
+	err := b.Batch.Commit(ctx)
+	b.flush(err)
+	return err
+}
+
+func (b *auditBatch) Rollback(ctx context.Context) error {
+	err := b.Batch.Rollback(ctx)
+	b.flush(errBatchRolledBack)
+	return err
+}
+
+func (b *auditBatch) flush(err error) {
+	for _, e := range b.pending {
+		if err != nil {
+			e.Status = "error"
+			e.Error = err.Error()
+		}
+		b.log.Log(e)
+	}
+	b.pending = nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// readAuditLog decodes every entry written to the audit log at path.
+func readAuditLog(t *testing.T, path string) []AuditEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []AuditEntry
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var e AuditEntry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("decoding audit entry: %v", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		failing string
+		want    AuditEntry
+	}{
+		{"credit", `{"valor": 500, "tipo": "c", "descricao": "deposito"}`, "", AuditEntry{CustomerID: 1, Amount: 500, Type: "c", Balance: 500, Status: "applied"}},
+		{"debit", `{"valor": 500, "tipo": "d", "descricao": "saque"}`, "", AuditEntry{CustomerID: 1, Amount: 500, Type: "d", Balance: -500, Status: "applied"}},
+		{"debit over the limit", `{"valor": 100001, "tipo": "d", "descricao": "saque"}`, "", AuditEntry{CustomerID: 1, Amount: 100001, Type: "d", Balance: 0, Status: "rejected"}},
+		{"expected balance", `{"valor": 500, "tipo": "c", "descricao": "deposito", "saldo_esperado": 0}`, "", AuditEntry{CustomerID: 1, Amount: 500, Type: "c", Balance: 500, Status: "applied"}},
+		{"store error", `{"valor": 500, "tipo": "c", "descricao": "deposito"}`, "Credit", AuditEntry{CustomerID: 1, Amount: 500, Type: "c", Status: "error", Error: "boom"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := t.TempDir() + "/audit.log"
+			cfg := testConfig()
+			cfg.Transactions.AuditLog = path
+			store := newFakeStore()
+			if tt.failing != "" {
+				store.failWith(tt.failing, errors.New("boom"))
+			}
+			s := newTestServer(t, cfg, store)
+
+			do(s, "POST", "/clientes/1/transacoes", tt.body)
+
+			entries := readAuditLog(t, path)
+			if len(entries) != 1 {
+				t.Fatalf("got %d audit entries, want 1", len(entries))
+			}
+			got := entries[0]
+			if got.Time.IsZero() {
+				t.Error("audit entry has no time")
+			}
+			got.Time = tt.want.Time
+			if got != tt.want {
+				t.Errorf("audit entry = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuditLogBatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		failCommit bool
+		wantStatus string
+	}{
+		{"committed", false, "applied"},
+		{"commit failed", true, "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := t.TempDir() + "/audit.log"
+			cfg := testConfig()
+			cfg.Transactions.AuditLog = path
+			store := newFakeStore()
+			if tt.failCommit {
+				store.failWith("Batch.Commit", errors.New("commit failed"))
+			}
+			s := newTestServer(t, cfg, store)
+
+			do(s, "POST", "/clientes/1/transacoes/stream", ndjson(4))
+
+			entries := readAuditLog(t, path)
+			if len(entries) != 4 {
+				t.Fatalf("got %d audit entries, want 4", len(entries))
+			}
+			for i, e := range entries {
+				if e.Status != tt.wantStatus {
+					t.Errorf("entry %d status = %q, want %q", i, e.Status, tt.wantStatus)
+				}
+			}
+		})
+	}
+}
+
+func TestAuditLogRejections(t *testing.T) {
+	const credit = `{"valor": 500, "tipo": "c", "descricao": "deposito"}`
+	tests := []struct {
+		name   string
+		cfg    func(*Config)
+		fail   error
+		target string
+		bodies []string
+		want   []AuditEntry
+	}{
+		{
+			name:   "validation",
+			target: "/clientes/1/transacoes",
+			bodies: []string{`{"valor": 0, "tipo": "c", "descricao": "deposito"}`},
+			want:   []AuditEntry{{CustomerID: 1, Type: "c", Status: "invalid", Error: "value"}},
+		},
+		{
+			name:   "malformed body",
+			target: "/clientes/1/transacoes",
+			bodies: []string{`{"valor": `},
+			want:   []AuditEntry{{CustomerID: 1, Status: "invalid", Error: "syntax"}},
+		},
+		{
+			name:   "transaction cap",
+			cfg:    func(c *Config) { c.Transactions.MaxPerCustomer = 1 },
+			target: "/clientes/1/transacoes",
+			bodies: []string{credit, credit},
+			want: []AuditEntry{
+				{CustomerID: 1, Amount: 500, Type: "c", Balance: 500, Status: "applied"},
+				{CustomerID: 1, Amount: 500, Type: "c", Status: "rejected", Error: errTransactionLimit.Error()},
+			},
+		},
+		{
+			name:   "duplicate",
+			cfg:    func(c *Config) { c.Transactions.DedupWindow = Duration{time.Minute} },
+			target: "/clientes/1/transacoes",
+			bodies: []string{credit, credit},
+			want: []AuditEntry{
+				{CustomerID: 1, Amount: 500, Type: "c", Balance: 500, Status: "applied"},
+				{CustomerID: 1, Amount: 500, Type: "c", Balance: 500, Status: "duplicate"},
+			},
+		},
+		{
+			name:   "buffered",
+			cfg:    func(c *Config) { c.Transactions.CreditBuffer = filepath.Join(t.TempDir(), "credits.ndjson") },
+			fail:   &pgconn.PgError{Code: "08006"},
+			target: "/clientes/1/transacoes",
+			bodies: []string{credit},
+			want:   []AuditEntry{{CustomerID: 1, Amount: 500, Type: "c", Status: "buffered"}},
+		},
+		{
+			name:   "stream",
+			target: "/clientes/1/transacoes/stream",
+			bodies: []string{`{"valor": 1, "tipo": "x", "descricao": "linha"}` + "\n" + `{"valor": 1, "tipo": "c", "descricao": "linha"}` + "\n"},
+			want: []AuditEntry{
+				{CustomerID: 1, Amount: 1, Type: "x", Status: "invalid", Error: "type"},
+				{CustomerID: 1, Amount: 1, Type: "c", Balance: 1, Status: "applied"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := t.TempDir() + "/audit.log"
+			cfg := testConfig()
+			cfg.Transactions.AuditLog = path
+			if tt.cfg != nil {
+				tt.cfg(&cfg)
+			}
+			store := newFakeStore()
+			if tt.fail != nil {
+				store.failWith("Credit", tt.fail)
+			}
+			s := newTestServer(t, cfg, store)
+
+			for _, body := range tt.bodies {
+				do(s, "POST", tt.target, body)
+			}
+
+			entries := readAuditLog(t, path)
+			if len(entries) != len(tt.want) {
+				t.Fatalf("got %d audit entries, want %d: %+v", len(entries), len(tt.want), entries)
+			}
+			for i, got := range entries {
+				got.Time = time.Time{}
+				if got != tt.want[i] {
+					t.Errorf("audit entry %d = %+v, want %+v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCreditBufferReplayAudit(t *testing.T) {
+	path := t.TempDir() + "/audit.log"
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	store := newFakeStore()
+	buf := &creditBufferStore{
+		Store:   store,
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		audit:   NewAuditLogger(f, time.Now),
+		path:    filepath.Join(t.TempDir(), "credits.ndjson"),
+		pending: []bufferedCredit{{CustomerID: 1, Value: 300, Desc: "x"}, {CustomerID: 42, Value: 100, Desc: "x"}},
+	}
+
+	buf.replay(context.Background())
+
+	entries := readAuditLog(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("got %d audit entries, want 2: %+v", len(entries), entries)
+	}
+	if e := entries[0]; e.CustomerID != 1 || e.Status != "applied" || e.Balance != 300 {
+		t.Errorf("replayed credit entry = %+v, want applied with balance 300", e)
+	}
+	if e := entries[1]; e.CustomerID != 42 || e.Status != "error" {
+		t.Errorf("dropped credit entry = %+v, want an error", e)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// errChaos is what chaosStore fails operations with. It looks like a canceled
+// query, so it is answered with 503 like a real one.
+var errChaos = &pgconn.PgError{Code: "57014", Message: "chaos: injected failure"}
+
+// chaosStore injects latency and failures into credits, debits and
+// statements, to exercise how the service and its clients handle them. It is
+// only used when CHAOS_ENABLED is set.
+type chaosStore struct {
+	Store
+	cfg ChaosConfig
+}
+
+func (s *chaosStore) Credit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	if err := s.inject(ctx); err != nil {
+		return TransactionResult{}, err
+	}
+	return s.Store.Credit(ctx, customerID, value, desc)
+}
+
+func (s *chaosStore) Debit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	if err := s.inject(ctx); err != nil {
+		return TransactionResult{}, err
+	}
+	return s.Store.Debit(ctx, customerID, value, desc)
+}
+
+func (s *chaosStore) Statement(ctx context.Context, customerID int, opts StatementOptions) (Statement, error) {
+	if err := s.inject(ctx); err != nil {
+		return Statement{}, err
+	}
+	return s.Store.Statement(ctx, customerID, opts)
+}
+
+// inject sleeps for the configured latency and then fails, each with its own
+// probability. Like a slow query, the sleep is cut short by ctx.
+func (s *chaosStore) inject(ctx context.Context) error {
+	if s.cfg.LatencyRate > 0 && rand.Float64() < s.cfg.LatencyRate {
+		t := time.NewTimer(s.cfg.Latency.Duration)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+	if s.cfg.ErrorRate > 0 && rand.Float64() < s.cfg.ErrorRate {
+		return errChaos
+	}
+	return nil
+}
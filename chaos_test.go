@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestChaos(t *testing.T) {
+	credit := `{"valor": 1, "tipo": "c", "descricao": "x"}`
+	tests := []struct {
+		name        string
+		chaos       ChaosConfig
+		method      string
+		target      string
+		body        string
+		wantStatus  int
+		wantLatency time.Duration
+	}{
+		{"disabled", ChaosConfig{ErrorRate: 1, LatencyRate: 1, Latency: Duration{time.Hour}}, "POST", "/clientes/1/transacoes", credit, http.StatusOK, 0},
+		{"credit error", ChaosConfig{Enabled: true, ErrorRate: 1}, "POST", "/clientes/1/transacoes", credit, http.StatusServiceUnavailable, 0},
+		{"debit error", ChaosConfig{Enabled: true, ErrorRate: 1}, "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "d", "descricao": "x"}`, http.StatusServiceUnavailable, 0},
+		{"statement error", ChaosConfig{Enabled: true, ErrorRate: 1}, "GET", "/clientes/1/extrato", "", http.StatusServiceUnavailable, 0},
+		{"no error", ChaosConfig{Enabled: true}, "GET", "/clientes/1/extrato", "", http.StatusOK, 0},
+		{"latency", ChaosConfig{Enabled: true, LatencyRate: 1, Latency: Duration{50 * time.Millisecond}}, "GET", "/clientes/1/extrato", "", http.StatusOK, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Chaos = tt.chaos
+			s := newTestServer(t, cfg, newFakeStore())
+
+			start := time.Now()
+			w := do(s, tt.method, tt.target, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+				t.Error("injected failure answered without Retry-After")
+			}
+			if elapsed := time.Since(start); elapsed < tt.wantLatency {
+				t.Errorf("answered in %s, want at least the injected %s", elapsed, tt.wantLatency)
+			}
+		})
+	}
+}
+
+func TestChaosLatencyTimeout(t *testing.T) {
+	cfg := testConfig()
+	cfg.Chaos = ChaosConfig{Enabled: true, LatencyRate: 1, Latency: Duration{time.Hour}}
+	cfg.Server.StatementQueryTimeout = Duration{20 * time.Millisecond}
+	s := newTestServer(t, cfg, newFakeStore())
+
+	if w := do(s, "GET", "/clientes/1/extrato", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d once the injected latency passes the query timeout", w.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds every setting of the service. It is read from the JSON file
+// named by CONFIG_FILE, if any, and then overridden by environment variables.
+// Empty environment variables are treated as unset.
+type Config struct {
+	DB           DBConfig           `json:"db"`
+	Server       ServerConfig       `json:"server"`
+	Metrics      MetricsConfig      `json:"metrics"`
+	Transactions TransactionsConfig `json:"transactions"`
+	Chaos        ChaosConfig        `json:"chaos"`
+}
+
+type DBConfig struct {
+	URL                  string   `json:"url"`
+	ReplicaURL           string   `json:"replica_url"`
+	MaxReplicaLag        Duration `json:"max_replica_lag"`
+	LockTimeout          Duration `json:"lock_timeout"`
+	PreferSimpleProtocol bool     `json:"prefer_simple_protocol"`
+	// StatementTimeout has Postgres abort any query running longer, which
+	// is answered with 503. Zero leaves the server's default.
+	StatementTimeout Duration `json:"statement_timeout"`
+	// PgBouncerCompat disables the statement and description caches of pgx,
+	// which break behind PgBouncer in transaction pooling mode.
+	PgBouncerCompat bool  `json:"pgbouncer_compat"`
+	MaxConns        int32 `json:"max_conns"`
+	MinConns        int32 `json:"min_conns"`
+	// Trace logs every query with its args and duration. It's meant for
+	// local development; with it off there's no tracer at all.
+	Trace bool `json:"trace"`
+	// MaxConcurrentPerCustomer caps the database operations in flight for a
+	// single customer, answering the ones past it with 503. Zero disables
+	// the cap.
+	MaxConcurrentPerCustomer int `json:"max_concurrent_per_customer"`
+	// StatementOrderBy is the column the latest transactions of a statement
+	// are read by, "id" or "created_at". Each needs its matching index,
+	// see db.sql.
+	StatementOrderBy string `json:"statement_order_by"`
+	// MaxConcurrentReads caps the statement, summary and export reads in
+	// flight, answering the ones past it with 503. Zero disables the cap.
+	MaxConcurrentReads int `json:"max_concurrent_reads"`
+	// Shards splits the pool into this many sub-pools, MaxConns and
+	// MinConns shared among them, each customer always using the same one.
+	// Postgres keeps plans and catalog caches per backend, so a customer
+	// hitting fewer backends finds them warm more often; this only pays off
+	// with many connections and a skewed load, and otherwise just lets a
+	// hot shard queue while others idle. One means a single pool.
+	Shards int `json:"shards"`
+	// HealthCheckPeriod is how often the pool closes idle and expired
+	// connections and tops up to MinConns. pgxpool doesn't run a query for
+	// this; connections idle for over a second are pinged when acquired.
+	HealthCheckPeriod Duration `json:"health_check_period"`
+	// MaxConnLifetimeJitter spreads the closing of connections past their
+	// lifetime over this long, so connections opened together aren't all
+	// reopened at once.
+	MaxConnLifetimeJitter Duration `json:"max_conn_lifetime_jitter"`
+	// ReconnectWindow is how long after losing the connection to the
+	// database errors are answered with 503 rather than 500.
+	ReconnectWindow Duration `json:"reconnect_window"`
+	// DrainTimeout is how long shutdown waits for in-flight queries before
+	// closing the pool.
+	DrainTimeout Duration `json:"drain_timeout"`
+}
+
+type ServerConfig struct {
+	ListenAddr string `json:"listen_addr"`
+	APIKey     string `json:"api_key"`
+	// PathPrefix is where a reverse proxy mounts the service, such as
+	// "/api". Every route is served under it, and it's stripped before
+	// routing, so metrics keep the unprefixed paths.
+	PathPrefix string `json:"path_prefix"`
+	// CustomerAPIKeys maps API keys to the customers they may operate on.
+	// When set, the /clientes/{id} endpoints require one of these keys, or
+	// APIKey, which is allowed on every customer.
+	CustomerAPIKeys map[string][]int `json:"customer_api_keys"`
+	// EnableReset allows POST /clientes/{id}/reset, meant for QA
+	// environments only.
+	EnableReset bool `json:"enable_reset"`
+	// AccessLog logs a line per request to stdout, formatted as
+	// AccessLogFormat: "json" or "combined", the Apache combined format.
+	AccessLog       bool   `json:"access_log"`
+	AccessLogFormat string `json:"access_log_format"`
+	// LogLevel is the least severe level logged: debug, info, warn or
+	// error. It's reloadable.
+	LogLevel string `json:"log_level"`
+	// Timezone is the IANA name of the location dates are written in. It's
+	// reloadable.
+	Timezone string `json:"timezone"`
+	// StatementMaxAge lets clients and proxies cache statements for this
+	// long. Zero disables caching.
+	StatementMaxAge Duration `json:"statement_max_age"`
+	// StatementCacheTTL keeps encoded statements in memory for this long.
+	// Zero disables the cache. It's only invalidated by transactions applied
+	// by this process, so with several instances the TTL bounds how stale a
+	// statement can be.
+	StatementCacheTTL Duration `json:"statement_cache_ttl"`
+	// StatementQueryTimeout bounds the queries of a statement, answering
+	// 503 past it, apart from any timeout on transactions. Zero disables it.
+	// It's reloadable.
+	StatementQueryTimeout Duration `json:"statement_query_timeout"`
+	// LargeNumbersAsStrings renders saldo, limite and valor as strings when
+	// they are beyond 2^53, where JavaScript numbers lose precision.
+	LargeNumbersAsStrings bool `json:"large_numbers_as_strings"`
+	// FastJSON encodes statements with a hand-written encoder instead of
+	// encoding/json. The output is the same.
+	FastJSON bool `json:"fast_json"`
+	// MaxHeaderBytes caps the size of request headers. Zero uses the
+	// net/http default.
+	MaxHeaderBytes int `json:"max_header_bytes"`
+	// MaxBodyBytes caps the size of JSON request bodies, answering 413 past
+	// it. The NDJSON stream isn't capped. Zero disables the cap.
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+	// KeepAlives lets clients reuse connections. Disabling it costs a new
+	// connection per request, which is rarely wanted behind a proxy.
+	KeepAlives bool `json:"keep_alives"`
+	// MaxConnections caps simultaneous client connections, zero meaning no
+	// cap. A request holds at most one DB connection, so with keep-alives
+	// a cap below DB.MaxConns leaves pool connections unused, while a much
+	// higher cap only makes requests queue on the pool instead of the
+	// listener.
+	MaxConnections int `json:"max_connections"`
+	// ShutdownTimeout is how long shutdown waits for in-flight requests
+	// before closing their connections.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// TLSCertFile and TLSKeyFile make the server terminate TLS itself, with
+	// HTTP/2 enabled. Both must be set together.
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+}
+
+type MetricsConfig struct {
+	SampleRate float64 `json:"sample_rate"`
+	// Descriptions are the descricao values that get their own label in
+	// transactions_by_description_total; the rest are counted as "other".
+	Descriptions []string `json:"descriptions"`
+	// Persist saves the counters to PersistFile on shutdown and adds them
+	// back on startup, so totals survive restarts. See persistedCounters
+	// for what it doesn't cover.
+	Persist     bool   `json:"persist"`
+	PersistFile string `json:"persist_file"`
+	// Exemplars attaches the trace id of requests carrying a W3C traceparent
+	// header to their http_request_duration_seconds observations, and serves
+	// /metrics in the OpenMetrics format to scrapers asking for it, the only
+	// one with exemplars. It's for deployments traced upstream, by a proxy
+	// or the caller; off, the header isn't even read.
+	Exemplars bool `json:"exemplars"`
+}
+
+type TransactionsConfig struct {
+	NormalizeDescricao bool `json:"normalize_descricao"`
+	// AllowedDescricoes, when set, is the only descricao values accepted.
+	// DeniedDescricoes are rejected. Both match case-insensitively.
+	AllowedDescricoes  []string `json:"allowed_descricoes"`
+	DeniedDescricoes   []string `json:"denied_descricoes"`
+	StrictConsistency  bool     `json:"strict_consistency"`
+	DefaultCreditLimit int      `json:"default_credit_limit"`
+	MinValue           int      `json:"min_transaction_value"`
+	// MaxValue rejects transactions above it. Zero disables the check.
+	MaxValue int `json:"max_transaction_value"`
+	// MaxPerCustomer rejects transactions of customers that already have
+	// this many. Zero disables the check.
+	MaxPerCustomer int `json:"max_transactions_per_customer"`
+	// GroupCommitWindow enables group commit, collecting credits and debits
+	// for this long before applying them in a single DB transaction. It
+	// can't be combined with Workers, MaxRetries, DB.MaxConcurrentPerCustomer
+	// or chaos mode.
+	GroupCommitWindow Duration `json:"group_commit_window"`
+	// Workers enables the worker pool, running credits and debits on this
+	// many goroutines with up to QueueSize of them waiting.
+	Workers   int `json:"workers"`
+	QueueSize int `json:"queue_size"`
+	// DedupWindow enables suppressing a transaction identical (customer,
+	// value, type and descricao) to one completed within the window.
+	DedupWindow Duration `json:"dedup_window"`
+	// MaxRetries is how many times a credit or debit failing with a
+	// serialization failure or deadlock is retried. Zero disables retries.
+	MaxRetries int `json:"max_retries"`
+	// RetryBudget caps the retries per second across all requests. It's
+	// reloadable.
+	RetryBudget float64 `json:"retry_budget"`
+	// Created201 answers applied transactions with 201 and the Location of
+	// the new transaction instead of 200.
+	Created201 bool `json:"created_201"`
+	// CreditBuffer is the file credits are kept in while the database can't
+	// be reached, answering 202 until they're applied. Empty disables it.
+	CreditBuffer string `json:"credit_buffer"`
+	// ReconcileInterval enables checking this often that every balance is
+	// the sum of its transactions. Zero disables it.
+	ReconcileInterval Duration `json:"reconcile_interval"`
+	// AuditLog is where every credit and debit attempt is recorded:
+	// "stdout", a file path, or "off", the default. Entries are written
+	// synchronously, on the request path.
+	AuditLog string `json:"audit_log"`
+}
+
+// ChaosConfig sets up failure injection for resilience testing. Nothing is
+// injected unless Enabled is set.
+type ChaosConfig struct {
+	Enabled bool `json:"enabled"`
+	// ErrorRate is the probability of failing an operation with 503.
+	ErrorRate float64 `json:"error_rate"`
+	// LatencyRate is the probability of delaying an operation by Latency.
+	LatencyRate float64  `json:"latency_rate"`
+	Latency     Duration `json:"latency"`
+}
+
+// maxDescriptionLabels bounds the cardinality of
+// transactions_by_description_total.
+const maxDescriptionLabels = 50
+
+// Duration is a time.Duration written as a string such as "1.5s" in the
+// config file.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func defaultConfig() Config {
+	return Config{
+		DB: DBConfig{
+			URL:                   "user=db password=db host=db port=5432 dbname=db",
+			MaxReplicaLag:         Duration{5 * time.Second},
+			MaxConns:              50,
+			MinConns:              49,
+			Shards:                1,
+			StatementOrderBy:      "id",
+			DrainTimeout:          Duration{10 * time.Second},
+			ReconnectWindow:       Duration{5 * time.Second},
+			MaxConnLifetimeJitter: Duration{12 * time.Minute}, // a tenth of the lifetime
+			HealthCheckPeriod:     Duration{10 * time.Minute},
+		},
+		Transactions: TransactionsConfig{
+			MinValue:    1,
+			AuditLog:    "off",
+			QueueSize:   100,
+			RetryBudget: 10,
+		},
+		Server: ServerConfig{
+			ListenAddr:      ":8080",
+			Timezone:        "America/Sao_Paulo",
+			LogLevel:        "info",
+			MaxBodyBytes:    64 << 10,
+			AccessLogFormat: "json",
+			KeepAlives:      true,
+			ShutdownTimeout: Duration{10 * time.Second},
+		},
+		Metrics: MetricsConfig{
+			SampleRate:  1,
+			PersistFile: "metrics.json",
+		},
+	}
+}
+
+// LoadConfig builds the Config from the defaults, the optional CONFIG_FILE and
+// the environment, in increasing order of precedence.
+func LoadConfig() (Config, error) {
+	cfg := defaultConfig()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return cfg, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+
+	err := errors.Join(
+		envString("DATABASE_URL", &cfg.DB.URL),
+		envString("DB_REPLICA_URL", &cfg.DB.ReplicaURL),
+		envDuration("REPLICA_MAX_LAG", &cfg.DB.MaxReplicaLag),
+		envDuration("DB_LOCK_TIMEOUT", &cfg.DB.LockTimeout),
+		envDuration("DB_STATEMENT_TIMEOUT", &cfg.DB.StatementTimeout),
+		envString("DB_STATEMENT_ORDER_BY", &cfg.DB.StatementOrderBy),
+		envBool("DB_PREFER_SIMPLE_PROTOCOL", &cfg.DB.PreferSimpleProtocol),
+		envBool("PGBOUNCER_COMPAT", &cfg.DB.PgBouncerCompat),
+		envBool("DB_TRACE", &cfg.DB.Trace),
+		envInt("DB_MAX_CONCURRENT_PER_CUSTOMER", &cfg.DB.MaxConcurrentPerCustomer),
+		envInt("DB_MAX_CONCURRENT_READS", &cfg.DB.MaxConcurrentReads),
+		envInt32("DB_MAX_CONNS", &cfg.DB.MaxConns),
+		envInt("DB_POOL_SHARDS", &cfg.DB.Shards),
+		envInt32("DB_MIN_CONNS", &cfg.DB.MinConns),
+		envDuration("DB_DRAIN_TIMEOUT", &cfg.DB.DrainTimeout),
+		envDuration("DB_RECONNECT_WINDOW", &cfg.DB.ReconnectWindow),
+		envDuration("DB_MAX_CONN_LIFETIME_JITTER", &cfg.DB.MaxConnLifetimeJitter),
+		envDuration("DB_HEALTH_CHECK_PERIOD", &cfg.DB.HealthCheckPeriod),
+		envString("LISTEN_ADDR", &cfg.Server.ListenAddr),
+		envString("API_KEY", &cfg.Server.APIKey),
+		envString("PATH_PREFIX", &cfg.Server.PathPrefix),
+		envCustomerKeys("CUSTOMER_API_KEYS", &cfg.Server.CustomerAPIKeys),
+		envBool("ENABLE_RESET", &cfg.Server.EnableReset),
+		envString("TIMEZONE", &cfg.Server.Timezone),
+		envString("LOG_LEVEL", &cfg.Server.LogLevel),
+		envBool("ACCESS_LOG", &cfg.Server.AccessLog),
+		envString("ACCESS_LOG_FORMAT", &cfg.Server.AccessLogFormat),
+		envDuration("STATEMENT_MAX_AGE", &cfg.Server.StatementMaxAge),
+		envDuration("STATEMENT_CACHE_TTL", &cfg.Server.StatementCacheTTL),
+		envDuration("STATEMENT_QUERY_TIMEOUT", &cfg.Server.StatementQueryTimeout),
+		envBool("FAST_JSON", &cfg.Server.FastJSON),
+		envBool("JSON_LARGE_NUMBERS_AS_STRINGS", &cfg.Server.LargeNumbersAsStrings),
+		envInt("HTTP_MAX_HEADER_BYTES", &cfg.Server.MaxHeaderBytes),
+		envInt64("HTTP_MAX_BODY_BYTES", &cfg.Server.MaxBodyBytes),
+		envBool("HTTP_KEEP_ALIVES", &cfg.Server.KeepAlives),
+		envDuration("HTTP_SHUTDOWN_TIMEOUT", &cfg.Server.ShutdownTimeout),
+		envInt("HTTP_MAX_CONNECTIONS", &cfg.Server.MaxConnections),
+		envString("TLS_CERT_FILE", &cfg.Server.TLSCertFile),
+		envString("TLS_KEY_FILE", &cfg.Server.TLSKeyFile),
+		envFloat("METRICS_SAMPLE_RATE", &cfg.Metrics.SampleRate),
+		envStringList("METRICS_DESCRIPTIONS", &cfg.Metrics.Descriptions),
+		envBool("PERSIST_METRICS", &cfg.Metrics.Persist),
+		envBool("METRICS_EXEMPLARS", &cfg.Metrics.Exemplars),
+		envString("METRICS_PERSIST_FILE", &cfg.Metrics.PersistFile),
+		envBool("CHAOS_ENABLED", &cfg.Chaos.Enabled),
+		envFloat("CHAOS_ERROR_RATE", &cfg.Chaos.ErrorRate),
+		envFloat("CHAOS_LATENCY_RATE", &cfg.Chaos.LatencyRate),
+		envDuration("CHAOS_LATENCY", &cfg.Chaos.Latency),
+		envBool("NORMALIZE_DESCRICAO", &cfg.Transactions.NormalizeDescricao),
+		envStringList("DESCRICAO_ALLOWLIST", &cfg.Transactions.AllowedDescricoes),
+		envStringList("DESCRICAO_DENYLIST", &cfg.Transactions.DeniedDescricoes),
+		envBool("STRICT_CONSISTENCY", &cfg.Transactions.StrictConsistency),
+		envInt("DEFAULT_CREDIT_LIMIT", &cfg.Transactions.DefaultCreditLimit),
+		envInt("MIN_TRANSACTION_VALUE", &cfg.Transactions.MinValue),
+		envInt("MAX_TRANSACTION_VALUE", &cfg.Transactions.MaxValue),
+		envInt("MAX_TRANSACTIONS_PER_CUSTOMER", &cfg.Transactions.MaxPerCustomer),
+		envDuration("GROUP_COMMIT_WINDOW", &cfg.Transactions.GroupCommitWindow),
+		envDuration("DEDUP_WINDOW", &cfg.Transactions.DedupWindow),
+		envString("AUDIT_LOG", &cfg.Transactions.AuditLog),
+		envInt("WORKER_POOL_SIZE", &cfg.Transactions.Workers),
+		envInt("WORKER_QUEUE_SIZE", &cfg.Transactions.QueueSize),
+		envInt("TX_MAX_RETRIES", &cfg.Transactions.MaxRetries),
+		envFloat("RETRY_BUDGET", &cfg.Transactions.RetryBudget),
+		envString("CREDIT_BUFFER_FILE", &cfg.Transactions.CreditBuffer),
+		envBool("TRANSACTION_201", &cfg.Transactions.Created201),
+		envDuration("RECONCILE_INTERVAL", &cfg.Transactions.ReconcileInterval),
+	)
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.validate()
+}
+
+func (c Config) validate() error {
+	if c.DB.URL == "" {
+		return errors.New("database url must not be empty")
+	}
+	if c.DB.MaxConns < 1 {
+		return fmt.Errorf("max conns must be positive, got %d", c.DB.MaxConns)
+	}
+	if c.DB.Shards < 1 || c.DB.Shards > int(c.DB.MaxConns) {
+		return fmt.Errorf("pool shards must be between 1 and max conns (%d), got %d", c.DB.MaxConns, c.DB.Shards)
+	}
+	if c.DB.MinConns < 0 || c.DB.MinConns > c.DB.MaxConns {
+		return fmt.Errorf("min conns must be between 0 and max conns (%d), got %d", c.DB.MaxConns, c.DB.MinConns)
+	}
+	if c.DB.HealthCheckPeriod.Duration <= 0 {
+		return fmt.Errorf("health check period must be positive, got %s", c.DB.HealthCheckPeriod)
+	}
+	if c.DB.MaxConnLifetimeJitter.Duration < 0 {
+		return fmt.Errorf("max conn lifetime jitter must not be negative, got %s", c.DB.MaxConnLifetimeJitter)
+	}
+	if c.DB.ReconnectWindow.Duration < 0 {
+		return fmt.Errorf("reconnect window must not be negative, got %s", c.DB.ReconnectWindow)
+	}
+	if c.DB.DrainTimeout.Duration < 0 {
+		return fmt.Errorf("drain timeout must not be negative, got %s", c.DB.DrainTimeout)
+	}
+	if c.DB.MaxReplicaLag.Duration <= 0 {
+		return fmt.Errorf("max replica lag must be positive, got %s", c.DB.MaxReplicaLag)
+	}
+	if c.DB.StatementTimeout.Duration < 0 {
+		return fmt.Errorf("statement timeout must not be negative, got %s", c.DB.StatementTimeout)
+	}
+	if c.DB.StatementOrderBy != "id" && c.DB.StatementOrderBy != "created_at" {
+		return fmt.Errorf("statement order by must be id or created_at, got %q", c.DB.StatementOrderBy)
+	}
+	if c.DB.LockTimeout.Duration < 0 {
+		return fmt.Errorf("lock timeout must not be negative, got %s", c.DB.LockTimeout)
+	}
+	if c.Server.StatementCacheTTL.Duration < 0 {
+		return fmt.Errorf("statement cache TTL must not be negative, got %s", c.Server.StatementCacheTTL)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Server.LogLevel)); err != nil {
+		return fmt.Errorf("log level must be debug, info, warn or error, got %q", c.Server.LogLevel)
+	}
+	if c.Server.AccessLogFormat != "json" && c.Server.AccessLogFormat != "combined" {
+		return fmt.Errorf("access log format must be json or combined, got %q", c.Server.AccessLogFormat)
+	}
+	if c.Server.StatementQueryTimeout.Duration < 0 {
+		return fmt.Errorf("statement query timeout must not be negative, got %s", c.Server.StatementQueryTimeout)
+	}
+	if c.Server.ShutdownTimeout.Duration <= 0 {
+		return fmt.Errorf("shutdown timeout must be positive, got %s", c.Server.ShutdownTimeout)
+	}
+	if c.Server.StatementMaxAge.Duration < 0 {
+		return fmt.Errorf("statement max age must not be negative, got %s", c.Server.StatementMaxAge)
+	}
+	if c.Server.MaxBodyBytes < 0 {
+		return fmt.Errorf("max body bytes must not be negative, got %d", c.Server.MaxBodyBytes)
+	}
+	if c.Server.MaxHeaderBytes < 0 {
+		return fmt.Errorf("max header bytes must not be negative, got %d", c.Server.MaxHeaderBytes)
+	}
+	if c.Server.MaxConnections < 0 {
+		return fmt.Errorf("max connections must not be negative, got %d", c.Server.MaxConnections)
+	}
+	if (c.Server.TLSCertFile == "") != (c.Server.TLSKeyFile == "") {
+		return errors.New("tls cert file and key file must be set together")
+	}
+	if c.DB.MaxConcurrentPerCustomer < 0 {
+		return fmt.Errorf("max concurrent operations per customer must not be negative, got %d", c.DB.MaxConcurrentPerCustomer)
+	}
+	for key, ids := range c.Server.CustomerAPIKeys {
+		if key == "" || len(ids) == 0 {
+			return errors.New("customer api keys must not be empty nor map to no customers")
+		}
+	}
+	if c.DB.MaxConcurrentReads < 0 {
+		return fmt.Errorf("max concurrent reads must not be negative, got %d", c.DB.MaxConcurrentReads)
+	}
+	if c.Server.PathPrefix != "" && (!strings.HasPrefix(c.Server.PathPrefix, "/") || strings.HasSuffix(c.Server.PathPrefix, "/")) {
+		return fmt.Errorf("path prefix must start and not end with a slash, got %q", c.Server.PathPrefix)
+	}
+	if c.Server.ListenAddr == "" {
+		return errors.New("listen address must not be empty")
+	}
+	if c.Metrics.SampleRate <= 0 || c.Metrics.SampleRate > 1 {
+		return fmt.Errorf("metrics sample rate must be in (0, 1], got %v", c.Metrics.SampleRate)
+	}
+	if c.Chaos.ErrorRate < 0 || c.Chaos.ErrorRate > 1 {
+		return fmt.Errorf("chaos error rate must be in [0, 1], got %v", c.Chaos.ErrorRate)
+	}
+	if c.Chaos.LatencyRate < 0 || c.Chaos.LatencyRate > 1 {
+		return fmt.Errorf("chaos latency rate must be in [0, 1], got %v", c.Chaos.LatencyRate)
+	}
+	if c.Chaos.Latency.Duration < 0 {
+		return fmt.Errorf("chaos latency must not be negative, got %s", c.Chaos.Latency)
+	}
+	if c.Metrics.Persist && c.Metrics.PersistFile == "" {
+		return errors.New("metrics persist file must not be empty")
+	}
+	if len(c.Metrics.Descriptions) > maxDescriptionLabels {
+		return fmt.Errorf("at most %d metrics descriptions are allowed, got %d", maxDescriptionLabels, len(c.Metrics.Descriptions))
+	}
+	if c.Transactions.DefaultCreditLimit < 0 {
+		return fmt.Errorf("default credit limit must not be negative, got %d", c.Transactions.DefaultCreditLimit)
+	}
+	if c.Transactions.MinValue < 1 {
+		return fmt.Errorf("min transaction value must be positive, got %d", c.Transactions.MinValue)
+	}
+	if c.Transactions.MaxValue != 0 && c.Transactions.MaxValue < c.Transactions.MinValue {
+		return fmt.Errorf("max transaction value must be zero or at least the min (%d), got %d", c.Transactions.MinValue, c.Transactions.MaxValue)
+	}
+	if c.Transactions.MaxPerCustomer < 0 {
+		return fmt.Errorf("max transactions per customer must not be negative, got %d", c.Transactions.MaxPerCustomer)
+	}
+	if c.Transactions.Workers < 0 {
+		return fmt.Errorf("workers must not be negative, got %d", c.Transactions.Workers)
+	}
+	if c.Transactions.Workers > 0 && c.Transactions.QueueSize < 1 {
+		return fmt.Errorf("queue size must be positive, got %d", c.Transactions.QueueSize)
+	}
+	if c.Transactions.MaxRetries < 0 {
+		return fmt.Errorf("max retries must not be negative, got %d", c.Transactions.MaxRetries)
+	}
+	if c.Transactions.MaxRetries > 0 && c.Transactions.RetryBudget <= 0 {
+		return fmt.Errorf("retry budget must be positive, got %v", c.Transactions.RetryBudget)
+	}
+	if c.Transactions.ReconcileInterval.Duration < 0 {
+		return fmt.Errorf("reconcile interval must not be negative, got %s", c.Transactions.ReconcileInterval)
+	}
+	if c.Transactions.DedupWindow.Duration < 0 {
+		return fmt.Errorf("dedup window must not be negative, got %s", c.Transactions.DedupWindow)
+	}
+	if c.Transactions.GroupCommitWindow.Duration < 0 {
+		return fmt.Errorf("group commit window must not be negative, got %s", c.Transactions.GroupCommitWindow)
+	}
+	// Group commit applies operations through a batch, which goes around the
+	// stores that only wrap single credits and debits, and skips the strict
+	// consistency check.
+	if c.Transactions.GroupCommitWindow.Duration > 0 {
+		switch {
+		case c.Transactions.Workers > 0:
+			return errors.New("group commit can't be combined with the worker pool")
+		case c.Transactions.MaxRetries > 0:
+			return errors.New("group commit can't be combined with retries")
+		case c.DB.MaxConcurrentPerCustomer > 0:
+			return errors.New("group commit can't be combined with a per-customer concurrency cap")
+		case c.Chaos.Enabled:
+			return errors.New("group commit can't be combined with chaos mode")
+		case c.Transactions.StrictConsistency:
+			return errors.New("group commit can't be combined with strict consistency")
+		}
+	}
+	return nil
+}
+
+func envString(name string, dst *string) error {
+	if v := os.Getenv(name); v != "" {
+		*dst = v
+	}
+	return nil
+}
+
+func envBool(name string, dst *bool) error {
+	if v := os.Getenv(name); v != "" {
+		*dst = v == "true"
+	}
+	return nil
+}
+
+// envStringList reads a comma-separated list, ignoring empty items.
+func envStringList(name string, dst *[]string) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	*dst = nil
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*dst = append(*dst, item)
+		}
+	}
+	return nil
+}
+
+// envCustomerKeys reads a comma-separated list of key=id|id|... items.
+func envCustomerKeys(name string, dst *map[string][]int) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	*dst = make(map[string][]int)
+	for _, item := range strings.Split(v, ",") {
+		key, list, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return fmt.Errorf("%s: %q is not key=ids", name, item)
+		}
+		for _, id := range strings.Split(list, "|") {
+			n, err := strconv.Atoi(id)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			(*dst)[key] = append((*dst)[key], n)
+		}
+	}
+	return nil
+}
+
+func envInt(name string, dst *int) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	*dst = n
+	return nil
+}
+
+func envInt64(name string, dst *int64) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	*dst = n
+	return nil
+}
+
+func envInt32(name string, dst *int32) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.ParseInt(v, 10, 32)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	*dst = int32(n)
+	return nil
+}
+
+func envFloat(name string, dst *float64) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	*dst = f
+	return nil
+}
+
+func envDuration(name string, dst *Duration) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	dst.Duration = d
+	return nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes content to a file and points CONFIG_FILE at it.
+func writeConfigFile(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		check   func(Config) bool
+		wantErr bool
+	}{
+		{
+			name: "file overrides defaults",
+			file: `{"db": {"url": "host=file", "lock_timeout": "150ms"}, "server": {"listen_addr": ":9000"}}`,
+			check: func(c Config) bool {
+				return c.DB.URL == "host=file" && c.DB.LockTimeout.Duration == 150*time.Millisecond && c.Server.ListenAddr == ":9000"
+			},
+		},
+		{
+			name:  "defaults kept",
+			file:  `{"server": {"listen_addr": ":9000"}}`,
+			check: func(c Config) bool { return c.DB.MaxConns == defaultConfig().DB.MaxConns },
+		},
+		{
+			name:  "env overrides file",
+			file:  `{"server": {"listen_addr": ":9000"}}`,
+			env:   map[string]string{"LISTEN_ADDR": ":9001"},
+			check: func(c Config) bool { return c.Server.ListenAddr == ":9001" },
+		},
+		{
+			name:  "empty env ignored",
+			file:  `{"server": {"listen_addr": ":9000"}}`,
+			env:   map[string]string{"LISTEN_ADDR": ""},
+			check: func(c Config) bool { return c.Server.ListenAddr == ":9000" },
+		},
+		{
+			name:  "health check period from env",
+			file:  `{"db": {"health_check_period": "1m"}}`,
+			env:   map[string]string{"DB_HEALTH_CHECK_PERIOD": "15s"},
+			check: func(c Config) bool { return c.DB.HealthCheckPeriod.Duration == 15*time.Second },
+		},
+		{
+			name:  "trace from env",
+			file:  `{"db": {"trace": false}}`,
+			env:   map[string]string{"DB_TRACE": "true"},
+			check: func(c Config) bool { return c.DB.Trace },
+		},
+		{
+			name: "customer api keys from env",
+			file: `{"server": {"customer_api_keys": {"old": [5]}}}`,
+			env:  map[string]string{"CUSTOMER_API_KEYS": "a=1, b=2|3"},
+			check: func(c Config) bool {
+				return len(c.Server.CustomerAPIKeys) == 2 &&
+					slices.Equal(c.Server.CustomerAPIKeys["a"], []int{1}) &&
+					slices.Equal(c.Server.CustomerAPIKeys["b"], []int{2, 3})
+			},
+		},
+		{name: "malformed customer api keys", file: `{}`, env: map[string]string{"CUSTOMER_API_KEYS": "a:1"}, wantErr: true},
+		{
+			name:  "pool shards from env",
+			file:  `{"db": {"shards": 1}}`,
+			env:   map[string]string{"DB_POOL_SHARDS": "4"},
+			check: func(c Config) bool { return c.DB.Shards == 4 },
+		},
+		{
+			name:  "reset from env",
+			file:  `{"server": {"enable_reset": false}}`,
+			env:   map[string]string{"ENABLE_RESET": "true"},
+			check: func(c Config) bool { return c.Server.EnableReset },
+		},
+		{
+			name:  "access log format from env",
+			file:  `{"server": {"access_log_format": "json"}}`,
+			env:   map[string]string{"ACCESS_LOG_FORMAT": "combined"},
+			check: func(c Config) bool { return c.Server.AccessLogFormat == "combined" },
+		},
+		{
+			name:  "max body bytes from env",
+			file:  `{"server": {"max_body_bytes": 1024}}`,
+			env:   map[string]string{"HTTP_MAX_BODY_BYTES": "2048"},
+			check: func(c Config) bool { return c.Server.MaxBodyBytes == 2048 },
+		},
+		{
+			name:  "persisted metrics from env",
+			file:  `{}`,
+			env:   map[string]string{"PERSIST_METRICS": "true", "METRICS_PERSIST_FILE": "/data/metrics.json"},
+			check: func(c Config) bool { return c.Metrics.Persist && c.Metrics.PersistFile == "/data/metrics.json" },
+		},
+		{
+			name: "descricao lists from env",
+			file: `{}`,
+			env:  map[string]string{"DESCRICAO_ALLOWLIST": "pix,ted", "DESCRICAO_DENYLIST": "admin"},
+			check: func(c Config) bool {
+				return slices.Equal(c.Transactions.AllowedDescricoes, []string{"pix", "ted"}) && slices.Equal(c.Transactions.DeniedDescricoes, []string{"admin"})
+			},
+		},
+		{
+			name:  "statement order by from env",
+			file:  `{"db": {"statement_order_by": "id"}}`,
+			env:   map[string]string{"DB_STATEMENT_ORDER_BY": "created_at"},
+			check: func(c Config) bool { return c.DB.StatementOrderBy == "created_at" },
+		},
+		{
+			name:  "exemplars from env",
+			file:  `{}`,
+			env:   map[string]string{"METRICS_EXEMPLARS": "true"},
+			check: func(c Config) bool { return c.Metrics.Exemplars },
+		},
+		{
+			name:  "audit log off by default",
+			file:  `{}`,
+			check: func(c Config) bool { return c.Transactions.AuditLog == "off" },
+		},
+		{
+			name:  "audit log from env",
+			file:  `{"transactions": {"audit_log": "off"}}`,
+			env:   map[string]string{"AUDIT_LOG": "stdout"},
+			check: func(c Config) bool { return c.Transactions.AuditLog == "stdout" },
+		},
+		{
+			name:  "transaction 201 from env",
+			file:  `{}`,
+			env:   map[string]string{"TRANSACTION_201": "true"},
+			check: func(c Config) bool { return c.Transactions.Created201 },
+		},
+		{
+			name:  "statement query timeout from env",
+			file:  `{"server": {"statement_query_timeout": "1s"}}`,
+			env:   map[string]string{"STATEMENT_QUERY_TIMEOUT": "250ms"},
+			check: func(c Config) bool { return c.Server.StatementQueryTimeout.Duration == 250*time.Millisecond },
+		},
+		{
+			name:  "path prefix from env",
+			file:  `{}`,
+			env:   map[string]string{"PATH_PREFIX": "/api"},
+			check: func(c Config) bool { return c.Server.PathPrefix == "/api" },
+		},
+		{
+			name:  "reconnect window from env",
+			file:  `{}`,
+			env:   map[string]string{"DB_RECONNECT_WINDOW": "0s"},
+			check: func(c Config) bool { return c.DB.ReconnectWindow.Duration == 0 },
+		},
+		{
+			name:  "conn lifetime jitter from env",
+			file:  `{"db": {"max_conn_lifetime_jitter": "1m"}}`,
+			env:   map[string]string{"DB_MAX_CONN_LIFETIME_JITTER": "3m"},
+			check: func(c Config) bool { return c.DB.MaxConnLifetimeJitter.Duration == 3*time.Minute },
+		},
+		{name: "malformed", file: `{"server": `, wantErr: true},
+		{name: "bad duration", file: `{"db": {"lock_timeout": "soon"}}`, wantErr: true},
+		{name: "invalid values", file: `{"db": {"max_conns": 0}}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeConfigFile(t, tt.file)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			cfg, err := LoadConfig()
+			if tt.wantErr {
+				if err == nil {
+					t.Error("LoadConfig succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if !tt.check(cfg) {
+				t.Errorf("unexpected config: %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	t.Setenv("CONFIG_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	if _, err := LoadConfig(); err == nil {
+		t.Error("LoadConfig succeeded with a missing file")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(*Config)
+		wantErr bool
+	}{
+		{"defaults", func(*Config) {}, false},
+		{"no database url", func(c *Config) { c.DB.URL = "" }, true},
+		{"no connections", func(c *Config) { c.DB.MaxConns = 0 }, true},
+		{"more min than max conns", func(c *Config) { c.DB.MinConns = c.DB.MaxConns + 1 }, true},
+		{"no listen address", func(c *Config) { c.Server.ListenAddr = "" }, true},
+		{"unknown log level", func(c *Config) { c.Server.LogLevel = "loud" }, true},
+		{"negative lock timeout", func(c *Config) { c.DB.LockTimeout = Duration{-time.Second} }, true},
+		{"zero min transaction value", func(c *Config) { c.Transactions.MinValue = 0 }, true},
+		{"min transaction value of 100", func(c *Config) { c.Transactions.MinValue = 100 }, false},
+		{"max below min transaction value", func(c *Config) { c.Transactions.MinValue, c.Transactions.MaxValue = 100, 50 }, true},
+		{"max transaction value", func(c *Config) { c.Transactions.MaxValue = 1000 }, false},
+		{"negative drain timeout", func(c *Config) { c.DB.DrainTimeout = Duration{-time.Second} }, true},
+		{"no shutdown timeout", func(c *Config) { c.Server.ShutdownTimeout = Duration{} }, true},
+		{"too many metrics descriptions", func(c *Config) { c.Metrics.Descriptions = make([]string, maxDescriptionLabels+1) }, true},
+		{"negative max retries", func(c *Config) { c.Transactions.MaxRetries = -1 }, true},
+		{"retries without budget", func(c *Config) { c.Transactions.MaxRetries, c.Transactions.RetryBudget = 2, 0 }, true},
+		{"retries with budget", func(c *Config) { c.Transactions.MaxRetries, c.Transactions.RetryBudget = 2, 0.5 }, false},
+		{"customer api keys", func(c *Config) { c.Server.CustomerAPIKeys = map[string][]int{"k": {1, 2}} }, false},
+		{"empty customer api key", func(c *Config) { c.Server.CustomerAPIKeys = map[string][]int{"": {1}} }, true},
+		{"customer api key without customers", func(c *Config) { c.Server.CustomerAPIKeys = map[string][]int{"k": {}} }, true},
+		{"pool shards", func(c *Config) { c.DB.Shards = 2 }, false},
+		{"no pool shards", func(c *Config) { c.DB.Shards = 0 }, true},
+		{"more pool shards than connections", func(c *Config) { c.DB.Shards = int(c.DB.MaxConns) + 1 }, true},
+		{"reconcile interval", func(c *Config) { c.Transactions.ReconcileInterval = Duration{time.Minute} }, false},
+		{"negative reconcile interval", func(c *Config) { c.Transactions.ReconcileInterval = Duration{-time.Minute} }, true},
+		{"negative statement query timeout", func(c *Config) { c.Server.StatementQueryTimeout = Duration{-time.Second} }, true},
+		{"path prefix", func(c *Config) { c.Server.PathPrefix = "/api" }, false},
+		{"path prefix without leading slash", func(c *Config) { c.Server.PathPrefix = "api" }, true},
+		{"path prefix with trailing slash", func(c *Config) { c.Server.PathPrefix = "/api/" }, true},
+		{"negative reconnect window", func(c *Config) { c.DB.ReconnectWindow = Duration{-time.Second} }, true},
+		{"negative conn lifetime jitter", func(c *Config) { c.DB.MaxConnLifetimeJitter = Duration{-time.Minute} }, true},
+		{"combined access log", func(c *Config) { c.Server.AccessLogFormat = "combined" }, false},
+		{"unknown access log format", func(c *Config) { c.Server.AccessLogFormat = "common" }, true},
+		{"no body limit", func(c *Config) { c.Server.MaxBodyBytes = 0 }, false},
+		{"negative body limit", func(c *Config) { c.Server.MaxBodyBytes = -1 }, true},
+		{"persisted metrics", func(c *Config) { c.Metrics.Persist = true }, false},
+		{"persisted metrics without a file", func(c *Config) { c.Metrics.Persist, c.Metrics.PersistFile = true, "" }, true},
+		{"statement order by created_at", func(c *Config) { c.DB.StatementOrderBy = "created_at" }, false},
+		{"unknown statement order by", func(c *Config) { c.DB.StatementOrderBy = "amount" }, true},
+		{"group commit", func(c *Config) { c.Transactions.GroupCommitWindow = Duration{time.Millisecond} }, false},
+		{"group commit with strict consistency", func(c *Config) {
+			c.Transactions.GroupCommitWindow = Duration{time.Millisecond}
+			c.Transactions.StrictConsistency = true
+		}, true},
+		{"group commit with workers", func(c *Config) {
+			c.Transactions.GroupCommitWindow = Duration{time.Millisecond}
+			c.Transactions.Workers = 4
+		}, true},
+		{"group commit with retries", func(c *Config) {
+			c.Transactions.GroupCommitWindow = Duration{time.Millisecond}
+			c.Transactions.MaxRetries = 2
+		}, true},
+		{"group commit with per-customer cap", func(c *Config) {
+			c.Transactions.GroupCommitWindow = Duration{time.Millisecond}
+			c.DB.MaxConcurrentPerCustomer = 2
+		}, true},
+		{"group commit with chaos", func(c *Config) {
+			c.Transactions.GroupCommitWindow = Duration{time.Millisecond}
+			c.Chaos.Enabled = true
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			tt.setup(&cfg)
+			if err := cfg.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnvParsers(t *testing.T) {
+	t.Setenv("TEST_INT", "12")
+	t.Setenv("TEST_BAD_INT", "twelve")
+	t.Setenv("TEST_INT32", "3000000000")
+	t.Setenv("TEST_DURATION", "1.5s")
+	t.Setenv("TEST_BOOL", "true")
+	t.Setenv("TEST_LIST", " a, ,b ")
+
+	var n int
+	if err := envInt("TEST_INT", &n); err != nil || n != 12 {
+		t.Errorf("envInt = %d, %v; want 12", n, err)
+	}
+	if err := envInt("TEST_BAD_INT", &n); err == nil {
+		t.Error("envInt accepted a word")
+	}
+	if err := envInt("TEST_UNSET", &n); err != nil || n != 12 {
+		t.Errorf("envInt of an unset variable = %d, %v; want it left alone", n, err)
+	}
+	var n32 int32
+	if err := envInt32("TEST_INT32", &n32); err == nil {
+		t.Error("envInt32 accepted a value out of range")
+	}
+	var d Duration
+	if err := envDuration("TEST_DURATION", &d); err != nil || d.Duration != 1500*time.Millisecond {
+		t.Errorf("envDuration = %s, %v; want 1.5s", d, err)
+	}
+	var b bool
+	if err := envBool("TEST_BOOL", &b); err != nil || !b {
+		t.Errorf("envBool = %v, %v; want true", b, err)
+	}
+	var list []string
+	if err := envStringList("TEST_LIST", &list); err != nil || len(list) != 2 || list[0] != "a" || list[1] != "b" {
+		t.Errorf("envStringList = %q, %v; want [a b]", list, err)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+var errCreditBuffered = errors.New("credit buffered until the database is reachable")
+
+const (
+	// creditBufferReplayInterval is how often buffered credits are retried.
+	creditBufferReplayInterval = time.Second
+	// creditBufferReplayTimeout bounds a replay, so one stuck on the database
+	// gives way to the next tick.
+	creditBufferReplayTimeout = 5 * time.Second
+)
+
+type bufferedCredit struct {
+	CustomerID int    `json:"customer_id"`
+	Value      int    `json:"value"`
+	Desc       string `json:"desc"`
+}
+
+// creditBufferStore keeps credits that failed because the database couldn't
+// be reached in a file, one JSON line each, and applies them in order once
+// it's back. The caller gets errCreditBuffered, answered with 202. Credits
+// have no business rule that can reject them, so accepting one before it's
+// applied is safe; debits need the limit check and stay synchronous.
+//
+// A buffered credit may land after debits accepted later, which can then be
+// refused for a balance the customer would have had.
+//
+// The checks of the stores below, such as the transaction cap, only run when
+// a buffered credit is replayed. A credit failing with an error that can't go
+// away, such as an unknown customer, is logged, counted in
+// buffered_credits_dropped_total and dropped; any other error leaves it and
+// the ones after it for the next replay. Replayed and dropped credits are
+// recorded in the audit log, if any.
+type creditBufferStore struct {
+	Store
+	logger *slog.Logger
+	audit  *AuditLogger
+	path   string
+
+	// replaying serializes replays, which run without mu so Credit isn't
+	// held up by the database.
+	replaying sync.Mutex
+
+	mu      sync.Mutex
+	pending []bufferedCredit
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newCreditBufferStore loads the credits left in path by a previous run and
+// starts replaying them until Close.
+func newCreditBufferStore(store Store, path string, logger *slog.Logger, audit *AuditLogger) (*creditBufferStore, error) {
+	s := &creditBufferStore{Store: store, logger: logger, audit: audit, path: path, done: make(chan struct{})}
+
+	f, err := os.Open(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if f != nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var c bufferedCredit
+			if err := json.Unmarshal(sc.Bytes(), &c); err != nil {
+				return nil, fmt.Errorf("reading %s: %w", path, err)
+			}
+			s.pending = append(s.pending, c)
+		}
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go s.replayEvery(ctx, creditBufferReplayInterval)
+	return s, nil
+}
+
+func (s *creditBufferStore) replayEvery(ctx context.Context, interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.replay(ctx)
+		}
+	}
+}
+
+// Close stops replaying, waiting for a replay under way. The credits still
+// pending stay in the file for the next run.
+func (s *creditBufferStore) Close() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+func (s *creditBufferStore) Credit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	s.mu.Lock()
+	buffering := len(s.pending) > 0
+	s.mu.Unlock()
+
+	// Credits already waiting go first, so they keep their order.
+	if !buffering {
+		res, err := s.Store.Credit(ctx, customerID, value, desc)
+		if !isConnectionError(err) {
+			return res, err
+		}
+	}
+
+	if err := s.buffer(bufferedCredit{CustomerID: customerID, Value: value, Desc: desc}); err != nil {
+		return TransactionResult{}, err
+	}
+	return TransactionResult{}, errCreditBuffered
+}
+
+// buffer appends c to the file, synced before returning so the credit
+// survives a crash once the client has been told it was accepted.
+func (s *creditBufferStore) buffer(c bufferedCredit) error {
+	line, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	s.pending = append(s.pending, c)
+	return nil
+}
+
+// replay applies the buffered credits in order, stopping at the first one
+// that fails with a transient error, and rewrites the file with those left.
+// Credits buffered meanwhile are appended after the ones it read.
+func (s *creditBufferStore) replay(ctx context.Context) {
+	s.replaying.Lock()
+	defer s.replaying.Unlock()
+
+	s.mu.Lock()
+	pending := slices.Clone(s.pending)
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, creditBufferReplayTimeout)
+	defer cancel()
+	done, dropped := 0, 0
+	for _, c := range pending {
+		res, err := s.Store.Credit(ctx, c.CustomerID, c.Value, c.Desc)
+		if err != nil {
+			if !isPermanentCreditError(err) {
+				if !isConnectionError(err) {
+					s.logger.Warn("buffered credit failed, retrying later", "customer", c.CustomerID, "value", c.Value, "err", err)
+				}
+				break
+			}
+			s.logger.Error("dropping buffered credit", "customer", c.CustomerID, "value", c.Value, "err", err)
+			bufferedCreditsDroppedTotal.Inc()
+			dropped++
+		}
+		s.audit.record(c.CustomerID, c.Value, "c", res, err)
+		done++
+	}
+	if done == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = s.pending[done:]
+	s.logger.Info("replayed buffered credits", "applied", done-dropped, "dropped", dropped, "left", len(s.pending))
+	if err := s.rewrite(); err != nil {
+		s.logger.Error("rewriting credit buffer", "path", s.path, "err", err)
+	}
+}
+
+// isPermanentCreditError reports whether a credit failing with err would
+// fail the same way on every retry: an unknown customer, a value the
+// database refuses or the transaction cap. Busy and unreachable databases,
+// full queues and timeouts pass.
+func isPermanentCreditError(err error) bool {
+	if errors.Is(err, errTransactionLimit) {
+		return true
+	}
+	switch statusForDBError(err) {
+	case http.StatusNotFound, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// rewrite replaces the file with the pending credits, through a temporary
+// file so a crash leaves either the old or the new contents.
+func (s *creditBufferStore) rewrite() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, c := range s.pending {
+		enc.Encode(c)
+	}
+	if err := errors.Join(w.Flush(), f.Sync(), f.Close()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// outage makes the calls of store a request may go through fail as when the
+// database can't be reached, or succeed again when down is false.
+func outage(store *fakeStore, down bool) {
+	var err error
+	if down {
+		err = &pgconn.PgError{Code: "08006"}
+	}
+	for _, method := range []string{"Credit", "Debit", "ApplyIfBalance", "CustomerCurrency"} {
+		store.failWith(method, err)
+	}
+}
+
+// newTestCreditBuffer opens a credit buffer on path over store, closed when
+// the test ends.
+func newTestCreditBuffer(t *testing.T, store Store, path string) *creditBufferStore {
+	t.Helper()
+	buf, err := newCreditBufferStore(store, path, slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { buf.Close() })
+	return buf
+}
+
+func TestCreditBuffer(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		// wantApplied is what the transaction adds to the balance once the
+		// database is back.
+		wantApplied int
+	}{
+		{"credit", `{"valor": 100, "tipo": "c", "descricao": "x"}`, http.StatusAccepted, 100},
+		{"credit with moeda", `{"valor": 100, "tipo": "c", "descricao": "x", "moeda": "BRL"}`, http.StatusAccepted, 100},
+		{"debit", `{"valor": 100, "tipo": "d", "descricao": "x"}`, http.StatusServiceUnavailable, 0},
+		{"credit with saldo_esperado", `{"valor": 100, "tipo": "c", "descricao": "x", "saldo_esperado": 0}`, http.StatusServiceUnavailable, 0},
+		{"invalid credit", `{"valor": 0, "tipo": "c", "descricao": "x"}`, http.StatusUnprocessableEntity, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Transactions.CreditBuffer = filepath.Join(t.TempDir(), "credits.ndjson")
+			store := newFakeStore()
+			s := newTestServer(t, cfg, store)
+
+			outage(store, true)
+			for range 3 {
+				if w := do(s, "POST", "/clientes/1/transacoes", tt.body); w.Code != tt.wantStatus {
+					t.Fatalf("during the outage: status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+				}
+			}
+			b, err := os.ReadFile(cfg.Transactions.CreditBuffer)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			wantLines := 0
+			if tt.wantApplied > 0 {
+				wantLines = 3
+			}
+			if got := strings.Count(string(b), "\n"); got != wantLines {
+				t.Fatalf("%d credits in the buffer file, want %d:\n%s", got, wantLines, b)
+			}
+
+			outage(store, false)
+			s.txStore.(*creditBufferStore).replay(context.Background())
+			if got := store.customer(1).Balance; got != 3*tt.wantApplied {
+				t.Errorf("balance after recovery = %d, want %d", got, 3*tt.wantApplied)
+			}
+			if b, _ := os.ReadFile(cfg.Transactions.CreditBuffer); len(b) != 0 {
+				t.Errorf("buffer file not emptied after the replay:\n%s", b)
+			}
+		})
+	}
+}
+
+func TestCreditBufferOrder(t *testing.T) {
+	cfg := testConfig()
+	cfg.Transactions.CreditBuffer = filepath.Join(t.TempDir(), "credits.ndjson")
+	store := newFakeStore()
+	s := newTestServer(t, cfg, store)
+
+	outage(store, true)
+	for _, body := range []string{
+		`{"valor": 1, "tipo": "c", "descricao": "primeira"}`,
+		`{"valor": 2, "tipo": "c", "descricao": "segunda"}`,
+	} {
+		if w := do(s, "POST", "/clientes/1/transacoes", body); w.Code != http.StatusAccepted {
+			t.Fatalf("status = %d, want 202", w.Code)
+		}
+	}
+	// Back up, but credits are still waiting: a new one queues behind them.
+	outage(store, false)
+	if w := do(s, "POST", "/clientes/1/transacoes", `{"valor": 3, "tipo": "c", "descricao": "terceira"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202 while credits are pending", w.Code)
+	}
+	s.txStore.(*creditBufferStore).replay(context.Background())
+
+	var got []string
+	for _, tr := range store.transactions[1] {
+		got = append(got, tr.Description)
+	}
+	if strings.Join(got, ",") != "primeira,segunda,terceira" {
+		t.Errorf("applied %v, want them in the order they were accepted", got)
+	}
+}
+
+func TestCreditBufferReplayStopsOnOutage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credits.ndjson")
+	store := newFakeStore()
+	buf := newTestCreditBuffer(t, store, path)
+	outage(store, true)
+	for range 2 {
+		if _, err := buf.Credit(context.Background(), 1, 10, "x"); !errors.Is(err, errCreditBuffered) {
+			t.Fatalf("Credit: %v, want errCreditBuffered", err)
+		}
+	}
+
+	buf.replay(context.Background())
+	if got := len(buf.pending); got != 2 {
+		t.Errorf("%d credits pending after a replay during the outage, want 2", got)
+	}
+
+	// Restarting picks up the credits the file holds.
+	restarted := newTestCreditBuffer(t, store, path)
+	outage(store, false)
+	restarted.replay(context.Background())
+	if got := store.customer(1).Balance; got != 20 {
+		t.Errorf("balance after replaying from the file = %d, want 20", got)
+	}
+}
+
+// The replay tests build the buffer without its replay loop, so they can swap
+// the store under it.
+func TestCreditBufferReplayErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantDropped bool
+	}{
+		{"connection lost", &pgconn.PgError{Code: "08006"}, false},
+		{"queue full", errQueueFull, false},
+		{"customer busy", errCustomerBusy, false},
+		{"retry budget exhausted", errRetryBudgetExhausted, false},
+		{"lock timeout", &pgconn.PgError{Code: "55P03"}, false},
+		{"statement timeout", &pgconn.PgError{Code: "57014"}, false},
+		{"deadline", context.DeadlineExceeded, false},
+		{"unexpected", errors.New("boom"), false},
+		{"unknown customer", pgx.ErrNoRows, true},
+		{"constraint", &pgconn.PgError{Code: "23514"}, true},
+		{"transaction cap", errTransactionLimit, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "credits.ndjson")
+			store := newFakeStore()
+			buf := &creditBufferStore{Store: store, logger: slog.New(slog.NewTextHandler(io.Discard, nil)), path: path}
+			outage(store, true)
+			for _, desc := range []string{"primeira", "segunda"} {
+				if _, err := buf.Credit(context.Background(), 1, 10, desc); !errors.Is(err, errCreditBuffered) {
+					t.Fatalf("Credit: %v, want errCreditBuffered", err)
+				}
+			}
+			before := counterValue(t, bufferedCreditsDroppedTotal)
+
+			// Only the first replayed credit fails.
+			store.failWith("Credit", tt.err)
+			buf.Store = &failOnceStore{Store: store}
+			buf.replay(context.Background())
+
+			wantPending, wantBalance, wantDropped := 2, 0, 0.0
+			if tt.wantDropped {
+				wantPending, wantBalance, wantDropped = 0, 10, 1
+			}
+			if got := len(buf.pending); got != wantPending {
+				t.Errorf("%d credits pending, want %d", got, wantPending)
+			}
+			if got := store.customer(1).Balance; got != wantBalance {
+				t.Errorf("balance = %d, want %d", got, wantBalance)
+			}
+			if got := counterValue(t, bufferedCreditsDroppedTotal) - before; got != wantDropped {
+				t.Errorf("buffered_credits_dropped_total went up by %v, want %v", got, wantDropped)
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Count(string(b), "\n"); got != wantPending {
+				t.Errorf("%d credits in the file, want %d", got, wantPending)
+			}
+
+			// A kept credit goes through on the next replay, in order.
+			buf.replay(context.Background())
+			if got := store.customer(1).Balance; got != 20-10*int(wantDropped) {
+				t.Errorf("balance after the next replay = %d, want %d", got, 20-10*int(wantDropped))
+			}
+		})
+	}
+}
+
+// failOnceStore lets the first Credit through to the fakeStore below, set to
+// fail, and clears the failure afterwards.
+type failOnceStore struct {
+	Store
+	once sync.Once
+}
+
+func (s *failOnceStore) Credit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	res, err := s.Store.Credit(ctx, customerID, value, desc)
+	s.once.Do(func() { s.Store.(*fakeStore).failWith("Credit", nil) })
+	return res, err
+}
+
+func TestCreditBufferReplayUnlocked(t *testing.T) {
+	store := newFakeStore()
+	buf := &creditBufferStore{Store: store, logger: slog.New(slog.NewTextHandler(io.Discard, nil)), path: filepath.Join(t.TempDir(), "credits.ndjson")}
+	outage(store, true)
+	if _, err := buf.Credit(context.Background(), 1, 10, "primeira"); !errors.Is(err, errCreditBuffered) {
+		t.Fatalf("Credit: %v, want errCreditBuffered", err)
+	}
+	outage(store, false)
+
+	blocking := &hotCustomerStore{Store: store, started: make(chan struct{}, 1), release: make(chan struct{})}
+	buf.Store = blocking
+	replayed := make(chan struct{})
+	go func() {
+		buf.replay(context.Background())
+		close(replayed)
+	}()
+	<-blocking.started
+
+	// While the replay waits on the database, credits still get buffered.
+	credited := make(chan error, 1)
+	go func() {
+		_, err := buf.Credit(context.Background(), 2, 5, "segunda")
+		credited <- err
+	}()
+	select {
+	case err := <-credited:
+		if !errors.Is(err, errCreditBuffered) {
+			t.Errorf("Credit during the replay: %v, want errCreditBuffered", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Credit blocked by the replay")
+	}
+
+	close(blocking.release)
+	<-replayed
+	if len(buf.pending) != 1 || buf.pending[0].Desc != "segunda" {
+		t.Errorf("pending after the replay = %+v, want only the credit buffered during it", buf.pending)
+	}
+}
+
+func TestCreditBufferClose(t *testing.T) {
+	buf, err := newCreditBufferStore(newFakeStore(), filepath.Join(t.TempDir(), "credits.ndjson"), slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		buf.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close didn't stop the replay loop")
+	}
+	select {
+	case <-buf.done:
+	default:
+		t.Error("replay loop still running after Close")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestCreateCustomerCurrency(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		wantStatus   int
+		wantCurrency string
+	}{
+		{"default", `{}`, http.StatusCreated, "BRL"},
+		{"explicit", `{"moeda": "USD"}`, http.StatusCreated, "USD"},
+		{"lowercase", `{"moeda": "usd"}`, http.StatusUnprocessableEntity, ""},
+		{"too long", `{"moeda": "REAL"}`, http.StatusUnprocessableEntity, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			s := newTestServer(t, testConfig(), store)
+
+			w := do(s, "POST", "/clientes", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusCreated {
+				if body := w.Body.String(); body != `{"erro": "moeda_invalid"}` {
+					t.Errorf("body = %s, want the moeda_invalid code", body)
+				}
+				return
+			}
+			var got customerRes
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding %q: %v", w.Body, err)
+			}
+			if got.Currency != tt.wantCurrency {
+				t.Errorf("moeda = %q, want %q", got.Currency, tt.wantCurrency)
+			}
+			if c := store.customer(6); c.Currency != tt.wantCurrency {
+				t.Errorf("stored moeda = %q, want %q", c.Currency, tt.wantCurrency)
+			}
+		})
+	}
+}
+
+func TestTransactionCurrency(t *testing.T) {
+	tests := []struct {
+		name        string
+		customer    string
+		body        string
+		wantStatus  int
+		wantBody    string
+		wantBalance int
+	}{
+		{"omitted on BRL account", "1", `{"valor": 10, "tipo": "c", "descricao": "x"}`, http.StatusOK, "", 10},
+		{"omitted on USD account", "6", `{"valor": 10, "tipo": "c", "descricao": "x"}`, http.StatusOK, "", 10},
+		{"matching BRL", "1", `{"valor": 10, "tipo": "d", "descricao": "x", "moeda": "BRL"}`, http.StatusOK, "", -10},
+		{"matching USD", "6", `{"valor": 10, "tipo": "c", "descricao": "x", "moeda": "USD"}`, http.StatusOK, "", 10},
+		{"mismatched credit", "1", `{"valor": 10, "tipo": "c", "descricao": "x", "moeda": "USD"}`,
+			http.StatusUnprocessableEntity, `{"erro": "moeda_mismatch"}`, 0},
+		{"mismatched debit", "6", `{"valor": 10, "tipo": "d", "descricao": "x", "moeda": "BRL"}`,
+			http.StatusUnprocessableEntity, `{"erro": "moeda_mismatch"}`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			s := newTestServer(t, testConfig(), store)
+			if w := do(s, "POST", "/clientes", `{"limite": 1000, "moeda": "USD"}`); w.Code != http.StatusCreated {
+				t.Fatalf("creating the USD customer: status %d: %s", w.Code, w.Body)
+			}
+			before := counterValue(t, validationFailureTotal.WithLabelValues("moeda"))
+
+			w := do(s, "POST", "/clientes/"+tt.customer+"/transacoes", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %s, want %s", w.Body, tt.wantBody)
+			}
+			st := getStatement(t, s, "/clientes/"+tt.customer+"/extrato")
+			if st.Balance.Total.String() != strconv.Itoa(tt.wantBalance) {
+				t.Errorf("saldo = %s, want %d", st.Balance.Total, tt.wantBalance)
+			}
+			wantFailures := 0.0
+			if tt.wantStatus != http.StatusOK {
+				wantFailures = 1
+			}
+			if got := counterValue(t, validationFailureTotal.WithLabelValues("moeda")) - before; got != wantFailures {
+				t.Errorf("moeda validation failures went up by %v, want %v", got, wantFailures)
+			}
+		})
+	}
+}
+
+func TestStatementCurrency(t *testing.T) {
+	s := newTestServer(t, testConfig(), newFakeStore())
+	if w := do(s, "POST", "/clientes", `{"moeda": "EUR"}`); w.Code != http.StatusCreated {
+		t.Fatalf("creating the EUR customer: status %d: %s", w.Code, w.Body)
+	}
+	tests := []struct {
+		customer     string
+		wantCurrency string
+	}{
+		{"1", "BRL"},
+		{"6", "EUR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.customer, func(t *testing.T) {
+			if got := getStatement(t, s, "/clientes/"+tt.customer+"/extrato").Balance.Currency; got != tt.wantCurrency {
+				t.Errorf("moeda = %q, want %q", got, tt.wantCurrency)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var errCustomerBusy = errors.New("too many concurrent operations for customer")
+
+// customerLimitStore caps the number of operations in flight for a single
+// customer, failing the ones past the cap with errCustomerBusy right away
+// rather than letting one customer's traffic take every pool connection.
+// A batch counts once for every customer it applies operations to, until
+// it's committed or rolled back.
+type customerLimitStore struct {
+	Store
+	max int
+
+	mu       sync.Mutex
+	inFlight map[int]int
+}
+
+func newCustomerLimitStore(store Store, max int) *customerLimitStore {
+	return &customerLimitStore{Store: store, max: max, inFlight: make(map[int]int)}
+}
+
+func (s *customerLimitStore) Credit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	if !s.acquire(customerID) {
+		return TransactionResult{}, errCustomerBusy
+	}
+	defer s.release(customerID)
+	return s.Store.Credit(ctx, customerID, value, desc)
+}
+
+func (s *customerLimitStore) Debit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	if !s.acquire(customerID) {
+		return TransactionResult{}, errCustomerBusy
+	}
+	defer s.release(customerID)
+	return s.Store.Debit(ctx, customerID, value, desc)
+}
+
+func (s *customerLimitStore) ApplyIfBalance(ctx context.Context, customerID, value int, typ, desc string, expected int) (TransactionResult, error) {
+	if !s.acquire(customerID) {
+		return TransactionResult{}, errCustomerBusy
+	}
+	defer s.release(customerID)
+	return s.Store.ApplyIfBalance(ctx, customerID, value, typ, desc, expected)
+}
+
+func (s *customerLimitStore) Statement(ctx context.Context, customerID int, opts StatementOptions) (Statement, error) {
+	if !s.acquire(customerID) {
+		return Statement{}, errCustomerBusy
+	}
+	defer s.release(customerID)
+	return s.Store.Statement(ctx, customerID, opts)
+}
+
+func (s *customerLimitStore) Summary(ctx context.Context, customerID int) (Summary, error) {
+	if !s.acquire(customerID) {
+		return Summary{}, errCustomerBusy
+	}
+	defer s.release(customerID)
+	return s.Store.Summary(ctx, customerID)
+}
+
+func (s *customerLimitStore) BeginBatch(ctx context.Context) (Batch, error) {
+	b, err := s.Store.BeginBatch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &customerLimitBatch{Batch: b, store: s, held: make(map[int]bool)}, nil
+}
+
+func (s *customerLimitStore) acquire(customerID int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inFlight[customerID] >= s.max {
+		return false
+	}
+	s.inFlight[customerID]++
+	return true
+}
+
+func (s *customerLimitStore) release(customerID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inFlight[customerID]--; s.inFlight[customerID] == 0 {
+		delete(s.inFlight, customerID)
+	}
+}
+
+// customerLimitBatch takes a slot for each customer on its first Apply for
+// them, and gives them all back once committed or rolled back.
+type customerLimitBatch struct {
+	Batch
+	store *customerLimitStore
+	held  map[int]bool
+}
+
+func (b *customerLimitBatch) Apply(ctx context.Context, customerID, value int, typ, desc string) (TransactionResult, error) {
+	if !b.held[customerID] {
+		if !b.store.acquire(customerID) {
+			return TransactionResult{}, errCustomerBusy
+		}
+		b.held[customerID] = true
+	}
+	return b.Batch.Apply(ctx, customerID, value, typ, desc)
+}
+
+func (b *customerLimitBatch) Commit(ctx context.Context) error {
+	defer b.releaseAll()
+	return b.Batch.Commit(ctx)
+}
+
+func (b *customerLimitBatch) Rollback(ctx context.Context) error {
+	defer b.releaseAll()
+	return b.Batch.Rollback(ctx)
+}
+
+func (b *customerLimitBatch) releaseAll() {
+	for customerID := range b.held {
+		b.store.release(customerID)
+	}
+	clear(b.held)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hotCustomerStore holds the credits of customer 1 until release is closed,
+// signaling on started as each one begins.
+type hotCustomerStore struct {
+	Store
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *hotCustomerStore) Credit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	if customerID == 1 {
+		s.started <- struct{}{}
+		<-s.release
+	}
+	return s.Store.Credit(ctx, customerID, value, desc)
+}
+
+func TestCustomerLimit(t *testing.T) {
+	const max = 2
+	store := &hotCustomerStore{Store: newFakeStore(), started: make(chan struct{}, max), release: make(chan struct{})}
+	cfg := testConfig()
+	cfg.DB.MaxConcurrentPerCustomer = max
+	s := newTestServer(t, cfg, store)
+	credit := `{"valor": 1, "tipo": "c", "descricao": "x"}`
+
+	// Flood customer 1 until it has max operations in flight.
+	var wg sync.WaitGroup
+	for i := 0; i < max; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := do(s, "POST", "/clientes/1/transacoes", credit); w.Code != http.StatusOK {
+				t.Errorf("held credit: status = %d", w.Code)
+			}
+		}()
+	}
+	for i := 0; i < max; i++ {
+		<-store.started
+	}
+
+	tests := []struct {
+		method, target, body string
+		wantStatus           int
+	}{
+		{"POST", "/clientes/1/transacoes", credit, http.StatusServiceUnavailable},
+		{"GET", "/clientes/1/extrato", "", http.StatusServiceUnavailable},
+		{"POST", "/clientes/2/transacoes", credit, http.StatusOK},
+		{"GET", "/clientes/2/extrato", "", http.StatusOK},
+		{"GET", "/clientes/3/extrato", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			start := time.Now()
+			w := do(s, tt.method, tt.target, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("answered after %s while customer 1 is flooded", elapsed)
+			}
+		})
+	}
+
+	close(store.release)
+	wg.Wait()
+	if w := do(s, "POST", "/clientes/1/transacoes", credit); w.Code != http.StatusOK {
+		t.Errorf("customer 1 after the flood: status = %d, want 200", w.Code)
+	}
+	if got := store.Store.(*fakeStore).customer(1).Balance; got != max+1 {
+		t.Errorf("customer 1 balance = %d, want %d", got, max+1)
+	}
+}
+
+func TestCustomerLimitBatch(t *testing.T) {
+	store := newCustomerLimitStore(newFakeStore(), 1)
+	ctx := context.Background()
+
+	batch, err := store.BeginBatch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := batch.Apply(ctx, 1, 100, "c", "x"); err != nil {
+			t.Fatalf("apply %d within the batch: %v", i, err)
+		}
+	}
+	if _, err := store.Credit(ctx, 1, 1, "x"); !errors.Is(err, errCustomerBusy) {
+		t.Errorf("credit while a batch holds the customer: err = %v, want errCustomerBusy", err)
+	}
+	if _, err := store.Credit(ctx, 2, 1, "x"); err != nil {
+		t.Errorf("credit for another customer: %v", err)
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Credit(ctx, 1, 1, "x"); err != nil {
+		t.Errorf("credit after the batch was committed: %v", err)
+	}
+	if len(store.inFlight) != 0 {
+		t.Errorf("in flight = %v after every operation finished, want none", store.inFlight)
+	}
+}
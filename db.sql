@@ -3,7 +3,9 @@ SET timezone TO 'America/Sao_Paulo';
 CREATE TABLE customers (
     id SERIAL PRIMARY KEY,
     "limit" INTEGER NOT NULL,
-    balance INTEGER NOT NULL DEFAULT 0
+    balance INTEGER NOT NULL DEFAULT 0,
+    currency CHAR(3) NOT NULL DEFAULT 'BRL',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
 INSERT INTO customers ("limit", balance)
@@ -16,7 +18,7 @@ VALUES
 
 CREATE UNLOGGED TABLE transactions (
     id SERIAL PRIMARY KEY,
-    customer_id SMALLINT NOT NULL,
+    customer_id INT NOT NULL,
     amount INTEGER NOT NULL,
     type CHAR(1) NOT NULL,
     description VARCHAR(10) NOT NULL,
@@ -30,19 +32,32 @@ SET
 
 CREATE INDEX idx_transactions ON transactions (customer_id asc);
 
+-- Statements read the latest transactions of a customer by id, or by
+-- created_at with DB_STATEMENT_ORDER_BY=created_at. The index matching the
+-- ordering lets them stop at the limit without sorting, and its INCLUDE
+-- columns let them skip the table once it's vacuumed. Create the one for
+-- the configured ordering:
+--
+-- CREATE INDEX idx_transactions_id ON transactions (customer_id, id DESC)
+--     INCLUDE (amount, type, description, created_at);
+-- CREATE INDEX idx_transactions_created_at ON transactions (customer_id, created_at DESC, id DESC)
+--     INCLUDE (amount, type, description);
+
 CREATE OR REPLACE FUNCTION debit(
-	customer_id_tx SMALLINT,
+	customer_id_tx INT,
 	amount_tx INT,
 	description_tx VARCHAR(10))
 RETURNS TABLE (
 	new_balance INT,
 	success BOOL,
-	current_limit INT)
+	current_limit INT,
+	transaction_id INT)
 LANGUAGE plpgsql
 AS $$
 DECLARE
 	current_balance int;
 	current_limit_amount int;
+	new_transaction_id int;
 BEGIN
 	PERFORM pg_advisory_xact_lock(customer_id_tx);
 
@@ -55,40 +70,56 @@ BEGIN
 	FROM customers
 	WHERE id = customer_id_tx;
 
+	-- No rows for an unknown customer, which the API answers with 404.
+	IF NOT FOUND THEN
+		RETURN;
+	END IF;
+
 	IF current_balance - amount_tx >= current_limit_amount * -1 THEN
-		INSERT INTO transactions VALUES(DEFAULT, customer_id_tx, amount_tx, 'd', description_tx);
+		INSERT INTO transactions VALUES(DEFAULT, customer_id_tx, amount_tx, 'd', description_tx)
+		RETURNING id INTO new_transaction_id;
 		
 		RETURN QUERY
     UPDATE customers 
-    SET balance = balance - amount_tx 
+    SET balance = balance - amount_tx, updated_at = now()
     WHERE id = customer_id_tx
-    RETURNING balance, TRUE, "limit";
+    RETURNING balance, TRUE, "limit", new_transaction_id;
 
 	ELSE
-		RETURN QUERY SELECT current_balance, FALSE, current_limit_amount;
+		RETURN QUERY SELECT current_balance, FALSE, current_limit_amount, 0;
 	END IF;
 END;
 $$;
 
 CREATE OR REPLACE FUNCTION credit(
-	customer_id_tx SMALLINT,
+	customer_id_tx INT,
 	amount_tx INT,
 	description_tx VARCHAR(10))
 RETURNS TABLE (
 	new_balance INT,
 	success BOOL,
-	current_limit INT)
+	current_limit INT,
+	transaction_id INT)
 LANGUAGE plpgsql
 AS $$
+DECLARE
+	new_transaction_id int;
 BEGIN
 	PERFORM pg_advisory_xact_lock(customer_id_tx);
 
-	INSERT INTO transactions VALUES(DEFAULT, customer_id_tx, amount_tx, 'c', description_tx);
+	-- No rows for an unknown customer, which the API answers with 404.
+	PERFORM 1 FROM customers WHERE id = customer_id_tx;
+	IF NOT FOUND THEN
+		RETURN;
+	END IF;
+
+	INSERT INTO transactions VALUES(DEFAULT, customer_id_tx, amount_tx, 'c', description_tx)
+	RETURNING id INTO new_transaction_id;
 
 	RETURN QUERY
 		UPDATE customers
-		SET balance = balance + amount_tx
+		SET balance = balance + amount_tx, updated_at = now()
 		WHERE id = customer_id_tx
-		RETURNING balance, TRUE, "limit";
+		RETURNING balance, TRUE, "limit", new_transaction_id;
 END;
 $$;
\ No newline at end of file
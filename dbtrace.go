@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/jackc/pgx/v5/tracelog"
+)
+
+// newQueryTracer returns a pgx tracer logging every query with its SQL, args
+// and duration to logger at debug level, meant for local development.
+func newQueryTracer(logger *slog.Logger) *tracelog.TraceLog {
+	return &tracelog.TraceLog{
+		Logger: tracelog.LoggerFunc(func(ctx context.Context, level tracelog.LogLevel, msg string, data map[string]any) {
+			attrs := make([]slog.Attr, 0, len(data))
+			for k, v := range data {
+				attrs = append(attrs, slog.Any(k, v))
+			}
+			logger.LogAttrs(ctx, slog.LevelDebug, msg, attrs...)
+		}),
+		LogLevel: tracelog.LogLevelDebug,
+	}
+}
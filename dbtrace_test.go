@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/tracelog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newTraceServer builds a Server over the fake store logging to buf at
+// level.
+func newTraceServer(t *testing.T, cfg Config, buf *bytes.Buffer, level slog.Level) *Server {
+	t.Helper()
+	s, err := NewServer(cfg,
+		WithStore(newFakeStore()),
+		WithRegistry(prometheus.NewRegistry()),
+		WithLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: level}))),
+	)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(s.close)
+	return s
+}
+
+func TestQueryTracer(t *testing.T) {
+	tests := []struct {
+		name       string
+		trace      bool
+		level      slog.Level
+		wantTracer bool
+		wantLogged bool
+	}{
+		{"off", false, slog.LevelDebug, false, false},
+		{"on", true, slog.LevelDebug, true, true},
+		{"on above debug level", true, slog.LevelInfo, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DB.Trace = tt.trace
+			var buf bytes.Buffer
+			s := newTraceServer(t, cfg, &buf, tt.level)
+
+			pc, err := s.poolConfig()
+			if err != nil {
+				t.Fatalf("poolConfig: %v", err)
+			}
+			tracer, _ := pc.ConnConfig.Tracer.(*tracelog.TraceLog)
+			if (pc.ConnConfig.Tracer != nil) != tt.wantTracer || tt.wantTracer && tracer == nil {
+				t.Fatalf("tracer = %T, want one: %v", pc.ConnConfig.Tracer, tt.wantTracer)
+			}
+			if tracer != nil {
+				// The data TraceLog passes for a successful query.
+				tracer.Logger.Log(context.Background(), tracelog.LogLevelInfo, "Query", map[string]any{
+					"sql":  "select saldo from clientes where id = $1",
+					"args": []any{1},
+					"time": 3 * time.Millisecond,
+				})
+			}
+
+			out := buf.String()
+			logged := strings.Contains(out, "msg=Query")
+			if logged != tt.wantLogged {
+				t.Fatalf("logged = %v, want %v; log:\n%s", logged, tt.wantLogged, out)
+			}
+			if !logged {
+				return
+			}
+			for _, want := range []string{"level=DEBUG", `sql="select saldo from clientes where id = $1"`, "args=[1]", "time=3ms"} {
+				if !strings.Contains(out, want) {
+					t.Errorf("log %q doesn't contain %q", out, want)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryTracerLogsQueries(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	for _, trace := range []bool{false, true} {
+		cfg := testConfig()
+		cfg.DB.URL = url
+		cfg.DB.Trace = trace
+		var buf bytes.Buffer
+		s := newTraceServer(t, cfg, &buf, slog.LevelDebug)
+		pc, err := s.poolConfig()
+		if err != nil {
+			t.Fatalf("poolConfig: %v", err)
+		}
+		db, err := pgxpool.NewWithConfig(context.Background(), pc)
+		if err != nil {
+			t.Fatalf("connecting: %v", err)
+		}
+		var n int
+		err = db.QueryRow(context.Background(), "select $1::int + 1", 41).Scan(&n)
+		db.Close()
+		if err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		if logged := strings.Contains(buf.String(), "select $1::int + 1"); logged != trace {
+			t.Errorf("trace %v: query logged = %v; log:\n%s", trace, logged, buf.String())
+		}
+	}
+}
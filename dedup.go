@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// dedupStore suppresses a credit or debit identical to one that completed
+// less than window ago for the same customer, returning the earlier result
+// instead of applying it again. It's meant to absorb double submits from
+// clients that don't send any idempotency key. An identical operation still
+// in flight is waited for, and its outcome shared, so concurrent double
+// submits are caught as well.
+type dedupStore struct {
+	Store
+	window time.Duration
+
+	mu        sync.Mutex
+	seen      map[dedupKey]*dedupEntry
+	nextSweep time.Time
+}
+
+type dedupKey struct {
+	customerID int
+	value      int
+	typ        string
+	desc       string
+}
+
+// dedupEntry is recorded before the operation runs. Its fields are set once
+// done is closed; at is only read with the store's mutex held.
+type dedupEntry struct {
+	done chan struct{}
+	res  TransactionResult
+	err  error
+	at   time.Time
+}
+
+func newDedupStore(store Store, window time.Duration) *dedupStore {
+	return &dedupStore{
+		Store:  store,
+		window: window,
+		seen:   make(map[dedupKey]*dedupEntry),
+	}
+}
+
+func (s *dedupStore) Credit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	return s.do(ctx, dedupKey{customerID, value, "c", desc}, func() (TransactionResult, error) {
+		return s.Store.Credit(ctx, customerID, value, desc)
+	})
+}
+
+func (s *dedupStore) Debit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	return s.do(ctx, dedupKey{customerID, value, "d", desc}, func() (TransactionResult, error) {
+		return s.Store.Debit(ctx, customerID, value, desc)
+	})
+}
+
+// do runs fn unless an identical operation is in flight, whose outcome is
+// waited for, or completed within the window, whose result is returned.
+// Only successful operations are remembered past their completion.
+func (s *dedupStore) do(ctx context.Context, key dedupKey, fn func() (TransactionResult, error)) (TransactionResult, error) {
+	s.mu.Lock()
+	if e, ok := s.seen[key]; ok {
+		select {
+		case <-e.done:
+			if time.Since(e.at) < s.window {
+				s.mu.Unlock()
+				return duplicateOf(e.res), nil
+			}
+		default:
+			s.mu.Unlock()
+			select {
+			case <-e.done:
+				return duplicateOf(e.res), e.err
+			case <-ctx.Done():
+				return TransactionResult{}, ctx.Err()
+			}
+		}
+	}
+	e := &dedupEntry{done: make(chan struct{})}
+	s.seen[key] = e
+	s.mu.Unlock()
+
+	e.res, e.err = fn()
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.at = now
+	close(e.done)
+	if e.err != nil {
+		delete(s.seen, key)
+	}
+	s.sweep(now)
+	return e.res, e.err
+}
+
+// duplicateOf returns res as answered to an operation suppressed as a
+// duplicate.
+func duplicateOf(res TransactionResult) TransactionResult {
+	res.Duplicate = true
+	return res
+}
+
+// sweep drops, at most once per window, the entries that have expired so the
+// map doesn't grow without bound. It's called with the mutex held.
+func (s *dedupStore) sweep(now time.Time) {
+	if now.Before(s.nextSweep) {
+		return
+	}
+	for k, e := range s.seen {
+		select {
+		case <-e.done:
+			if now.Sub(e.at) >= s.window {
+				delete(s.seen, k)
+			}
+		default:
+		}
+	}
+	s.nextSweep = now.Add(s.window)
+}
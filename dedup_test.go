@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type dedupOp struct {
+	customerID, value int
+	typ, desc         string
+}
+
+func (op dedupOp) apply(ctx context.Context, s Store) (TransactionResult, error) {
+	if op.typ == "d" {
+		return s.Debit(ctx, op.customerID, op.value, op.desc)
+	}
+	return s.Credit(ctx, op.customerID, op.value, op.desc)
+}
+
+func TestDedup(t *testing.T) {
+	op := dedupOp{1, 100, "c", "x"}
+	tests := []struct {
+		name        string
+		second      dedupOp
+		wait        time.Duration
+		failFirst   bool
+		wantApplied int
+	}{
+		{"identical", op, 0, false, 1},
+		{"other value", dedupOp{1, 101, "c", "x"}, 0, false, 2},
+		{"other type", dedupOp{1, 100, "d", "x"}, 0, false, 2},
+		{"other descricao", dedupOp{1, 100, "c", "y"}, 0, false, 2},
+		{"other customer", dedupOp{2, 100, "c", "x"}, 0, false, 2},
+		{"after the window", op, 60 * time.Millisecond, false, 2},
+		{"first one failed", op, 0, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeStore()
+			s := newDedupStore(fake, 50*time.Millisecond)
+			ctx := context.Background()
+			if tt.failFirst {
+				fake.failWith("Credit", errors.New("boom"))
+			}
+			first, err := op.apply(ctx, s)
+			if tt.failFirst {
+				if err == nil {
+					t.Fatal("first credit succeeded, want the injected error")
+				}
+				fake.failWith("Credit", nil)
+			}
+			time.Sleep(tt.wait)
+
+			second, err := tt.second.apply(ctx, s)
+			if err != nil {
+				t.Fatalf("second operation: %v", err)
+			}
+			applied := 0
+			for _, txs := range fake.transactions {
+				applied += len(txs)
+			}
+			if applied != tt.wantApplied {
+				t.Errorf("%d operations applied, want %d", applied, tt.wantApplied)
+			}
+			if tt.wantApplied == 1 && !tt.failFirst && second != duplicateOf(first) {
+				t.Errorf("suppressed duplicate returned %+v, want the first result %+v marked duplicate", second, first)
+			}
+		})
+	}
+}
+
+func TestDedupConcurrent(t *testing.T) {
+	blocking := &blockingCreditStore{Store: newFakeStore(), started: make(chan struct{}, 10), release: make(chan struct{})}
+	s := newDedupStore(blocking, time.Second)
+
+	const n = 10
+	results := make([]TransactionResult, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := s.Credit(context.Background(), 1, 100, "x")
+			if err != nil {
+				t.Errorf("credit: %v", err)
+			}
+			results[i] = res
+		}()
+	}
+	<-blocking.started
+	// Give the duplicates time to find the credit in flight.
+	time.Sleep(20 * time.Millisecond)
+	close(blocking.release)
+	wg.Wait()
+
+	if got := blocking.Store.(*fakeStore).customer(1).Balance; got != 100 {
+		t.Errorf("balance = %d after %d concurrent duplicates, want 100", got, n)
+	}
+	original := 0
+	for i, res := range results {
+		if !res.Duplicate {
+			original++
+		}
+		if duplicateOf(res) != duplicateOf(results[0]) {
+			t.Errorf("duplicate %d got %+v, want the shared result %+v", i, res, results[0])
+		}
+	}
+	if original != 1 {
+		t.Errorf("%d results not marked duplicate, want 1", original)
+	}
+}
+
+func TestDedupWindowConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		window      time.Duration
+		wantBalance int
+	}{
+		{"off by default", 0, 200},
+		{"window", time.Second, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeStore()
+			cfg := testConfig()
+			cfg.Transactions.DedupWindow = Duration{tt.window}
+			s := newTestServer(t, cfg, fake)
+			for i := 0; i < 2; i++ {
+				if w := do(s, "POST", "/clientes/1/transacoes", `{"valor": 100, "tipo": "c", "descricao": "x"}`); w.Code != http.StatusOK {
+					t.Fatalf("status = %d", w.Code)
+				}
+			}
+			if got := fake.customer(1).Balance; got != tt.wantBalance {
+				t.Errorf("balance = %d, want %d", got, tt.wantBalance)
+			}
+		})
+	}
+}
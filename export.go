@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handleExport streams every transaction of a customer as a file to
+// download: CSV when the client accepts text/csv, NDJSON otherwise.
+func (s *Server) handleExport(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		customerIDStr := r.PathValue("id")
+		customerID, err := parseCustomerID(customerIDStr)
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, "", "customer not found")
+			return
+		}
+
+		if customerID < 1 {
+			writeError(w, r, http.StatusNotFound, "", "customer not found")
+			return
+		}
+
+		format := moneyFormat{largeAsStrings: s.cfg.Server.LargeNumbersAsStrings}
+		loc := s.location.Load()
+		asCSV := strings.Contains(r.Header.Get("Accept"), "text/csv")
+		contentType, ext := "application/x-ndjson", "ndjson"
+		if asCSV {
+			contentType, ext = "text/csv", "csv"
+		}
+
+		// Headers are only sent with the first transaction, so a customer
+		// that doesn't exist can still be answered with 404.
+		var csvw *csv.Writer
+		var enc *json.Encoder
+		start := func() {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Disposition", `attachment; filename="cliente-`+strconv.Itoa(customerID)+`-transacoes.`+ext+`"`)
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusOK)
+			if asCSV {
+				csvw = csv.NewWriter(w)
+				csvw.Write([]string{"valor", "tipo", "descricao", "realizada_em"})
+			} else {
+				enc = json.NewEncoder(w)
+			}
+		}
+
+		started := false
+		err = store.ExportTransactions(r.Context(), customerID, func(t Transaction) error {
+			if !started {
+				start()
+				started = true
+			}
+			// Times are scanned in time.Local, which in the image is UTC.
+			date := t.CreatedAt.In(loc).Format(time.RFC3339Nano)
+			if asCSV {
+				return csvw.Write([]string{strconv.Itoa(t.Value), t.Type, t.Description, date})
+			}
+			return enc.Encode(transactionRes{Value: money{t.Value, format}, Type: t.Type, Desc: t.Description, Date: date})
+		})
+		if err != nil && !started {
+			s.writeStoreError(w, r, err)
+			return
+		}
+		if err != nil {
+			// Too late for an error status; the client gets a short file.
+			s.Logger.Error("export failed", "customer", customerID, "err", err)
+			return
+		}
+		if !started {
+			start()
+		}
+		if csvw != nil {
+			csvw.Flush()
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withHistory gives customer 1 of store n transactions.
+func withHistory(store *fakeStore, n int) *fakeStore {
+	created := time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC)
+	for i := range n {
+		store.transactions[1] = append(store.transactions[1], Transaction{
+			ID:          int64(i + 1),
+			Value:       i + 1,
+			Type:        "c",
+			Description: "t" + strconv.Itoa(i),
+			CreatedAt:   created.Add(time.Duration(i) * time.Second),
+		})
+	}
+	return store
+}
+
+// failingExportStore fails ExportTransactions after the first after
+// transactions.
+type failingExportStore struct {
+	*fakeStore
+	after int
+}
+
+func (s *failingExportStore) ExportTransactions(ctx context.Context, customerID int, fn func(Transaction) error) error {
+	n := 0
+	return s.fakeStore.ExportTransactions(ctx, customerID, func(t Transaction) error {
+		if n == s.after {
+			return errors.New("connection reset")
+		}
+		n++
+		return fn(t)
+	})
+}
+
+func TestExport(t *testing.T) {
+	const large = 100_000
+	tests := []struct {
+		name            string
+		store           Store
+		target, accept  string
+		wantStatus      int
+		wantContentType string
+		wantFile        string
+		wantRows        int
+	}{
+		{"ndjson", withHistory(newFakeStore(), large), "/clientes/1/export", "", http.StatusOK,
+			"application/x-ndjson", "cliente-1-transacoes.ndjson", large},
+		{"csv", withHistory(newFakeStore(), large), "/clientes/1/export", "text/csv", http.StatusOK,
+			"text/csv", "cliente-1-transacoes.csv", large},
+		{"empty ndjson", newFakeStore(), "/clientes/2/export", "", http.StatusOK,
+			"application/x-ndjson", "cliente-2-transacoes.ndjson", 0},
+		{"empty csv", newFakeStore(), "/clientes/2/export", "text/csv", http.StatusOK,
+			"text/csv", "cliente-2-transacoes.csv", 0},
+		{"failing midway", &failingExportStore{withHistory(newFakeStore(), 10), 4}, "/clientes/1/export", "", http.StatusOK,
+			"application/x-ndjson", "cliente-1-transacoes.ndjson", 4},
+		{"failing before the first", &failingExportStore{withHistory(newFakeStore(), 10), 0}, "/clientes/1/export", "", http.StatusInternalServerError,
+			"", "", 0},
+		{"unknown customer", newFakeStore(), "/clientes/6/export", "", http.StatusNotFound, "", "", 0},
+		{"invalid id", newFakeStore(), "/clientes/x/export", "", http.StatusNotFound, "", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, testConfig(), tt.store)
+			var header []string
+			if tt.accept != "" {
+				header = []string{"Accept", tt.accept}
+			}
+
+			w := do(s, "GET", tt.target, "", header...)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+			if got, want := w.Header().Get("Content-Disposition"), `attachment; filename="`+tt.wantFile+`"`; got != want {
+				t.Errorf("Content-Disposition = %q, want %q", got, want)
+			}
+
+			rows := 0
+			if tt.accept == "text/csv" {
+				records, err := csv.NewReader(w.Body).ReadAll()
+				if err != nil {
+					t.Fatalf("reading the CSV: %v", err)
+				}
+				if len(records) == 0 || strings.Join(records[0], ",") != "valor,tipo,descricao,realizada_em" {
+					t.Fatalf("CSV header = %v", records)
+				}
+				for i, rec := range records[1:] {
+					if rec[0] != strconv.Itoa(i+1) || rec[2] != "t"+strconv.Itoa(i) {
+						t.Fatalf("row %d = %v, out of order", i, rec)
+					}
+				}
+				rows = len(records) - 1
+			} else {
+				sc := bufio.NewScanner(w.Body)
+				for sc.Scan() {
+					var tr struct {
+						Value json.Number `json:"valor"`
+						Desc  string      `json:"descricao"`
+						Date  string      `json:"realizada_em"`
+					}
+					if err := json.Unmarshal(sc.Bytes(), &tr); err != nil {
+						t.Fatalf("line %d %q: %v", rows, sc.Text(), err)
+					}
+					if tr.Value.String() != strconv.Itoa(rows+1) || tr.Desc != "t"+strconv.Itoa(rows) {
+						t.Fatalf("line %d = %+v, out of order", rows, tr)
+					}
+					if _, err := time.Parse(time.RFC3339Nano, tr.Date); err != nil {
+						t.Fatalf("line %d realizada_em: %v", rows, err)
+					}
+					rows++
+				}
+			}
+			if rows != tt.wantRows {
+				t.Errorf("exported %d transactions, want %d", rows, tt.wantRows)
+			}
+		})
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakeStore is an in-memory Store following the rules of the functions in
+// db.sql, so handlers can be tested without Postgres. Unknown customers fail
+// with pgx.ErrNoRows, as the queries do.
+type fakeStore struct {
+	mu           sync.Mutex
+	customers    map[int]*Customer
+	transactions map[int][]Transaction // oldest first
+	modified     map[int]time.Time
+	lastID       int64
+	lag          *time.Duration
+
+	// errs makes the named method, e.g. "Credit" or "Batch.Commit", fail
+	// with the error without doing anything.
+	errs map[string]error
+	// calls counts the calls of each method, named as in errs.
+	calls map[string]int
+}
+
+// newFakeStore returns a fakeStore with the customers db.sql seeds.
+func newFakeStore() *fakeStore {
+	f := &fakeStore{
+		customers:    make(map[int]*Customer),
+		transactions: make(map[int][]Transaction),
+		modified:     make(map[int]time.Time),
+		errs:         make(map[string]error),
+		calls:        make(map[string]int),
+	}
+	for i, limit := range []int{1000 * 100, 800 * 100, 10000 * 100, 100000 * 100, 5000 * 100} {
+		f.customers[i+1] = &Customer{ID: i + 1, Limit: limit, Currency: "BRL"}
+	}
+	return f
+}
+
+// call records a call of method and returns the error set for it. It's
+// called with the mutex held.
+func (f *fakeStore) call(method string) error {
+	f.calls[method]++
+	return f.errs[method]
+}
+
+// failWith makes method fail with err.
+func (f *fakeStore) failWith(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs[method] = err
+}
+
+// count returns how many times method was called.
+func (f *fakeStore) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+func (f *fakeStore) customer(id int) Customer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return *f.customers[id]
+}
+
+// apply runs a credit or debit as the SQL functions do. It's called with the
+// mutex held.
+func (f *fakeStore) apply(customerID, value int, typ, desc string) (TransactionResult, error) {
+	c, ok := f.customers[customerID]
+	if !ok {
+		return TransactionResult{}, pgx.ErrNoRows
+	}
+	balance := c.Balance + value
+	if typ == "d" {
+		balance = c.Balance - value
+		if balance < -c.Limit {
+			return TransactionResult{Balance: c.Balance, Limit: c.Limit}, nil
+		}
+	}
+	c.Balance = balance
+	f.lastID++
+	f.transactions[customerID] = append(f.transactions[customerID], Transaction{
+		ID:          f.lastID,
+		Value:       value,
+		Type:        typ,
+		Description: desc,
+		CreatedAt:   time.Now().UTC(),
+	})
+	f.modified[customerID] = time.Now()
+	return TransactionResult{Balance: c.Balance, Limit: c.Limit, Applied: true, ID: f.lastID}, nil
+}
+
+func (f *fakeStore) Credit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("Credit"); err != nil {
+		return TransactionResult{}, err
+	}
+	return f.apply(customerID, value, "c", desc)
+}
+
+func (f *fakeStore) Debit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("Debit"); err != nil {
+		return TransactionResult{}, err
+	}
+	return f.apply(customerID, value, "d", desc)
+}
+
+func (f *fakeStore) ApplyIfBalance(ctx context.Context, customerID, value int, typ, desc string, expected int) (TransactionResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ApplyIfBalance"); err != nil {
+		return TransactionResult{}, err
+	}
+	c, ok := f.customers[customerID]
+	if !ok {
+		return TransactionResult{}, pgx.ErrNoRows
+	}
+	if c.Balance != expected {
+		return TransactionResult{Balance: c.Balance, Limit: c.Limit}, errBalanceMismatch
+	}
+	return f.apply(customerID, value, typ, desc)
+}
+
+func (f *fakeStore) Statement(ctx context.Context, customerID int, opts StatementOptions) (Statement, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("Statement"); err != nil {
+		return Statement{}, err
+	}
+	c, ok := f.customers[customerID]
+	if !ok {
+		return Statement{}, pgx.ErrNoRows
+	}
+	st := Statement{Balance: c.Balance, Limit: c.Limit, Currency: c.Currency, LastModified: f.modified[customerID], Transactions: make([]Transaction, 0)}
+	all := f.transactions[customerID]
+	if opts.Since != nil {
+		for _, t := range all {
+			if t.ID > *opts.Since && len(st.Transactions) < opts.Limit {
+				st.Transactions = append(st.Transactions, t)
+			}
+		}
+		return st, nil
+	}
+	for i := len(all) - 1; i >= 0 && len(st.Transactions) < opts.Limit; i-- {
+		t := all[i]
+		t.ID = 0
+		st.Transactions = append(st.Transactions, t)
+	}
+	return st, nil
+}
+
+func (f *fakeStore) Summary(ctx context.Context, customerID int) (Summary, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("Summary"); err != nil {
+		return Summary{}, err
+	}
+	c, ok := f.customers[customerID]
+	if !ok {
+		return Summary{}, pgx.ErrNoRows
+	}
+	sum := Summary{Balance: c.Balance, Limit: c.Limit, Currency: c.Currency, TransactionCount: len(f.transactions[customerID])}
+	if n := len(f.transactions[customerID]); n > 0 {
+		last := f.transactions[customerID][n-1].CreatedAt
+		sum.LastTransactionAt = &last
+	}
+	return sum, nil
+}
+
+func (f *fakeStore) TransactionCount(ctx context.Context, customerID int) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("TransactionCount"); err != nil {
+		return 0, err
+	}
+	return len(f.transactions[customerID]), nil
+}
+
+func (f *fakeStore) ExportTransactions(ctx context.Context, customerID int, fn func(Transaction) error) error {
+	f.mu.Lock()
+	if err := f.call("ExportTransactions"); err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	if _, ok := f.customers[customerID]; !ok {
+		f.mu.Unlock()
+		return pgx.ErrNoRows
+	}
+	all := slices.Clone(f.transactions[customerID])
+	f.mu.Unlock()
+
+	for _, t := range all {
+		t.ID = 0
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeStore) BeginBatch(ctx context.Context) (Batch, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("BeginBatch"); err != nil {
+		return nil, err
+	}
+	return &fakeBatch{store: f, before: f.snapshot()}, nil
+}
+
+func (f *fakeStore) CreateCustomer(ctx context.Context, limit int, currency string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateCustomer"); err != nil {
+		return 0, err
+	}
+	id := len(f.customers) + 1
+	f.customers[id] = &Customer{ID: id, Limit: limit, Currency: currency}
+	return int64(id), nil
+}
+
+func (f *fakeStore) CustomerCurrency(ctx context.Context, customerID int) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CustomerCurrency"); err != nil {
+		return "", err
+	}
+	c, ok := f.customers[customerID]
+	if !ok {
+		return "", pgx.ErrNoRows
+	}
+	return c.Currency, nil
+}
+
+func (f *fakeStore) ResetCustomer(ctx context.Context, customerID int, clearTransactions bool) (Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ResetCustomer"); err != nil {
+		return Customer{}, err
+	}
+	c, ok := f.customers[customerID]
+	if !ok {
+		return Customer{}, pgx.ErrNoRows
+	}
+	c.Balance = 0
+	if clearTransactions {
+		delete(f.transactions, customerID)
+	}
+	return *c, nil
+}
+
+func (f *fakeStore) ListCustomers(ctx context.Context) ([]Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ListCustomers"); err != nil {
+		return nil, err
+	}
+	var customers []Customer
+	for _, c := range f.customers {
+		customers = append(customers, *c)
+	}
+	slices.SortFunc(customers, func(a, b Customer) int { return a.ID - b.ID })
+	return customers, nil
+}
+
+func (f *fakeStore) Balances(ctx context.Context, ids []int) ([]Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("Balances"); err != nil {
+		return nil, err
+	}
+	var customers []Customer
+	for _, id := range ids {
+		if c, ok := f.customers[id]; ok {
+			customers = append(customers, *c)
+		}
+	}
+	return customers, nil
+}
+
+func (f *fakeStore) Ping(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.call("Ping")
+}
+
+func (f *fakeStore) ReplicaLag(ctx context.Context) (*time.Duration, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ReplicaLag"); err != nil {
+		return nil, err
+	}
+	return f.lag, nil
+}
+
+// snapshot copies the state a batch rollback goes back to. It's called with
+// the mutex held.
+func (f *fakeStore) snapshot() fakeState {
+	st := fakeState{customers: make(map[int]Customer), transactions: make(map[int][]Transaction)}
+	for id, c := range f.customers {
+		st.customers[id] = *c
+	}
+	for id, ts := range f.transactions {
+		st.transactions[id] = slices.Clone(ts)
+	}
+	return st
+}
+
+type fakeState struct {
+	customers    map[int]Customer
+	transactions map[int][]Transaction
+}
+
+// fakeBatch applies right away and puts the state taken at BeginBatch back
+// on rollback, so it's only meant for one batch at a time.
+type fakeBatch struct {
+	store  *fakeStore
+	before fakeState
+}
+
+func (b *fakeBatch) Apply(ctx context.Context, customerID, value int, typ, desc string) (TransactionResult, error) {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+	if err := b.store.call("Batch.Apply"); err != nil {
+		return TransactionResult{}, err
+	}
+	return b.store.apply(customerID, value, typ, desc)
+}
+
+func (b *fakeBatch) TransactionCount(ctx context.Context, customerID int) (int, error) {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+	if err := b.store.call("Batch.TransactionCount"); err != nil {
+		return 0, err
+	}
+	return len(b.store.transactions[customerID]), nil
+}
+
+func (b *fakeBatch) Commit(ctx context.Context) error {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+	if err := b.store.call("Batch.Commit"); err != nil {
+		b.rollback()
+		return err
+	}
+	return nil
+}
+
+func (b *fakeBatch) Rollback(ctx context.Context) error {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+	b.store.call("Batch.Rollback")
+	b.rollback()
+	return nil
+}
+
+func (b *fakeBatch) rollback() {
+	for id, c := range b.before.customers {
+		*b.store.customers[id] = c
+	}
+	b.store.transactions = b.before.transactions
+}
+
+// testConfig is the default config without the audit log, which would
+// write to stdout.
+func testConfig() Config {
+	cfg := defaultConfig()
+	cfg.Transactions.AuditLog = "off"
+	return cfg
+}
+
+// newTestServer builds a Server over store with its own metrics registry
+// and a logger that discards everything.
+func newTestServer(t testing.TB, cfg Config, store Store) *Server {
+	t.Helper()
+	s, err := NewServer(cfg,
+		WithStore(store),
+		WithRegistry(prometheus.NewRegistry()),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(s.close)
+	return s
+}
+
+// do serves a request with body through the routes of s.
+func do(s *Server, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.Routes().ServeHTTP(w, r)
+	return w
+}
+
+// counterValue returns the current value of c.
+func counterValue(t testing.TB, c prometheus.Collector) float64 {
+	t.Helper()
+	m := collectOne(t, c)
+	if m.Counter != nil {
+		return m.Counter.GetValue()
+	}
+	return m.Gauge.GetValue()
+}
+
+// histogramCount returns how many observations h has.
+func histogramCount(t testing.TB, h prometheus.Collector) uint64 {
+	t.Helper()
+	return collectOne(t, h).Histogram.GetSampleCount()
+}
+
+func collectOne(t testing.TB, c prometheus.Collector) *dto.Metric {
+	t.Helper()
+	ch := make(chan prometheus.Metric, 1)
+	c.Collect(ch)
+	close(ch)
+	var m dto.Metric
+	if err := (<-ch).Write(&m); err != nil {
+		t.Fatalf("writing metric: %v", err)
+	}
+	return &m
+}
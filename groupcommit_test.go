@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGroupCommit(t *testing.T) {
+	fake := newFakeStore()
+	store := newGroupCommitStore(fake, 20*time.Millisecond)
+	t.Cleanup(func() { store.Close() })
+
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := store.Credit(context.Background(), 1, 1, "grupo")
+			if err == nil && !res.Applied {
+				err = errors.New("credit not applied")
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("credit: %v", err)
+		}
+	}
+
+	if c := fake.customer(1); c.Balance != n {
+		t.Errorf("balance = %d, want %d", c.Balance, n)
+	}
+	if batches := fake.count("BeginBatch"); batches >= n {
+		t.Errorf("%d batches for %d credits, want them grouped", batches, n)
+	}
+}
+
+func TestGroupCommitFailure(t *testing.T) {
+	fake := newFakeStore()
+	commitErr := errors.New("commit failed")
+	fake.failWith("Batch.Commit", commitErr)
+	store := newGroupCommitStore(fake, time.Millisecond)
+	t.Cleanup(func() { store.Close() })
+
+	if _, err := store.Debit(context.Background(), 1, 1, "x"); !errors.Is(err, commitErr) {
+		t.Errorf("err = %v, want the commit error", err)
+	}
+	if c := fake.customer(1); c.Balance != 0 {
+		t.Errorf("balance = %d after a failed commit, want 0", c.Balance)
+	}
+}
+
+func TestGroupCommitDebitOverLimit(t *testing.T) {
+	fake := newFakeStore()
+	store := newGroupCommitStore(fake, time.Millisecond)
+	t.Cleanup(func() { store.Close() })
+
+	res, err := store.Debit(context.Background(), 2, 80001, "x")
+	if err != nil || res.Applied {
+		t.Errorf("debit over the limit = %+v, %v; want refused", res, err)
+	}
+}
+
+func TestGroupCommitClose(t *testing.T) {
+	fake := newFakeStore()
+	// A long window, so the credits are still queued when Close is called.
+	store := newGroupCommitStore(fake, time.Hour)
+
+	const n = 10
+	results := make(chan error, n)
+	for range n {
+		go func() {
+			_, err := store.Credit(context.Background(), 1, 1, "x")
+			results <- err
+		}()
+	}
+	// Let them all reach the worker, which waits on the window.
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		store.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close didn't stop the worker")
+	}
+	// The credits waiting on the window are applied rather than dropped.
+	for range n {
+		if err := <-results; err != nil {
+			t.Errorf("credit: %v", err)
+		}
+	}
+	if c := fake.customer(1); c.Balance != n {
+		t.Errorf("balance = %d, want the %d credits submitted before Close", c.Balance, n)
+	}
+
+	if _, err := store.Credit(context.Background(), 1, 1, "x"); !errors.Is(err, errGroupCommitClosed) {
+		t.Errorf("credit after Close: %v, want errGroupCommitClosed", err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type healthCheck struct {
+	Status         string  `json:"status"`
+	LatencySeconds float64 `json:"latency_seconds"`
+}
+
+// healthSeverity orders check statuses, the overall status being the most
+// severe of them.
+var healthSeverity = map[string]int{"ok": 0, "degraded": 1, "down": 2}
+
+// handleHealthz runs every health check, reporting each one with how long it
+// took along with the overall status. Unlike /health, the replica is checked
+// even when the primary is down.
+func handleHealthz(store Store, checkReplica bool, maxReplicaLag time.Duration) http.HandlerFunc {
+	type response struct {
+		Status string                 `json:"status"`
+		Checks map[string]healthCheck `json:"checks"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := response{Status: "ok", Checks: make(map[string]healthCheck)}
+		add := func(name string, check func(ctx context.Context) string) {
+			start := time.Now()
+			status := check(r.Context())
+			resp.Checks[name] = healthCheck{Status: status, LatencySeconds: time.Since(start).Seconds()}
+			if healthSeverity[status] > healthSeverity[resp.Status] {
+				resp.Status = status
+			}
+		}
+
+		add("database", func(ctx context.Context) string {
+			if err := store.Ping(ctx); err != nil {
+				return "down"
+			}
+			return "ok"
+		})
+		if checkReplica {
+			add("replica", func(ctx context.Context) string {
+				lag, err := store.ReplicaLag(ctx)
+				if err != nil {
+					return "down"
+				}
+				if lag == nil || *lag > maxReplicaLag {
+					return "degraded"
+				}
+				return "ok"
+			})
+		}
+
+		if resp.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
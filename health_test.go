@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	lag := func(d time.Duration) *time.Duration { return &d }
+	tests := []struct {
+		name        string
+		replica     bool
+		pingErr     error
+		lag         *time.Duration
+		lagErr      error
+		wantStatus  int
+		wantOverall string
+		wantChecks  map[string]string
+	}{
+		{"ok", false, nil, nil, nil, http.StatusOK, "ok", map[string]string{"database": "ok"}},
+		{"database down", false, errors.New("no db"), nil, nil, http.StatusServiceUnavailable, "down", map[string]string{"database": "down"}},
+		{"replica ok", true, nil, lag(time.Second), nil, http.StatusOK, "ok", map[string]string{"database": "ok", "replica": "ok"}},
+		{"replica behind", true, nil, lag(time.Minute), nil, http.StatusServiceUnavailable, "degraded", map[string]string{"database": "ok", "replica": "degraded"}},
+		{"replica down", true, nil, nil, errors.New("no replica"), http.StatusServiceUnavailable, "down", map[string]string{"database": "ok", "replica": "down"}},
+		{"worst of both", true, errors.New("no db"), lag(time.Minute), nil, http.StatusServiceUnavailable, "down", map[string]string{"database": "down", "replica": "degraded"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			if tt.replica {
+				cfg.DB.ReplicaURL = "host=replica"
+			}
+			store := newFakeStore()
+			store.lag = tt.lag
+			store.failWith("Ping", tt.pingErr)
+			store.failWith("ReplicaLag", tt.lagErr)
+			s := newTestServer(t, cfg, store)
+
+			w := do(s, "GET", "/healthz", "")
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			var resp struct {
+				Status string                 `json:"status"`
+				Checks map[string]healthCheck `json:"checks"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decoding %q: %v", w.Body, err)
+			}
+			if resp.Status != tt.wantOverall {
+				t.Errorf("overall status = %q, want %q", resp.Status, tt.wantOverall)
+			}
+			if len(resp.Checks) != len(tt.wantChecks) {
+				t.Errorf("checks = %+v, want %v", resp.Checks, tt.wantChecks)
+			}
+			for name, want := range tt.wantChecks {
+				if got := resp.Checks[name]; got.Status != want || got.LatencySeconds < 0 {
+					t.Errorf("check %s = %+v, want status %q with its latency", name, got, want)
+				}
+			}
+		})
+	}
+}
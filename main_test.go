@@ -0,0 +1,1583 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ndjson returns n transaction lines of 1 each, credits and debits
+// alternating.
+func ndjson(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		typ := "c"
+		if i%2 == 1 {
+			typ = "d"
+		}
+		b.WriteString(`{"valor": 1, "tipo": "` + typ + `", "descricao": "linha"}` + "\n")
+	}
+	return b.String()
+}
+
+type streamCounts struct {
+	Applied  int `json:"aplicadas"`
+	Rejected int `json:"rejeitadas"`
+}
+
+func TestTransactionsStream(t *testing.T) {
+	tests := []struct {
+		name        string
+		id          string
+		body        string
+		wantStatus  int
+		wantCounts  streamCounts
+		wantBatches int
+	}{
+		{
+			name:        "1000 lines",
+			id:          "1",
+			body:        ndjson(1000),
+			wantStatus:  http.StatusOK,
+			wantCounts:  streamCounts{Applied: 1000},
+			wantBatches: 10,
+		},
+		{
+			name:        "last line without newline",
+			id:          "1",
+			body:        strings.TrimSuffix(ndjson(3), "\n"),
+			wantStatus:  http.StatusOK,
+			wantCounts:  streamCounts{Applied: 3},
+			wantBatches: 1,
+		},
+		{
+			name:        "CRLF and blank lines",
+			id:          "1",
+			body:        "\r\n" + strings.ReplaceAll(ndjson(2), "\n", "\r\n") + "\n\n",
+			wantStatus:  http.StatusOK,
+			wantCounts:  streamCounts{Applied: 2},
+			wantBatches: 1,
+		},
+		{
+			name: "invalid lines",
+			id:   "1",
+			body: ndjson(1) +
+				"not json\n" +
+				`{"valor": 0, "tipo": "c", "descricao": "zero"}` + "\n" +
+				`{"valor": 1, "tipo": "x", "descricao": "tipo"}` + "\n" +
+				`{"valor": 1, "tipo": "c", "descricao": "muito longa demais"}` + "\n" +
+				`{"valor": 1, "tipo": "c"}` + "\n" +
+				`{"valor": 1, "tipo": "c", "descricao": "moeda", "moeda": "USD"}` + "\n" +
+				"{\"valor\": 1, \"tipo\": \"c\", \"descricao\": \"\xff\"}\n",
+			wantStatus:  http.StatusOK,
+			wantCounts:  streamCounts{Applied: 1, Rejected: 7},
+			wantBatches: 1,
+		},
+		{
+			name:        "line over the limit",
+			id:          "1",
+			body:        ndjson(1) + `{"valor": 1, "tipo": "c", "descricao": "` + strings.Repeat("x", streamMaxLine) + `"}` + "\n" + ndjson(1),
+			wantStatus:  http.StatusOK,
+			wantCounts:  streamCounts{Applied: 2, Rejected: 1},
+			wantBatches: 1,
+		},
+		{
+			name:        "debit over the limit",
+			id:          "2",
+			body:        `{"valor": 80001, "tipo": "d", "descricao": "alto"}` + "\n" + ndjson(1),
+			wantStatus:  http.StatusOK,
+			wantCounts:  streamCounts{Applied: 1, Rejected: 1},
+			wantBatches: 1,
+		},
+		{
+			name:       "unknown customer",
+			id:         "6",
+			body:       ndjson(1),
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "invalid id",
+			id:         "x",
+			body:       ndjson(1),
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			s := newTestServer(t, testConfig(), store)
+
+			w := do(s, "POST", "/clientes/"+tt.id+"/transacoes/stream", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got streamCounts
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding %q: %v", w.Body, err)
+			}
+			if got != tt.wantCounts {
+				t.Errorf("counts = %+v, want %+v", got, tt.wantCounts)
+			}
+			if n := store.count("BeginBatch"); n != tt.wantBatches {
+				t.Errorf("batches = %d, want %d", n, tt.wantBatches)
+			}
+		})
+	}
+}
+
+func TestTransactionsStreamCommitFailure(t *testing.T) {
+	store := newFakeStore()
+	s := newTestServer(t, testConfig(), store)
+	store.failWith("Batch.Commit", errors.New("commit failed"))
+
+	w := do(s, "POST", "/clientes/1/transacoes/stream", ndjson(10))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if c := store.customer(1); c.Balance != 0 {
+		t.Errorf("balance = %d after a failed commit, want 0", c.Balance)
+	}
+}
+
+// errReader fails after returning its data.
+type errReader struct {
+	data io.Reader
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestTransactionsStreamReadError(t *testing.T) {
+	store := newFakeStore()
+	s := newTestServer(t, testConfig(), store)
+
+	r := httptest.NewRequest("POST", "/clientes/1/transacoes/stream", &errReader{strings.NewReader(ndjson(150))})
+	w := httptest.NewRecorder()
+	s.Routes().ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	// The lines read in full before the body failed are applied.
+	if n := len(store.transactions[1]); n != 150 {
+		t.Errorf("transactions = %d, want 150", n)
+	}
+}
+
+func TestTransactionValidationFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantReason string
+	}{
+		{"malformed", `{"valor": `, http.StatusBadRequest, "syntax"},
+		{"truncated", `{"valor": 1, "tipo": "c", "descricao": "x"`, http.StatusBadRequest, "syntax"},
+		{"empty", ``, http.StatusBadRequest, "syntax"},
+		{"not json", `valor=1&tipo=c`, http.StatusBadRequest, "syntax"},
+		{"array", `[1, "c", "x"]`, http.StatusUnprocessableEntity, "decode"},
+		{"negative value", `{"valor": -1, "tipo": "c", "descricao": "x"}`, http.StatusUnprocessableEntity, "value"},
+		{"fractional value", `{"valor": 1.5, "tipo": "c", "descricao": "x"}`, http.StatusUnprocessableEntity, "decode"},
+		{"wrong field type", `{"valor": "1", "tipo": "c", "descricao": "x"}`, http.StatusUnprocessableEntity, "decode"},
+		{"zero value", `{"valor": 0, "tipo": "c", "descricao": "x"}`, http.StatusUnprocessableEntity, "value"},
+		{"unknown type", `{"valor": 1, "tipo": "x", "descricao": "x"}`, http.StatusUnprocessableEntity, "type"},
+		{"long descricao", `{"valor": 1, "tipo": "c", "descricao": "12345678901"}`, http.StatusUnprocessableEntity, "descricao"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, testConfig(), newFakeStore())
+			counter := validationFailureTotal.WithLabelValues(tt.wantReason)
+			before := counterValue(t, counter)
+
+			w := do(s, "POST", "/clientes/1/transacoes", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := counterValue(t, counter) - before; got != 1 {
+				t.Errorf("validation_failure_total{reason=%q} went up by %v, want 1", tt.wantReason, got)
+			}
+		})
+	}
+}
+
+func TestTransactionDescricao(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"omitted", `{"valor": 1, "tipo": "c"}`, http.StatusUnprocessableEntity, `{"erro": "descricao_required"}`},
+		{"null", `{"valor": 1, "tipo": "c", "descricao": null}`, http.StatusUnprocessableEntity, `{"erro": "descricao_required"}`},
+		{"empty", `{"valor": 1, "tipo": "c", "descricao": ""}`, http.StatusUnprocessableEntity, `{"erro": "descricao_empty"}`},
+		{"valid", `{"valor": 1, "tipo": "c", "descricao": "pix"}`, http.StatusOK, ""},
+		{"ten characters", `{"valor": 1, "tipo": "c", "descricao": "çççççççççç"}`, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, testConfig(), newFakeStore())
+
+			w := do(s, "POST", "/clientes/1/transacoes", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %s, want %s", w.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestTransactionDescricaoLists(t *testing.T) {
+	tests := []struct {
+		name         string
+		allow, deny  []string
+		descricao    string
+		wantReason   string
+		wantInDetail string
+	}{
+		{name: "no lists", descricao: "palavrao"},
+		{name: "denied", deny: []string{"palavrao", "admin"}, descricao: "admin", wantReason: "descricao_denied", wantInDetail: "admin is denylisted"},
+		{name: "denied in another case", deny: []string{"Admin"}, descricao: "ADMIN", wantReason: "descricao_denied", wantInDetail: "ADMIN is denylisted"},
+		{name: "not denied", deny: []string{"admin"}, descricao: "pix"},
+		{name: "allowed", allow: []string{"pix", "ted"}, descricao: "ted"},
+		{name: "allowed in another case", allow: []string{"pix"}, descricao: "PIX"},
+		{name: "not allowed", allow: []string{"pix", "ted"}, descricao: "boleto", wantReason: "descricao_not_allowed", wantInDetail: "boleto is not in the allowlist"},
+		{name: "both", allow: []string{"pix", "admin"}, deny: []string{"admin"}, descricao: "admin", wantReason: "descricao_denied", wantInDetail: "admin is denylisted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Transactions.AllowedDescricoes = tt.allow
+			cfg.Transactions.DeniedDescricoes = tt.deny
+			store := newFakeStore()
+			s := newTestServer(t, cfg, store)
+			var failures prometheus.Counter
+			var before float64
+			if tt.wantReason != "" {
+				failures = validationFailureTotal.WithLabelValues(tt.wantReason)
+				before = counterValue(t, failures)
+			}
+			body := `{"valor": 1, "tipo": "c", "descricao": "` + tt.descricao + `"}`
+
+			w := do(s, "POST", "/clientes/1/transacoes", body)
+			if tt.wantReason == "" {
+				if w.Code != http.StatusOK || store.count("Credit") != 1 {
+					t.Errorf("status = %d after %d credits, want it applied", w.Code, store.count("Credit"))
+				}
+				return
+			}
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusUnprocessableEntity)
+			}
+			if want := `{"erro": "` + tt.wantReason + `"}`; w.Body.String() != want {
+				t.Errorf("body = %s, want %s", w.Body, want)
+			}
+			if n := store.count("Credit"); n != 0 {
+				t.Errorf("Credit called %d times for a refused descricao", n)
+			}
+			if got := counterValue(t, failures) - before; got != 1 {
+				t.Errorf("validation_failure_total{reason=%s} went up by %v, want 1", tt.wantReason, got)
+			}
+
+			w = do(s, "POST", "/clientes/1/transacoes", body, "Accept", "application/problem+json")
+			if !strings.Contains(w.Body.String(), tt.wantInDetail) {
+				t.Errorf("problem = %s, want its detail to say %q", w.Body, tt.wantInDetail)
+			}
+		})
+	}
+}
+
+func TestTransactionMinValue(t *testing.T) {
+	tests := []struct {
+		name       string
+		minValue   int
+		value      int
+		wantStatus int
+		wantBody   string
+	}{
+		{"default minimum", 1, 50, http.StatusOK, ""},
+		{"below the minimum", 100, 50, http.StatusUnprocessableEntity, `{"erro": "valor_below_minimum"}`},
+		{"at the minimum", 100, 100, http.StatusOK, ""},
+		// Zero is rejected as any value, not for the minimum.
+		{"zero", 100, 0, http.StatusUnprocessableEntity, `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Transactions.MinValue = tt.minValue
+			store := newFakeStore()
+			s := newTestServer(t, cfg, store)
+
+			w := do(s, "POST", "/clientes/1/transacoes", `{"valor": `+strconv.Itoa(tt.value)+`, "tipo": "c", "descricao": "x"}`)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %s, want %s", w.Body, tt.wantBody)
+			}
+			if tt.wantStatus != http.StatusOK && store.count("Credit") != 0 {
+				t.Error("rejected transaction reached the store")
+			}
+		})
+	}
+}
+
+func TestTransactionMaxValue(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxValue   int
+		value      int
+		wantStatus int
+	}{
+		{"disabled", 0, 1 << 30, http.StatusOK},
+		{"at the maximum", 1000, 1000, http.StatusOK},
+		{"above the maximum", 1000, 1001, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Transactions.MaxValue = tt.maxValue
+			store := newFakeStore()
+			s := newTestServer(t, cfg, store)
+			counter := validationFailureTotal.WithLabelValues("max_value")
+			before := counterValue(t, counter)
+
+			w := do(s, "POST", "/clientes/1/transacoes", `{"valor": `+strconv.Itoa(tt.value)+`, "tipo": "c", "descricao": "x"}`)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			rejected := counterValue(t, counter) - before
+			if tt.wantStatus == http.StatusOK {
+				if rejected != 0 {
+					t.Error("validation_failure_total{reason=\"max_value\"} went up for an accepted value")
+				}
+				return
+			}
+			if want := `{"erro": "valor_above_maximum"}`; w.Body.String() != want {
+				t.Errorf("body = %s, want %s", w.Body, want)
+			}
+			if rejected != 1 {
+				t.Errorf("validation_failure_total{reason=\"max_value\"} went up by %v, want 1", rejected)
+			}
+		})
+	}
+}
+
+// refusingStore refuses every credit, as the credit function only would
+// with inconsistent data.
+type refusingStore struct {
+	Store
+}
+
+func (s refusingStore) Credit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	return TransactionResult{Applied: false}, nil
+}
+
+func TestTransactionNotApplied(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		wantStatus    int
+		wantRejection float64
+	}{
+		{"credit refused", `{"valor": 1, "tipo": "c", "descricao": "x"}`, http.StatusInternalServerError, 0},
+		{"debit over the limit", `{"valor": 100001, "tipo": "d", "descricao": "x"}`, http.StatusUnprocessableEntity, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, testConfig(), refusingStore{newFakeStore()})
+			counter := transactionRejectionTotal.WithLabelValues("business")
+			before := counterValue(t, counter)
+
+			w := do(s, "POST", "/clientes/1/transacoes", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := counterValue(t, counter) - before; got != tt.wantRejection {
+				t.Errorf("business rejections went up by %v, want %v", got, tt.wantRejection)
+			}
+		})
+	}
+}
+
+func TestHealth(t *testing.T) {
+	lag := func(d time.Duration) *time.Duration { return &d }
+	tests := []struct {
+		name       string
+		replica    bool
+		pingErr    error
+		lag        *time.Duration
+		lagErr     error
+		wantStatus int
+		wantBody   string
+	}{
+		{"ok", false, nil, nil, nil, http.StatusOK, `{"status":"ok"}`},
+		{"down", false, errors.New("no db"), nil, nil, http.StatusServiceUnavailable, `{"status":"down"}`},
+		{"replica ok", true, nil, lag(time.Second), nil, http.StatusOK, `{"status":"ok","replica_lag_seconds":1}`},
+		{"replica behind", true, nil, lag(time.Minute), nil, http.StatusServiceUnavailable, `{"status":"degraded","replica_lag_seconds":60}`},
+		{"replica never replayed", true, nil, nil, nil, http.StatusServiceUnavailable, `{"status":"degraded"}`},
+		{"replica unreachable", true, nil, nil, errors.New("no replica"), http.StatusServiceUnavailable, `{"status":"degraded"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			if tt.replica {
+				cfg.DB.ReplicaURL = "host=replica"
+			}
+			store := newFakeStore()
+			store.lag = tt.lag
+			store.failWith("Ping", tt.pingErr)
+			store.failWith("ReplicaLag", tt.lagErr)
+			s := newTestServer(t, cfg, store)
+
+			w := do(s, "GET", "/health", "")
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tt.wantBody {
+				t.Errorf("body = %s, want %s", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestNormalizeDescription(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"pix", "pix"},
+		{"  pix  ", "pix"},
+		{"a   b\tc", "a b c"},
+		{"\n", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeDescription(tt.in); got != tt.want {
+			t.Errorf("normalizeDescription(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTransactionNormalizesDescricao(t *testing.T) {
+	tests := []struct {
+		name       string
+		normalize  bool
+		descricao  string
+		wantStatus int
+		wantStored string
+	}{
+		{"off keeps spaces", false, " a  b ", http.StatusOK, " a  b "},
+		{"on collapses spaces", true, " a  b ", http.StatusOK, "a b"},
+		// Only 10 characters once normalized.
+		{"on shortens", true, "  1234567890  ", http.StatusOK, "1234567890"},
+		{"on leaves nothing", true, "   ", http.StatusUnprocessableEntity, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Transactions.NormalizeDescricao = tt.normalize
+			store := newFakeStore()
+			s := newTestServer(t, cfg, store)
+
+			w := do(s, "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "`+tt.descricao+`"}`)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := store.transactions[1][0].Description; got != tt.wantStored {
+				t.Errorf("stored descricao = %q, want %q", got, tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestInstrumentInFlight(t *testing.T) {
+	s := newTestServer(t, testConfig(), newFakeStore())
+	before := counterValue(t, httpRequestsInFlight)
+
+	var during float64
+	h := s.instrument("/test", func(w http.ResponseWriter, r *http.Request) {
+		during = counterValue(t, httpRequestsInFlight)
+	})
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+
+	if during != before+1 {
+		t.Errorf("in flight during the request = %v, want %v", during, before+1)
+	}
+	if after := counterValue(t, httpRequestsInFlight); after != before {
+		t.Errorf("in flight after the request = %v, want %v", after, before)
+	}
+}
+
+func TestCreateCustomer(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantLimit  int
+	}{
+		{"default limit", `{}`, http.StatusCreated, 50000},
+		{"explicit limit", `{"limite": 700}`, http.StatusCreated, 700},
+		{"zero limit", `{"limite": 0}`, http.StatusCreated, 0},
+		{"negative limit", `{"limite": -1}`, http.StatusUnprocessableEntity, 0},
+		{"malformed", `{"limite": `, http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Transactions.DefaultCreditLimit = 50000
+			store := newFakeStore()
+			s := newTestServer(t, cfg, store)
+
+			w := do(s, "POST", "/clientes", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusCreated {
+				return
+			}
+			var got customerRes
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding %q: %v", w.Body, err)
+			}
+			if got.ID != 6 || got.Limit != tt.wantLimit {
+				t.Errorf("created %+v, want id 6 with limite %d", got, tt.wantLimit)
+			}
+			if c := store.customer(6); c.Limit != tt.wantLimit {
+				t.Errorf("stored limit = %d, want %d", c.Limit, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestTransactionOnCreatedCustomer(t *testing.T) {
+	s := newTestServer(t, testConfig(), newFakeStore())
+	if w := do(s, "POST", "/clientes", `{"limite": 100}`); w.Code != http.StatusCreated {
+		t.Fatalf("creating customer: status %d", w.Code)
+	}
+
+	// Customers are looked up in the store, so ones created after startup,
+	// maybe by another instance, are found and unknown ones aren't.
+	if w := do(s, "POST", "/clientes/6/transacoes", `{"valor": 100, "tipo": "d", "descricao": "novo"}`); w.Code != http.StatusOK {
+		t.Errorf("debit on created customer: status %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := do(s, "POST", "/clientes/7/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`); w.Code != http.StatusNotFound {
+		t.Errorf("credit on unknown customer: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := do(s, "GET", "/clientes/7/extrato", ""); w.Code != http.StatusNotFound {
+		t.Errorf("statement of unknown customer: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestTransactionInconsistentBalance(t *testing.T) {
+	store := newFakeStore()
+	store.failWith("Debit", errInconsistentBalance)
+	s := newTestServer(t, testConfig(), store)
+
+	w := do(s, "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "d", "descricao": "x"}`)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestRuntimeCollectors(t *testing.T) {
+	s := newTestServer(t, testConfig(), newFakeStore())
+	families, err := s.reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	want := map[string]bool{"go_goroutines": false, "go_gc_duration_seconds": false, "process_cpu_seconds_total": false}
+	for _, f := range families {
+		if _, ok := want[f.GetName()]; ok {
+			want[f.GetName()] = true
+		}
+	}
+	for name, found := range want {
+		if !found {
+			t.Errorf("%s not gathered", name)
+		}
+	}
+
+	// Registering again, as a second server on the same registry does, is
+	// not an error.
+	if err := registerRuntimeCollectors(s.reg); err != nil {
+		t.Errorf("registering again: %v", err)
+	}
+}
+
+func TestListCustomers(t *testing.T) {
+	store := newFakeStore()
+	s := newTestServer(t, testConfig(), store)
+	do(s, "POST", "/clientes/1/transacoes", `{"valor": 10, "tipo": "d", "descricao": "x"}`)
+
+	w := do(s, "GET", "/clientes", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var got []customerRes
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body, err)
+	}
+	if len(got) != 5 {
+		t.Fatalf("got %d customers, want 5", len(got))
+	}
+	if want := (customerRes{ID: 1, Limit: 100000, Balance: -10, Currency: "BRL"}); got[0] != want {
+		t.Errorf("first customer = %+v, want %+v", got[0], want)
+	}
+}
+
+func TestBalances(t *testing.T) {
+	tooMany := strings.Repeat("1,", maxBalanceIDs) + "1"
+	tests := []struct {
+		name       string
+		ids        string
+		storeErr   error
+		wantStatus int
+		want       map[string]*customerRes
+	}{
+		{"existing", "?ids=1,2", nil, http.StatusOK, map[string]*customerRes{
+			"1": {ID: 1, Limit: 100000, Balance: -10, Currency: "BRL"},
+			"2": {ID: 2, Limit: 80000, Currency: "BRL"},
+		}},
+		{"mixed", "?ids=1,6,3,99", nil, http.StatusOK, map[string]*customerRes{
+			"1":  {ID: 1, Limit: 100000, Balance: -10, Currency: "BRL"},
+			"3":  {ID: 3, Limit: 1000000, Currency: "BRL"},
+			"6":  nil,
+			"99": nil,
+		}},
+		{"none existing", "?ids=6,7", nil, http.StatusOK, map[string]*customerRes{"6": nil, "7": nil}},
+		{"repeated", "?ids=2,2", nil, http.StatusOK, map[string]*customerRes{
+			"2": {ID: 2, Limit: 80000, Currency: "BRL"},
+		}},
+		{"at the cap", "?ids=" + tooMany[2:], nil, http.StatusOK, map[string]*customerRes{
+			"1": {ID: 1, Limit: 100000, Balance: -10, Currency: "BRL"},
+		}},
+		{"over the cap", "?ids=" + tooMany, nil, http.StatusUnprocessableEntity, nil},
+		{"missing", "", nil, http.StatusUnprocessableEntity, nil},
+		{"empty", "?ids=", nil, http.StatusUnprocessableEntity, nil},
+		{"not a number", "?ids=1,x", nil, http.StatusUnprocessableEntity, nil},
+		{"trailing comma", "?ids=1,", nil, http.StatusUnprocessableEntity, nil},
+		{"zero", "?ids=0", nil, http.StatusUnprocessableEntity, nil},
+		{"negative", "?ids=-1", nil, http.StatusUnprocessableEntity, nil},
+		{"store failure", "?ids=1", context.DeadlineExceeded, http.StatusServiceUnavailable, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			s := newTestServer(t, testConfig(), store)
+			do(s, "POST", "/clientes/1/transacoes", `{"valor": 10, "tipo": "d", "descricao": "x"}`)
+			store.failWith("Balances", tt.storeErr)
+
+			w := do(s, "GET", "/clientes/saldos"+tt.ids, "")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got map[string]*customerRes
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding %q: %v", w.Body, err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %s, want %d ids", w.Body, len(tt.want))
+			}
+			for id, want := range tt.want {
+				c, ok := got[id]
+				if !ok {
+					t.Errorf("id %s is missing", id)
+				} else if (c == nil) != (want == nil) || c != nil && *c != *want {
+					t.Errorf("id %s = %+v, want %+v", id, c, want)
+				}
+			}
+			if n := store.count("Balances"); n != 1 {
+				t.Errorf("Balances called %d times, want a single query", n)
+			}
+		})
+	}
+}
+
+func TestCustomersRequireAPIKey(t *testing.T) {
+	routes := []struct{ method, target, body string }{
+		{"GET", "/clientes", ""},
+		{"GET", "/clientes/saldos?ids=1", ""},
+		{"POST", "/clientes", `{}`},
+	}
+	keys := []struct {
+		name       string
+		key        string
+		wantStatus int
+	}{
+		{"no key", "", http.StatusUnauthorized},
+		{"wrong key", "nope", http.StatusUnauthorized},
+		{"right key", "secret", 0},
+	}
+	for _, rt := range routes {
+		for _, k := range keys {
+			t.Run(rt.method+" "+rt.target+" "+k.name, func(t *testing.T) {
+				cfg := testConfig()
+				cfg.Server.APIKey = "secret"
+				s := newTestServer(t, cfg, newFakeStore())
+
+				w := do(s, rt.method, rt.target, rt.body, "X-API-Key", k.key)
+				if k.wantStatus == 0 {
+					if w.Code == http.StatusUnauthorized {
+						t.Errorf("status = %d with the right key", w.Code)
+					}
+				} else if w.Code != k.wantStatus {
+					t.Errorf("status = %d, want %d", w.Code, k.wantStatus)
+				}
+			})
+		}
+	}
+}
+
+func TestCustomerAPIKeys(t *testing.T) {
+	credit := `{"valor": 1, "tipo": "c", "descricao": "x"}`
+	tests := []struct {
+		name                 string
+		key                  string
+		method, target, body string
+		wantStatus           int
+	}{
+		{"own customer statement", "key-1", "GET", "/clientes/1/extrato", "", http.StatusOK},
+		{"own customer transaction", "key-1", "POST", "/clientes/1/transacoes", credit, http.StatusOK},
+		{"other customer statement", "key-1", "GET", "/clientes/2/extrato", "", http.StatusForbidden},
+		{"other customer transaction", "key-1", "POST", "/clientes/2/transacoes", credit, http.StatusForbidden},
+		{"other customer export", "key-1", "GET", "/clientes/2/export", "", http.StatusForbidden},
+		{"second of several customers", "key-23", "GET", "/clientes/3/extrato", "", http.StatusOK},
+		{"outside of several customers", "key-23", "GET", "/clientes/1/extrato", "", http.StatusForbidden},
+		{"admin key", "admin", "GET", "/clientes/2/extrato", "", http.StatusOK},
+		{"unknown key", "nope", "GET", "/clientes/1/extrato", "", http.StatusUnauthorized},
+		{"no key", "", "GET", "/clientes/1/extrato", "", http.StatusUnauthorized},
+		{"customer key on admin route", "key-1", "GET", "/clientes", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Server.APIKey = "admin"
+			cfg.Server.CustomerAPIKeys = map[string][]int{"key-1": {1}, "key-23": {2, 3}}
+			store := newFakeStore()
+			s := newTestServer(t, cfg, store)
+
+			w := do(s, tt.method, tt.target, tt.body, "X-API-Key", tt.key)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusForbidden && store.count("Credit")+store.count("Statement") != 0 {
+				t.Error("the store was called for a forbidden request")
+			}
+		})
+	}
+}
+
+func TestObserveDurationSampling(t *testing.T) {
+	tests := []struct {
+		name             string
+		rate             float64
+		wantMin, wantMax uint64
+	}{
+		{"all", 1, 10000, 10000},
+		// Far enough from the mean to never fail in practice.
+		{"half", 0.5, 4500, 5500},
+		{"rare", 0.01, 20, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Metrics.SampleRate = tt.rate
+			s := newTestServer(t, cfg, newFakeStore())
+			path := "/sampling/" + tt.name
+
+			for i := 0; i < 10000; i++ {
+				s.observeDuration("GET", path, "", time.Now())
+			}
+			got := histogramCount(t, httpRequestDuration.WithLabelValues("GET", path).(prometheus.Histogram))
+			if got < tt.wantMin || got > tt.wantMax {
+				t.Errorf("observations = %d, want between %d and %d", got, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := t.TempDir() + "/api.sock"
+	// Left behind by a run that didn't shut down cleanly.
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0o666 {
+		t.Errorf("socket mode = %v, want a socket with 0666", fi.Mode())
+	}
+
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }))
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://unix/")
+	if err != nil {
+		t.Fatalf("request over the socket: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d", resp.StatusCode)
+	}
+}
+
+func TestListenTCP(t *testing.T) {
+	ln, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	if ln.Addr().Network() != "tcp" {
+		t.Errorf("network = %s, want tcp", ln.Addr().Network())
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         string
+		body       string
+		storeErr   error
+		wantStatus int
+		wantBody   string
+	}{
+		{"credit", "1", `{"valor": 100, "tipo": "c", "descricao": "pix"}`, nil, http.StatusOK, `{"limite": 100000, "saldo": 100}`},
+		{"debit", "1", `{"valor": 100, "tipo": "d", "descricao": "pix"}`, nil, http.StatusOK, `{"limite": 100000, "saldo": -100}`},
+		{"debit up to the limit", "2", `{"valor": 80000, "tipo": "d", "descricao": "pix"}`, nil, http.StatusOK, `{"limite": 80000, "saldo": -80000}`},
+		{"debit over the limit", "2", `{"valor": 80001, "tipo": "d", "descricao": "pix"}`, nil, http.StatusUnprocessableEntity, `{}`},
+		{"unknown customer", "6", `{"valor": 1, "tipo": "c", "descricao": "pix"}`, nil, http.StatusNotFound, `{}`},
+		{"non-numeric id", "abc", `{"valor": 1, "tipo": "c", "descricao": "pix"}`, nil, http.StatusNotFound, `{}`},
+		{"store failure", "1", `{"valor": 1, "tipo": "c", "descricao": "pix"}`, errors.New("boom"), http.StatusInternalServerError, `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			store.failWith("Credit", tt.storeErr)
+			s := newTestServer(t, testConfig(), store)
+
+			w := do(s, "POST", "/clientes/"+tt.id+"/transacoes", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %s, want %s", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestParseCustomerID(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{"1", 1, false},
+		{"2147483647", 2147483647, false},
+		{"2147483648", 0, true},
+		{"99999999999999999999", 0, true},
+		{"-1", -1, false},
+		{"", 0, true},
+		{"1a", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCustomerID(tt.in)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+			t.Errorf("parseCustomerID(%q) = %d, %v; want %d, error: %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestInstrumentResponseSize(t *testing.T) {
+	s := newTestServer(t, testConfig(), newFakeStore())
+	size := httpResponseSize.WithLabelValues("/clientes/{id}/extrato").(prometheus.Histogram)
+	before := collectOne(t, size).Histogram
+
+	w := do(s, "GET", "/clientes/1/extrato", "")
+
+	after := collectOne(t, size).Histogram
+	if got := after.GetSampleCount() - before.GetSampleCount(); got != 1 {
+		t.Errorf("observations = %d, want 1", got)
+	}
+	if got := after.GetSampleSum() - before.GetSampleSum(); got != float64(w.Body.Len()) {
+		t.Errorf("observed %v bytes, want %d", got, w.Body.Len())
+	}
+}
+
+func TestInstrumentStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    string
+	}{
+		{"explicit", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) }, "418"},
+		{"implicit", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }, "200"},
+		{"nothing", func(w http.ResponseWriter, r *http.Request) {}, "200"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, testConfig(), newFakeStore())
+			path := "/status/" + tt.name
+			counter := httpRequestTotal.WithLabelValues(tt.want, "GET", path)
+			before := counterValue(t, counter)
+
+			w := httptest.NewRecorder()
+			s.instrument(path, tt.handler)(w, httptest.NewRequest("GET", path, nil))
+			if got := strconv.Itoa(w.Code); got != tt.want {
+				t.Errorf("status written = %s, want %s", got, tt.want)
+			}
+			if got := counterValue(t, counter) - before; got != 1 {
+				t.Errorf("http_request_total{code=%q} went up by %v, want 1", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRoutesInstrumented(t *testing.T) {
+	tests := []struct {
+		method, target, body string
+		wantCode, wantPath   string
+	}{
+		{"POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`, "200", "/clientes/{id}/transacoes"},
+		{"POST", "/clientes/1/transacoes", `{"valor": 0}`, "422", "/clientes/{id}/transacoes"},
+		{"GET", "/clientes/2/extrato", "", "200", "/clientes/{id}/extrato"},
+		{"GET", "/clientes/9/extrato", "", "404", "/clientes/{id}/extrato"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target+" "+tt.wantCode, func(t *testing.T) {
+			s := newTestServer(t, testConfig(), newFakeStore())
+			counter := httpRequestTotal.WithLabelValues(tt.wantCode, tt.method, tt.wantPath)
+			duration := httpRequestDuration.WithLabelValues(tt.method, tt.wantPath).(prometheus.Histogram)
+			beforeCount, beforeDuration := counterValue(t, counter), histogramCount(t, duration)
+
+			do(s, tt.method, tt.target, tt.body)
+
+			if got := counterValue(t, counter) - beforeCount; got != 1 {
+				t.Errorf("http_request_total went up by %v, want 1", got)
+			}
+			if got := histogramCount(t, duration) - beforeDuration; got != 1 {
+				t.Errorf("http_request_duration_seconds got %d observations, want 1", got)
+			}
+		})
+	}
+}
+
+func TestRequestMetricLabels(t *testing.T) {
+	s := newTestServer(t, testConfig(), newFakeStore())
+	// Three statuses on the same path.
+	do(s, "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`)
+	do(s, "POST", "/clientes/1/transacoes", `{"valor": 0}`)
+	do(s, "POST", "/clientes/9/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`)
+
+	families, err := s.reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		wantLabels string
+		// minSeries and maxSeries bound the number of series of the
+		// transactions path. Other tests add to the same metrics, so only
+		// the ones without a code label have an exact count.
+		minSeries, maxSeries int
+	}{
+		{"http_request_duration_seconds", "method,path", 1, 1},
+		{"http_response_size_bytes", "path", 1, 1},
+		{"http_request_total", "code,method,path", 3, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			series := 0
+			for _, mf := range families {
+				if mf.GetName() != tt.name {
+					continue
+				}
+				for _, m := range mf.GetMetric() {
+					var names []string
+					path := ""
+					for _, l := range m.GetLabel() {
+						names = append(names, l.GetName())
+						if l.GetName() == "path" {
+							path = l.GetValue()
+						}
+					}
+					if got := strings.Join(names, ","); got != tt.wantLabels {
+						t.Errorf("labels = %s, want %s", got, tt.wantLabels)
+					}
+					if path == "/clientes/{id}/transacoes" {
+						series++
+					}
+				}
+			}
+			if series < tt.minSeries || series > tt.maxSeries {
+				t.Errorf("%d series for the transactions path, want %d to %d", series, tt.minSeries, tt.maxSeries)
+			}
+		})
+	}
+}
+
+func TestTransactionTotal(t *testing.T) {
+	s := newTestServer(t, testConfig(), newFakeStore())
+	credits := transactionTotal.WithLabelValues("c")
+	debits := transactionTotal.WithLabelValues("d")
+	beforeCredits, beforeDebits := counterValue(t, credits), counterValue(t, debits)
+
+	for _, body := range []string{
+		`{"valor": 100, "tipo": "c", "descricao": "x"}`,
+		`{"valor": 100, "tipo": "c", "descricao": "x"}`,
+		`{"valor": 100, "tipo": "c", "descricao": "x"}`,
+		`{"valor": 50, "tipo": "d", "descricao": "x"}`,
+		// Rejected ones aren't counted.
+		`{"valor": 1000000, "tipo": "d", "descricao": "x"}`,
+		`{"valor": 0, "tipo": "c", "descricao": "x"}`,
+	} {
+		do(s, "POST", "/clientes/1/transacoes", body)
+	}
+
+	if got := counterValue(t, credits) - beforeCredits; got != 3 {
+		t.Errorf("transactions_total{type=\"c\"} went up by %v, want 3", got)
+	}
+	if got := counterValue(t, debits) - beforeDebits; got != 1 {
+		t.Errorf("transactions_total{type=\"d\"} went up by %v, want 1", got)
+	}
+}
+
+func TestRoot(t *testing.T) {
+	tests := []struct {
+		target     string
+		wantStatus int
+	}{
+		{"/", http.StatusOK},
+		{"/nothing", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			s := newTestServer(t, testConfig(), newFakeStore())
+			counter := httpRequestTotal.WithLabelValues(strconv.Itoa(tt.wantStatus), "GET", tt.target)
+			before := counterValue(t, counter)
+
+			w := do(s, "GET", tt.target, "")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK {
+				var body map[string]string
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["service"] != "rinha-2024" || body["health"] == "" || body["metrics"] == "" {
+					t.Errorf("body = %s, want the service name and links", w.Body)
+				}
+			}
+			if got := counterValue(t, counter) - before; got != 0 {
+				t.Errorf("http_request_total went up by %v, want the root excluded", got)
+			}
+		})
+	}
+}
+
+func TestTransactionExpectedBalance(t *testing.T) {
+	tests := []struct {
+		name        string
+		expected    int
+		wantStatus  int
+		wantBalance int
+	}{
+		{"matching", 500, http.StatusOK, 600},
+		{"mismatch", 400, http.StatusConflict, 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			s := newTestServer(t, testConfig(), store)
+			seed(t, s, `{"valor": 500, "tipo": "c", "descricao": "x"}`)
+
+			w := do(s, "POST", "/clientes/1/transacoes", `{"valor": 100, "tipo": "c", "descricao": "x", "saldo_esperado": `+strconv.Itoa(tt.expected)+`}`)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusConflict {
+				if want := `{"erro": "saldo_esperado_mismatch", "saldo": 500}`; w.Body.String() != want {
+					t.Errorf("body = %s, want %s", w.Body, want)
+				}
+			}
+			if got := store.customer(1).Balance; got != tt.wantBalance {
+				t.Errorf("balance = %d, want %d", got, tt.wantBalance)
+			}
+		})
+	}
+}
+
+// BenchmarkMetricUpdates compares counting a request by looking its labels up
+// in the vec, as instrument does for the status code, with incrementing a
+// counter resolved up front and with batching into a local atomic flushed to
+// the counter every 100ms. The last one covers the whole middleware.
+func BenchmarkMetricUpdates(b *testing.B) {
+	newCounter := func() *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: "bench_total"}, []string{"code", "method", "path"})
+	}
+
+	b.Run("current", func(b *testing.B) {
+		counter := newCounter()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				counter.WithLabelValues("200", "GET", "/clientes/{id}/extrato").Inc()
+			}
+		})
+	})
+	b.Run("resolved", func(b *testing.B) {
+		counter := newCounter().WithLabelValues("200", "GET", "/clientes/{id}/extrato")
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				counter.Inc()
+			}
+		})
+	})
+	b.Run("batched", func(b *testing.B) {
+		counter := newCounter().WithLabelValues("200", "GET", "/clientes/{id}/extrato")
+		var pending atomic.Int64
+		done := make(chan struct{})
+		flushed := make(chan struct{})
+		go func() {
+			defer close(flushed)
+			ticker := time.NewTicker(100 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					counter.Add(float64(pending.Swap(0)))
+				case <-done:
+					counter.Add(float64(pending.Swap(0)))
+					return
+				}
+			}
+		}()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				pending.Add(1)
+			}
+		})
+		close(done)
+		<-flushed
+	})
+	b.Run("instrument", func(b *testing.B) {
+		s := newTestServer(b, testConfig(), newFakeStore())
+		h := s.instrument("/bench", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("{}")) })
+		r := httptest.NewRequest("GET", "/bench", nil)
+		b.RunParallel(func(pb *testing.PB) {
+			w := httptest.NewRecorder()
+			for pb.Next() {
+				w.Body.Reset()
+				h(w, r)
+			}
+		})
+	})
+}
+
+func TestTransactionsByDescription(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowlist []string
+		descs     []string
+		want      map[string]float64
+	}{
+		{"disabled", nil, []string{"pix", "boleto"}, map[string]float64{"pix": 0, "other": 0}},
+		{"allowlisted and others", []string{"pix", "boleto"}, []string{"pix", "pix", "boleto", "ted", "doc"}, map[string]float64{"pix": 2, "boleto": 1, "other": 2, "ted": 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Metrics.Descriptions = tt.allowlist
+			s := newTestServer(t, cfg, newFakeStore())
+			before := make(map[string]float64)
+			for label := range tt.want {
+				before[label] = counterValue(t, transactionByDescriptionTotal.WithLabelValues(label))
+			}
+
+			for _, desc := range tt.descs {
+				do(s, "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "`+desc+`"}`)
+			}
+			// Rejected transactions aren't counted.
+			do(s, "POST", "/clientes/1/transacoes", `{"valor": 1000000, "tipo": "d", "descricao": "pix"}`)
+
+			for label, want := range tt.want {
+				if got := counterValue(t, transactionByDescriptionTotal.WithLabelValues(label)) - before[label]; got != want {
+					t.Errorf("transactions_by_description_total{description=%q} went up by %v, want %v", label, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    transactionRequest
+		wantErr func(error) bool
+	}{
+		{"valid", `{"valor": 1, "tipo": "c", "descricao": "x"}`, transactionRequest{Value: 1, Type: "c"}, nil},
+		{"trailing whitespace", "{\"valor\": 1, \"tipo\": \"c\"}\n\t ", transactionRequest{Value: 1, Type: "c"}, nil},
+		// json.Decoder stopped after the first value, ignoring the rest.
+		{"trailing value", `{"valor": 1, "tipo": "c"} {"valor": 2}`, transactionRequest{}, isMalformedJSON},
+		{"trailing garbage", `{"valor": 1, "tipo": "c"}x`, transactionRequest{}, isMalformedJSON},
+		{"empty", ``, transactionRequest{}, isMalformedJSON},
+		{"invalid utf-8", "{\"valor\": 1, \"tipo\": \"c\", \"descricao\": \"\xff\"}", transactionRequest{}, func(err error) bool { return errors.Is(err, errInvalidUTF8) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got transactionRequest
+			err := decodeBody(strings.NewReader(tt.body), &got)
+			if tt.wantErr != nil {
+				if err == nil || !tt.wantErr(err) {
+					t.Errorf("err = %v, want a %s error", err, tt.name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeBody: %v", err)
+			}
+			if got.Value != tt.want.Value || got.Type != tt.want.Type {
+				t.Errorf("decoded %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	s := newTestServer(t, testConfig(), newFakeStore())
+	w := do(s, "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}{"valor": 1}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("body with trailing data: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+// Buffers go back to the pool while other requests decode, so no decoded
+// value may point into them.
+func TestDecodeBodyConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			desc := strconv.Itoa(i)
+			for j := 0; j < 100; j++ {
+				var tr transactionRequest
+				if err := decodeBody(strings.NewReader(`{"valor": `+desc+`, "tipo": "c", "descricao": "`+desc+`"}`), &tr); err != nil {
+					t.Errorf("decodeBody: %v", err)
+					return
+				}
+				runtime.Gosched()
+				if tr.Value != i || tr.Descricao == nil || *tr.Descricao != desc {
+					t.Errorf("decoded %d/%v, want %s", tr.Value, tr.Descricao, desc)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkDecodeBody compares decoding a transaction request with a
+// json.Decoder per request, as before, with decodeBody. Run with -benchmem.
+func BenchmarkDecodeBody(b *testing.B) {
+	body := []byte(`{"valor": 1000, "tipo": "c", "descricao": "descricao"}`)
+	b.Run("json.Decoder", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var tr transactionRequest
+			if err := json.NewDecoder(bytes.NewReader(body)).Decode(&tr); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("decodeBody", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var tr transactionRequest
+			if err := decodeBody(bytes.NewReader(body), &tr); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestTransactionInvalidUTF8(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantDesc   string
+	}{
+		{"invalid byte", "{\"valor\": 1, \"tipo\": \"c\", \"descricao\": \"ab\xffc\"}", http.StatusUnprocessableEntity, ""},
+		{"overlong encoding", "{\"valor\": 1, \"tipo\": \"c\", \"descricao\": \"\xc0\xaf\"}", http.StatusUnprocessableEntity, ""},
+		{"truncated sequence", "{\"valor\": 1, \"tipo\": \"c\", \"descricao\": \"\xe2\x82\"}", http.StatusUnprocessableEntity, ""},
+		{"surrogate half", "{\"valor\": 1, \"tipo\": \"c\", \"descricao\": \"\xed\xa0\x80\"}", http.StatusUnprocessableEntity, ""},
+		{"outside descricao", "{\"valor\": 1, \"tipo\": \"c\", \"descricao\": \"x\", \"\xff\": 1}", http.StatusUnprocessableEntity, ""},
+		{"multibyte", `{"valor": 1, "tipo": "c", "descricao": "café"}`, http.StatusOK, "café"},
+		{"ten multibyte runes", `{"valor": 1, "tipo": "c", "descricao": "çãéíóúâêôà"}`, http.StatusOK, "çãéíóúâêôà"},
+		{"escaped", `{"valor": 1, "tipo": "c", "descricao": "caf\u00e9"}`, http.StatusOK, "café"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			s := newTestServer(t, testConfig(), store)
+			failures := validationFailureTotal.WithLabelValues("utf8")
+			before := counterValue(t, failures)
+
+			w := do(s, "POST", "/clientes/1/transacoes", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if got := counterValue(t, failures) - before; got != 1 {
+					t.Errorf("utf8 validation failures went up by %v, want 1", got)
+				}
+				if n := store.count("Credit"); n != 0 {
+					t.Errorf("Credit called %d times for an invalid body", n)
+				}
+				return
+			}
+			if got := store.transactions[1][0].Description; got != tt.wantDesc {
+				t.Errorf("stored descricao %q, want %q", got, tt.wantDesc)
+			}
+		})
+	}
+}
+
+func TestTransactionRejectionClass(t *testing.T) {
+	tests := []struct {
+		name                         string
+		body                         string
+		wantStatus                   int
+		wantValidation, wantBusiness float64
+		// capped seeds one transaction under a cap of one.
+		capped bool
+	}{
+		{"applied", `{"valor": 1, "tipo": "c", "descricao": "x"}`, http.StatusOK, 0, 0, false},
+		{"invalid valor", `{"valor": 0, "tipo": "c", "descricao": "x"}`, http.StatusUnprocessableEntity, 1, 0, false},
+		{"invalid tipo", `{"valor": 1, "tipo": "x", "descricao": "x"}`, http.StatusUnprocessableEntity, 1, 0, false},
+		{"wrong field type", `{"valor": "1", "tipo": "c", "descricao": "x"}`, http.StatusUnprocessableEntity, 1, 0, false},
+		{"malformed", `{"valor": `, http.StatusBadRequest, 1, 0, false},
+		{"moeda mismatch", `{"valor": 1, "tipo": "c", "descricao": "x", "moeda": "USD"}`, http.StatusUnprocessableEntity, 1, 0, false},
+		{"over the limit", `{"valor": 1000000, "tipo": "d", "descricao": "x"}`, http.StatusUnprocessableEntity, 0, 1, false},
+		{"transaction cap", `{"valor": 1, "tipo": "c", "descricao": "x"}`, http.StatusUnprocessableEntity, 0, 1, true},
+		{"saldo_esperado mismatch", `{"valor": 1, "tipo": "c", "descricao": "x", "saldo_esperado": 5}`, http.StatusConflict, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			if tt.capped {
+				cfg.Transactions.MaxPerCustomer = 1
+			}
+			s := newTestServer(t, cfg, newFakeStore())
+			if tt.capped {
+				seed(t, s, `{"valor": 1, "tipo": "c", "descricao": "x"}`)
+			}
+			validation := transactionRejectionTotal.WithLabelValues("validation")
+			business := transactionRejectionTotal.WithLabelValues("business")
+			beforeValidation, beforeBusiness := counterValue(t, validation), counterValue(t, business)
+			requests := httpRequestTotal.WithLabelValues(strconv.Itoa(tt.wantStatus), "POST", "/clientes/{id}/transacoes")
+			beforeRequests := counterValue(t, requests)
+
+			w := do(s, "POST", "/clientes/1/transacoes", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := counterValue(t, validation) - beforeValidation; got != tt.wantValidation {
+				t.Errorf("validation rejections went up by %v, want %v", got, tt.wantValidation)
+			}
+			if got := counterValue(t, business) - beforeBusiness; got != tt.wantBusiness {
+				t.Errorf("business rejections went up by %v, want %v", got, tt.wantBusiness)
+			}
+			// The HTTP counter is left as it is.
+			if got := counterValue(t, requests) - beforeRequests; got != 1 {
+				t.Errorf("http_request_total went up by %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestTransactionCreated(t *testing.T) {
+	tests := []struct {
+		name         string
+		created      bool
+		prefix       string
+		body         string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"default", false, "", `{"valor": 1, "tipo": "c", "descricao": "x"}`, http.StatusOK, ""},
+		{"credit", true, "", `{"valor": 1, "tipo": "c", "descricao": "x"}`, http.StatusCreated, "/clientes/1/transacoes/2"},
+		{"debit", true, "", `{"valor": 1, "tipo": "d", "descricao": "x"}`, http.StatusCreated, "/clientes/1/transacoes/2"},
+		{"path prefix", true, "/api", `{"valor": 1, "tipo": "c", "descricao": "x"}`, http.StatusCreated, "/api/clientes/1/transacoes/2"},
+		{"over the limit", true, "", `{"valor": 1000000, "tipo": "d", "descricao": "x"}`, http.StatusUnprocessableEntity, ""},
+		{"invalid", true, "", `{"valor": 0, "tipo": "c", "descricao": "x"}`, http.StatusUnprocessableEntity, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Transactions.Created201 = tt.created
+			cfg.Server.PathPrefix = tt.prefix
+			s := newTestServer(t, cfg, newFakeStore())
+			// The first transaction takes id 1, so the one under test is 2.
+			do(s, "POST", tt.prefix+"/clientes/2/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`)
+
+			w := do(s, "POST", tt.prefix+"/clientes/1/transacoes", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+			if tt.wantStatus == http.StatusUnprocessableEntity {
+				return
+			}
+			var got struct{ Limite, Saldo int }
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.Limite != 100000 {
+				t.Errorf("body = %s, want the limite and saldo", w.Body)
+			}
+		})
+	}
+}
+
+func TestBodyTooLarge(t *testing.T) {
+	const limit = 1024
+	// padded is a valid transaction of n bytes, blank-padded before the
+	// closing brace.
+	padded := func(n int) string {
+		body := `{"valor": 1, "tipo": "c", "descricao": "x"`
+		return body + strings.Repeat(" ", n-len(body)-1) + "}"
+	}
+	tests := []struct {
+		name       string
+		max        int64
+		target     string
+		body       string
+		wantStatus int
+		wantCount  float64
+	}{
+		{"transaction at the limit", limit, "/clientes/1/transacoes", padded(limit), http.StatusOK, 0},
+		{"transaction over the limit", limit, "/clientes/1/transacoes", padded(limit + 1), http.StatusRequestEntityTooLarge, 1},
+		{"transaction far over the limit", limit, "/clientes/1/transacoes", padded(10 * limit), http.StatusRequestEntityTooLarge, 1},
+		{"customer over the limit", limit, "/clientes", `{"limite": 1000` + strings.Repeat(" ", limit) + `}`, http.StatusRequestEntityTooLarge, 1},
+		{"malformed", limit, "/clientes/1/transacoes", `{"valor": `, http.StatusBadRequest, 0},
+		{"no limit", 0, "/clientes/1/transacoes", padded(10 * limit), http.StatusOK, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Server.MaxBodyBytes = tt.max
+			s := newTestServer(t, cfg, newFakeStore())
+			before := counterValue(t, requestBodyTooLargeTotal)
+
+			w := do(s, "POST", tt.target, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := counterValue(t, requestBodyTooLargeTotal) - before; got != tt.wantCount {
+				t.Errorf("request_body_too_large_total went up by %v, want %v", got, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceparent string
+		want        string
+	}{
+		{"valid", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{"missing", "", ""},
+		{"too few parts", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", ""},
+		{"short id", "00-4bf92f3577b34da6-00f067aa0ba902b7-01", ""},
+		{"uppercase id", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", ""},
+		{"all zeros", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.traceparent != "" {
+				r.Header.Set("traceparent", tt.traceparent)
+			}
+			if got := traceID(r); got != tt.want {
+				t.Errorf("traceID = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExemplars(t *testing.T) {
+	tests := []struct {
+		name         string
+		exemplars    bool
+		traceID      string
+		traceparent  string
+		wantExemplar bool
+	}{
+		{"traced", true, "0af7651916cd43dd8448eb211c80319c", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", true},
+		{"malformed traceparent", true, "1af7651916cd43dd8448eb211c80319c", "00-1af7651916cd43dd8448eb211c80319c-b7ad6b7169203331", false},
+		{"exemplars off", false, "2af7651916cd43dd8448eb211c80319c", "00-2af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Metrics.Exemplars = tt.exemplars
+			s := newTestServer(t, cfg, newFakeStore())
+			do(s, "GET", "/clientes/1/extrato", "", "traceparent", tt.traceparent)
+
+			w := do(s, "GET", "/metrics", "", "Accept", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d", w.Code)
+			}
+			if got := strings.HasPrefix(w.Header().Get("Content-Type"), "application/openmetrics-text"); got != tt.exemplars {
+				t.Errorf("Content-Type = %q, want OpenMetrics %v", w.Header().Get("Content-Type"), tt.exemplars)
+			}
+			var found bool
+			for _, line := range strings.Split(w.Body.String(), "\n") {
+				if strings.Contains(line, `# {trace_id="`+tt.traceID+`"}`) {
+					found = true
+					if !strings.HasPrefix(line, `http_request_duration_seconds_bucket{method="GET",path="/clientes/{id}/extrato",`) {
+						t.Errorf("exemplar on %q, want it on the statement duration", line)
+					}
+				}
+			}
+			if found != tt.wantExemplar {
+				t.Errorf("exemplar with trace id %s found %v, want %v", tt.traceID, found, tt.wantExemplar)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// persistedCounters are the counters saved by saveCounters and restored by
+// restoreCounters, by name.
+//
+// Only counters are persisted: histograms can't be restored through the
+// client API, and gauges describe the current process. Restoring adds the
+// saved values to whatever was counted since startup, and the file is only
+// written on a graceful shutdown, so a crash loses everything counted since
+// the start. Several instances must not share the file, as the last one to
+// stop would overwrite the others' totals.
+var persistedCounters = map[string]prometheus.Collector{
+	"http_request_total":                httpRequestTotal,
+	"transactions_total":                transactionTotal,
+	"db_connection_errors_total":        dbConnectionErrorTotal,
+	"transactions_by_description_total": transactionByDescriptionTotal,
+	"validation_failure_total":          validationFailureTotal,
+	"request_body_too_large_total":      requestBodyTooLargeTotal,
+	"transaction_rejections_total":      transactionRejectionTotal,
+	"buffered_credits_dropped_total":    bufferedCreditsDroppedTotal,
+}
+
+type persistedSample struct {
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// saveCounters writes the value of every series of persistedCounters to
+// path, through a temporary file so a failed write leaves the last snapshot.
+func saveCounters(path string) error {
+	snapshot := make(map[string][]persistedSample)
+	for name, c := range persistedCounters {
+		ch := make(chan prometheus.Metric)
+		go func() {
+			c.Collect(ch)
+			close(ch)
+		}()
+		for m := range ch {
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil {
+				continue
+			}
+			sample := persistedSample{Value: pb.GetCounter().GetValue()}
+			for _, l := range pb.GetLabel() {
+				if sample.Labels == nil {
+					sample.Labels = make(map[string]string)
+				}
+				sample.Labels[l.GetName()] = l.GetValue()
+			}
+			snapshot[name] = append(snapshot[name], sample)
+		}
+	}
+
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// restoreCounters adds the values saved in path to persistedCounters. A
+// missing file, as on the first run, restores nothing.
+func restoreCounters(path string) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snapshot map[string][]persistedSample
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return err
+	}
+
+	for name, samples := range snapshot {
+		for _, sample := range samples {
+			switch c := persistedCounters[name].(type) {
+			case prometheus.Counter:
+				c.Add(sample.Value)
+			case *prometheus.CounterVec:
+				// Labels that no longer exist are dropped.
+				if counter, err := c.GetMetricWith(sample.Labels); err == nil {
+					counter.Add(sample.Value)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPersistCounters(t *testing.T) {
+	credits := transactionTotal.WithLabelValues("c")
+	tests := []struct {
+		name string
+		// save saves the counters, otherwise file is written when set.
+		save         bool
+		file         string
+		wantErr      bool
+		wantTooLarge float64
+		wantCredits  float64
+	}{
+		{name: "saved", save: true},
+		{name: "counter", file: `{"request_body_too_large_total": [{"value": 3}]}`, wantTooLarge: 3},
+		{name: "vector", file: `{"transactions_total": [{"labels": {"type": "c"}, "value": 7}]}`, wantCredits: 7},
+		{name: "unknown labels", file: `{"transactions_total": [{"labels": {"tipo": "c"}, "value": 7}]}`},
+		{name: "unknown counter", file: `{"gone_total": [{"value": 7}]}`},
+		{name: "missing file"},
+		{name: "malformed", file: `{"transactions_total": `, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "metrics.json")
+			if tt.save {
+				requestBodyTooLargeTotal.Inc()
+				credits.Inc()
+				if err := saveCounters(path); err != nil {
+					t.Fatalf("saveCounters: %v", err)
+				}
+			} else if tt.file != "" {
+				if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tooLarge, creditsBefore := counterValue(t, requestBodyTooLargeTotal), counterValue(t, credits)
+			// Saved values come back on top of what was counted since, as in
+			// a new process starting from zero.
+			wantTooLarge, wantCredits := tt.wantTooLarge, tt.wantCredits
+			if tt.save {
+				wantTooLarge, wantCredits = tooLarge, creditsBefore
+			}
+
+			err := restoreCounters(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("restoreCounters: %v, want error %v", err, tt.wantErr)
+			}
+			if got := counterValue(t, requestBodyTooLargeTotal) - tooLarge; got != wantTooLarge {
+				t.Errorf("request_body_too_large_total went up by %v, want %v", got, wantTooLarge)
+			}
+			if got := counterValue(t, credits) - creditsBefore; got != wantCredits {
+				t.Errorf("transactions_total{type=c} went up by %v, want %v", got, wantCredits)
+			}
+		})
+	}
+}
+
+func TestPersistMetricsRestart(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.ListenAddr = "unix:" + filepath.Join(t.TempDir(), "api.sock")
+	cfg.Metrics.Persist = true
+	cfg.Metrics.PersistFile = filepath.Join(t.TempDir(), "metrics.json")
+	credits := transactionTotal.WithLabelValues("c")
+
+	// run starts a server on the persisted file, returning the value of the
+	// credits counter once it's listening and a func stopping it.
+	run := func() (float64, func()) {
+		s := newTestServer(t, cfg, newFakeStore())
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- s.Run(ctx) }()
+		for range 100 {
+			if _, err := os.Stat(cfg.Server.ListenAddr[len("unix:"):]); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		started := counterValue(t, credits)
+		for range 3 {
+			do(s, "POST", "/clientes/1/transacoes", `{"valor": 1, "type": "c", "descricao": "x"}`)
+		}
+		return started, func() {
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+		}
+	}
+
+	before := counterValue(t, credits)
+	started, stop := run()
+	if started != before {
+		t.Errorf("credits went from %v to %v restoring a missing file", before, started)
+	}
+	stop()
+	saved := counterValue(t, credits)
+	if _, err := os.Stat(cfg.Metrics.PersistFile); err != nil {
+		t.Fatalf("no snapshot after shutdown: %v", err)
+	}
+
+	// A new process would start from the saved value; this one adds it
+	// to what it already counted.
+	started, stop = run()
+	defer stop()
+	if got := started - saved; got != saved {
+		t.Errorf("restart restored %v credits, want %v", got, saved)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// poolCollector exposes the stats of a pgxpool.Pool, read when /metrics is
+// scraped so they are always current.
+type poolCollector struct {
+	pool *pgxpool.Pool
+
+	acquiredConns        *prometheus.Desc
+	idleConns            *prometheus.Desc
+	totalConns           *prometheus.Desc
+	maxConns             *prometheus.Desc
+	acquireCount         *prometheus.Desc
+	emptyAcquireCount    *prometheus.Desc
+	canceledAcquireCount *prometheus.Desc
+	acquireDuration      *prometheus.Desc
+}
+
+// newPoolCollector returns a collector for pool, its metrics labeled with
+// name to tell the primary and replica pools apart.
+func newPoolCollector(pool *pgxpool.Pool, name string) *poolCollector {
+	labels := prometheus.Labels{"pool": name}
+	return &poolCollector{
+		pool:                 pool,
+		acquiredConns:        prometheus.NewDesc("db_pool_acquired_conns", "Number of connections currently in use", nil, labels),
+		idleConns:            prometheus.NewDesc("db_pool_idle_conns", "Number of idle connections", nil, labels),
+		totalConns:           prometheus.NewDesc("db_pool_total_conns", "Number of connections, acquired, idle or being established", nil, labels),
+		maxConns:             prometheus.NewDesc("db_pool_max_conns", "Maximum number of connections", nil, labels),
+		acquireCount:         prometheus.NewDesc("db_pool_acquires_total", "Total number of successful acquires", nil, labels),
+		emptyAcquireCount:    prometheus.NewDesc("db_pool_empty_acquires_total", "Total number of acquires that waited for a connection", nil, labels),
+		canceledAcquireCount: prometheus.NewDesc("db_pool_canceled_acquires_total", "Total number of acquires canceled by their context", nil, labels),
+		acquireDuration:      prometheus.NewDesc("db_pool_acquire_duration_seconds_total", "Total time spent acquiring connections", nil, labels),
+	}
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.acquiredConns
+	ch <- c.idleConns
+	ch <- c.totalConns
+	ch <- c.maxConns
+	ch <- c.acquireCount
+	ch <- c.emptyAcquireCount
+	ch <- c.canceledAcquireCount
+	ch <- c.acquireDuration
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := c.pool.Stat()
+	ch <- prometheus.MustNewConstMetric(c.acquiredConns, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(stat.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(c.maxConns, prometheus.GaugeValue, float64(stat.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(c.acquireCount, prometheus.CounterValue, float64(stat.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.emptyAcquireCount, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.canceledAcquireCount, prometheus.CounterValue, float64(stat.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.acquireDuration, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+}
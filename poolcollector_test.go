@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestPoolCollector(t *testing.T) {
+	// Nothing listens on port 1; the pool is only used for its stats.
+	pool, err := pgxpool.New(context.Background(), "postgres://rinha@127.0.0.1:1/rinha?pool_max_conns=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	s := newTestServer(t, testConfig(), newFakeStore())
+	if err := s.reg.Register(newPoolCollector(pool, "primary")); err != nil {
+		t.Fatal(err)
+	}
+	scrape := func() string {
+		t.Helper()
+		return do(s, "GET", "/metrics", "").Body.String()
+	}
+
+	tests := []struct {
+		name string
+		act  func()
+		want []string
+	}{
+		{"idle pool", func() {}, []string{
+			`db_pool_max_conns{pool="primary"} 3`,
+			`db_pool_acquired_conns{pool="primary"} 0`,
+			`db_pool_canceled_acquires_total{pool="primary"} 0`,
+		}},
+		{"canceled acquire", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			pool.Acquire(ctx)
+		}, []string{`db_pool_canceled_acquires_total{pool="primary"} 1`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.act()
+			// Scraped right away: nothing updates the values in between.
+			body := scrape()
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("/metrics doesn't have %s", want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// problem is an RFC 7807 problem details object.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Code is the "erro" of the default body, when the error has one.
+	Code string `json:"erro,omitempty"`
+}
+
+// wantsProblem reports whether the client asked for application/problem+json.
+func wantsProblem(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/problem+json")
+}
+
+// writeError writes an error response. By default the body is `{}`, or
+// {"erro": code} when code is set; clients accepting application/problem+json
+// get a problem with detail instead.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	if wantsProblem(r) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(problem{
+			Type:   "about:blank",
+			Title:  http.StatusText(status),
+			Status: status,
+			Detail: detail,
+			Code:   code,
+		})
+		return
+	}
+
+	w.WriteHeader(status)
+	if code == "" {
+		w.Write([]byte(`{}`))
+	} else {
+		w.Write([]byte(`{"erro": "` + code + `"}`))
+	}
+}
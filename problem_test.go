@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestProblemJSON(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		target, body string
+		wantStatus   int
+		wantDetail   string
+		wantCode     string
+		wantDefault  string
+	}{
+		{"debit over limit", "POST", "/clientes/1/transacoes", `{"valor": 1000000, "tipo": "d", "descricao": "x"}`,
+			http.StatusUnprocessableEntity, "debit would exceed the limit", "", `{}`},
+		{"invalid tipo", "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "x", "descricao": "x"}`,
+			http.StatusUnprocessableEntity, "", "", `{}`},
+		{"transaction for unknown customer", "POST", "/clientes/6/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`,
+			http.StatusNotFound, "customer not found", "", `{}`},
+		{"statement for unknown customer", "GET", "/clientes/6/extrato", "",
+			http.StatusNotFound, "customer not found", "", `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, testConfig(), newFakeStore())
+
+			w := do(s, tt.method, tt.target, tt.body, "Accept", "application/problem+json")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+				t.Errorf("Content-Type = %q, want application/problem+json", ct)
+			}
+			var p map[string]any
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatalf("body %q: %v", w.Body, err)
+			}
+			if p["type"] != "about:blank" {
+				t.Errorf("type = %v, want about:blank", p["type"])
+			}
+			if p["title"] != http.StatusText(tt.wantStatus) {
+				t.Errorf("title = %v, want %q", p["title"], http.StatusText(tt.wantStatus))
+			}
+			if p["status"] != float64(tt.wantStatus) {
+				t.Errorf("status field = %v, want %d", p["status"], tt.wantStatus)
+			}
+			if detail, _ := p["detail"].(string); detail == "" || tt.wantDetail != "" && detail != tt.wantDetail {
+				t.Errorf("detail = %q, want %q", detail, tt.wantDetail)
+			}
+
+			// Without the Accept header the body stays terse.
+			w = do(s, tt.method, tt.target, tt.body)
+			if w.Code != tt.wantStatus || w.Body.String() != tt.wantDefault {
+				t.Errorf("default response = %d %s, want %d %s", w.Code, w.Body, tt.wantStatus, tt.wantDefault)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+var errReadsBusy = errors.New("too many concurrent statement reads")
+
+// readLimitStore caps the statement, summary and export reads in flight,
+// failing the ones past the cap with errReadsBusy right away, so slow reads
+// can't take every pool connection and leave transactions waiting.
+type readLimitStore struct {
+	Store
+	sem chan struct{}
+}
+
+func newReadLimitStore(store Store, max int) *readLimitStore {
+	return &readLimitStore{Store: store, sem: make(chan struct{}, max)}
+}
+
+func (s *readLimitStore) Statement(ctx context.Context, customerID int, opts StatementOptions) (Statement, error) {
+	if !s.acquire() {
+		return Statement{}, errReadsBusy
+	}
+	defer s.release()
+	return s.Store.Statement(ctx, customerID, opts)
+}
+
+func (s *readLimitStore) Summary(ctx context.Context, customerID int) (Summary, error) {
+	if !s.acquire() {
+		return Summary{}, errReadsBusy
+	}
+	defer s.release()
+	return s.Store.Summary(ctx, customerID)
+}
+
+func (s *readLimitStore) ExportTransactions(ctx context.Context, customerID int, fn func(Transaction) error) error {
+	if !s.acquire() {
+		return errReadsBusy
+	}
+	defer s.release()
+	return s.Store.ExportTransactions(ctx, customerID, fn)
+}
+
+func (s *readLimitStore) acquire() bool {
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *readLimitStore) release() {
+	<-s.sem
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowReadStore holds statements until release is closed, signaling on
+// started as each one begins.
+type slowReadStore struct {
+	Store
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowReadStore) Statement(ctx context.Context, customerID int, opts StatementOptions) (Statement, error) {
+	s.started <- struct{}{}
+	<-s.release
+	return s.Store.Statement(ctx, customerID, opts)
+}
+
+func TestReadLimit(t *testing.T) {
+	const max = 2
+	store := &slowReadStore{Store: newFakeStore(), started: make(chan struct{}, max), release: make(chan struct{})}
+	cfg := testConfig()
+	cfg.DB.MaxConcurrentReads = max
+	// The cap counts transactions with a read of its own, which must not
+	// be held back by the statement reads.
+	cfg.Transactions.MaxPerCustomer = 100
+	s := newTestServer(t, cfg, store)
+
+	var wg sync.WaitGroup
+	for i := range max {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			target := "/clientes/" + strconv.Itoa(i+1) + "/extrato"
+			if w := do(s, "GET", target, ""); w.Code != http.StatusOK {
+				t.Errorf("held statement: status = %d", w.Code)
+			}
+		}()
+	}
+	for range max {
+		<-store.started
+	}
+
+	tests := []struct {
+		method, target, body string
+		wantStatus           int
+	}{
+		{"GET", "/clientes/3/extrato", "", http.StatusServiceUnavailable},
+		{"GET", "/clientes/3/extrato?summary=true", "", http.StatusServiceUnavailable},
+		{"GET", "/clientes/3/export", "", http.StatusServiceUnavailable},
+		{"POST", "/clientes/3/transacoes", `{"valor": 10, "tipo": "c", "descricao": "x"}`, http.StatusOK},
+		{"POST", "/clientes/3/transacoes", `{"valor": 5, "tipo": "d", "descricao": "x"}`, http.StatusOK},
+		{"POST", "/clientes/1/transacoes", `{"valor": 5, "tipo": "d", "descricao": "x"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			start := time.Now()
+			w := do(s, tt.method, tt.target, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+				t.Error("503 without Retry-After")
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("answered after %s while reads are saturated", elapsed)
+			}
+		})
+	}
+
+	close(store.release)
+	wg.Wait()
+	if w := do(s, "GET", "/clientes/3/extrato", ""); w.Code != http.StatusOK {
+		t.Errorf("statement after the reads finished: status = %d, want 200", w.Code)
+	}
+}
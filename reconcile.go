@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// drift is a customer whose balance isn't the signed sum of its
+// transactions.
+type drift struct {
+	CustomerID int
+	Balance    int
+	Sum        int
+}
+
+// driftFinder finds the customers whose balance drifted, which pgStore does
+// with a single query.
+type driftFinder interface {
+	findDrift(ctx context.Context) ([]drift, error)
+}
+
+// findDrift returns the customers whose balance differs from the sum of their
+// credits minus their debits. A reset that keeps the transactions shows up
+// here too.
+func (s *pgStore) findDrift(ctx context.Context) ([]drift, error) {
+	conn, err := s.acquire(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `
+		SELECT c.id, c.balance, COALESCE(SUM(CASE t.type WHEN 'c' THEN t.amount ELSE -t.amount END), 0) AS sum
+		FROM customers c
+		LEFT JOIN transactions t ON t.customer_id = c.id
+		GROUP BY c.id
+		HAVING c.balance <> COALESCE(SUM(CASE t.type WHEN 'c' THEN t.amount ELSE -t.amount END), 0)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var drifts []drift
+	for rows.Next() {
+		var d drift
+		rows.Scan(&d.CustomerID, &d.Balance, &d.Sum)
+		drifts = append(drifts, d)
+	}
+	return drifts, rows.Err()
+}
+
+// reconcile checks every interval, until ctx is done, that balances match
+// their transactions, logging each customer that doesn't and setting
+// balanceDriftCustomers. Each run scans the whole transactions table, so
+// the interval should be minutes rather than seconds.
+func (s *Server) reconcile(ctx context.Context, finder driftFinder, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		drifts, err := finder.findDrift(ctx)
+		if err != nil {
+			s.Logger.Error("reconciling balances", "err", err)
+			continue
+		}
+		balanceDriftCustomers.Set(float64(len(drifts)))
+		for _, d := range drifts {
+			s.Logger.Error("balance differs from the sum of transactions", "customer", d.CustomerID, "balance", d.Balance, "sum", d.Sum)
+		}
+	}
+}
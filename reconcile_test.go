@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// driftResults is a driftFinder answering each call with the next of its
+// results, then with the last one.
+type driftResults struct {
+	mu      sync.Mutex
+	results []driftResult
+	calls   int
+}
+
+type driftResult struct {
+	drifts []drift
+	err    error
+}
+
+func (f *driftResults) findDrift(ctx context.Context) ([]drift, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := f.results[min(f.calls, len(f.results)-1)]
+	f.calls++
+	return r.drifts, r.err
+}
+
+// syncBuffer is a bytes.Buffer safe to log to from another goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestReconcile(t *testing.T) {
+	drifted := []drift{{CustomerID: 1, Balance: 500, Sum: 400}, {CustomerID: 3, Balance: -10, Sum: 0}}
+	tests := []struct {
+		name      string
+		results   []driftResult
+		wantDrift float64
+		wantLogs  []string
+	}{
+		{"no drift", []driftResult{{}}, 0, nil},
+		{"drift", []driftResult{{drifts: drifted}}, 2,
+			[]string{`msg="balance differs from the sum of transactions" customer=1 balance=500 sum=400`, "customer=3 balance=-10 sum=0"}},
+		{"drift fixed", []driftResult{{drifts: drifted}, {}}, 0, nil},
+		// A failed check leaves the last count in place.
+		{"query failing", []driftResult{{drifts: drifted}, {err: errors.New("connection reset")}}, 2,
+			[]string{`msg="reconciling balances" err="connection reset"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs syncBuffer
+			s := newTestServer(t, testConfig(), newFakeStore())
+			s.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+			finder := &driftResults{results: tt.results}
+			balanceDriftCustomers.Set(0)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				s.reconcile(ctx, finder, time.Millisecond)
+				close(done)
+			}()
+			deadline := time.Now().Add(2 * time.Second)
+			for {
+				finder.mu.Lock()
+				calls := finder.calls
+				finder.mu.Unlock()
+				if calls >= len(tt.results)+1 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("reconcile ran %d checks, want %d", calls, len(tt.results)+1)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("reconcile didn't stop when ctx was done")
+			}
+
+			if got := counterValue(t, balanceDriftCustomers); got != tt.wantDrift {
+				t.Errorf("balance_drift_customers = %v, want %v", got, tt.wantDrift)
+			}
+			for _, want := range tt.wantLogs {
+				if !strings.Contains(logs.String(), want) {
+					t.Errorf("log %q doesn't contain %q", logs.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestPgStoreFindDrift(t *testing.T) {
+	store := testPgStore(t)
+	ctx := context.Background()
+	id, err := store.CreateCustomer(ctx, 1000, "BRL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	customerID := int(id)
+	if _, err := store.Credit(ctx, customerID, 300, "x"); err != nil {
+		t.Fatal(err)
+	}
+	has := func() bool {
+		drifts, err := store.findDrift(ctx)
+		if err != nil {
+			t.Fatalf("findDrift: %v", err)
+		}
+		for _, d := range drifts {
+			if d.CustomerID == customerID {
+				return true
+			}
+		}
+		return false
+	}
+	if has() {
+		t.Fatal("drift reported for a consistent customer")
+	}
+
+	// Resetting without clearing the transactions drifts the balance.
+	if _, err := store.ResetCustomer(ctx, customerID, false); err != nil {
+		t.Fatal(err)
+	}
+	if !has() {
+		t.Error("no drift reported for a balance reset under its transactions")
+	}
+}
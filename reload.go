@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// reloadableSettings are the config keys, as section.field in the config
+// file, that reload applies to the running service. Changes to any other
+// need a restart, e.g. pool sizes, which only take effect on a new pool.
+var reloadableSettings = map[string]bool{
+	"server.timezone":                true,
+	"server.log_level":               true,
+	"server.statement_query_timeout": true,
+	"transactions.retry_budget":      true,
+}
+
+type reloadResult struct {
+	// Applied lists the reloadable settings that changed.
+	Applied []string `json:"applied"`
+	// RestartRequired lists the settings that changed but can't be applied
+	// to the running service.
+	RestartRequired []string `json:"restart_required"`
+}
+
+// reload loads the config again and applies what changed among the
+// reloadableSettings. Either every change is applied or, if the config or
+// the timezone doesn't load, none.
+//
+// Only CONFIG_FILE can bring changes: the environment of a running process
+// doesn't change, and it still overrides the file, so a setting set from
+// the environment keeps its value until a restart.
+func (s *Server) reload() (reloadResult, error) {
+	res := reloadResult{Applied: []string{}, RestartRequired: []string{}}
+	cfg, err := LoadConfig()
+	if err != nil {
+		return res, err
+	}
+	loc, err := time.LoadLocation(cfg.Server.Timezone)
+	if err != nil {
+		return res, err
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	old, changed := configSettings(s.current), configSettings(cfg)
+	for key, v := range changed {
+		if reflect.DeepEqual(old[key], v) {
+			continue
+		}
+		if reloadableSettings[key] {
+			res.Applied = append(res.Applied, key)
+		} else {
+			res.RestartRequired = append(res.RestartRequired, key)
+		}
+	}
+	slices.Sort(res.Applied)
+	slices.Sort(res.RestartRequired)
+
+	s.location.Store(loc)
+	s.logLevel.Set(logLevel(cfg))
+	s.statementQueryTimeout.Store(int64(cfg.Server.StatementQueryTimeout.Duration))
+	if s.retryBudget != nil {
+		s.retryBudget.setRate(cfg.Transactions.RetryBudget)
+	}
+	// Later reloads report what changed since this one, not since startup.
+	s.current = cfg
+	return res, nil
+}
+
+// configSettings flattens cfg into its settings keyed as section.field.
+func configSettings(cfg Config) map[string]any {
+	b, _ := json.Marshal(cfg)
+	var sections map[string]map[string]any
+	json.Unmarshal(b, &sections)
+	settings := make(map[string]any)
+	for section, fields := range sections {
+		for field, v := range fields {
+			settings[section+"."+field] = v
+		}
+	}
+	return settings
+}
+
+// reloadOnHUP reloads the config on every SIGHUP until ctx is done. Requests
+// already running keep the settings they read.
+func (s *Server) reloadOnHUP(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			}
+			res, err := s.reload()
+			if err != nil {
+				s.Logger.Error("reloading config, keeping the current one", "err", err)
+				continue
+			}
+			s.Logger.Info("config reloaded", "applied", res.Applied, "restart_required", res.RestartRequired)
+		}
+	}()
+}
+
+// handleReload reloads the config like SIGHUP does, answering with the
+// settings applied and those needing a restart. A config that fails to load
+// is answered with 422 and leaves the current one in place.
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	res, err := s.reload()
+	if err != nil {
+		s.Logger.Error("reloading config, keeping the current one", "err", err)
+		writeError(w, r, http.StatusUnprocessableEntity, "", "config failed to load")
+		return
+	}
+	s.Logger.Info("config reloaded", "applied", res.Applied, "restart_required", res.RestartRequired)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// logLevel is the level cfg asks for, debug when tracing queries as the
+// tracer logs at that level.
+func logLevel(cfg Config) slog.Level {
+	if cfg.DB.Trace {
+		return slog.LevelDebug
+	}
+	var level slog.Level
+	level.UnmarshalText([]byte(cfg.Server.LogLevel))
+	return level
+}
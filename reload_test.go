@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// timezoneConfig is a config file setting timezone.
+func timezoneConfig(timezone string) string {
+	return `{"server": {"timezone": "` + timezone + `"}, "transactions": {"audit_log": "off"}}`
+}
+
+// newReloadServer builds a server from the config file content, returning
+// it along with the path of the file to change.
+func newReloadServer(t *testing.T, content string) (*Server, string) {
+	t.Helper()
+	t.Setenv("TIMEZONE", "")
+	writeConfigFile(t, content)
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestServer(t, cfg, newFakeStore()), os.Getenv("CONFIG_FILE")
+}
+
+// hup sends SIGHUP to the test process, waiting until location is want or
+// giving up after wait.
+func hup(t *testing.T, s *Server, want string, wait time.Duration) string {
+	t.Helper()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(wait)
+	for s.location.Load().String() != want && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return s.location.Load().String()
+}
+
+func TestReloadTimezoneOnHUP(t *testing.T) {
+	s, path := newReloadServer(t, timezoneConfig("America/Sao_Paulo"))
+	seed(t, s, `{"valor": 1000, "tipo": "c", "descricao": "x"}`)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.reloadOnHUP(ctx)
+
+	tests := []struct {
+		timezone   string
+		wantSuffix string
+	}{
+		{"Asia/Tokyo", "+09:00"},
+		{"UTC", "Z"},
+		{"America/Sao_Paulo", "-03:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.timezone, func(t *testing.T) {
+			if err := os.WriteFile(path, []byte(timezoneConfig(tt.timezone)), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if got := hup(t, s, tt.timezone, 2*time.Second); got != tt.timezone {
+				t.Fatalf("location = %s after SIGHUP, want %s", got, tt.timezone)
+			}
+
+			st := getStatement(t, s, "/clientes/1/extrato")
+			if !strings.HasSuffix(st.Balance.Date, tt.wantSuffix) {
+				t.Errorf("data_extrato = %s, want it in %s", st.Balance.Date, tt.timezone)
+			}
+			if len(st.Transactions) != 1 || !strings.HasSuffix(st.Transactions[0].Date, tt.wantSuffix) {
+				t.Errorf("ultimas_transacoes = %+v, want realizada_em in %s", st.Transactions, tt.timezone)
+			}
+		})
+	}
+}
+
+func TestReloadOnHUPStops(t *testing.T) {
+	// Keeps SIGHUP from terminating the test process once the server
+	// stopped listening for it.
+	guard := make(chan os.Signal, 1)
+	signal.Notify(guard, syscall.SIGHUP)
+	defer signal.Stop(guard)
+
+	s, path := newReloadServer(t, timezoneConfig("America/Sao_Paulo"))
+	ctx, cancel := context.WithCancel(context.Background())
+	s.reloadOnHUP(ctx)
+	cancel()
+	// Let the goroutine see ctx done before the signal is sent.
+	time.Sleep(50 * time.Millisecond)
+
+	if err := os.WriteFile(path, []byte(timezoneConfig("Asia/Tokyo")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := hup(t, s, "Asia/Tokyo", 200*time.Millisecond); got != "America/Sao_Paulo" {
+		t.Errorf("location = %s after SIGHUP once stopped, want it unchanged", got)
+	}
+	select {
+	case <-guard:
+	case <-time.After(time.Second):
+		t.Error("SIGHUP not delivered")
+	}
+}
+
+func TestReloadEnvOverride(t *testing.T) {
+	writeConfigFile(t, timezoneConfig("Asia/Tokyo"))
+	path := os.Getenv("CONFIG_FILE")
+	t.Setenv("TIMEZONE", "UTC")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, cfg, newFakeStore())
+
+	if err := os.WriteFile(path, []byte(timezoneConfig("America/Sao_Paulo")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.location.Load().String(); got != "UTC" {
+		t.Errorf("location = %s, want the environment to still win over the file", got)
+	}
+}
+
+func TestReloadUnknownTimezone(t *testing.T) {
+	s, path := newReloadServer(t, timezoneConfig("Asia/Tokyo"))
+	if err := os.WriteFile(path, []byte(timezoneConfig("Not/A_Zone")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.reload(); err == nil {
+		t.Fatal("reload succeeded with an unknown timezone")
+	}
+	if got := s.location.Load().String(); got != "Asia/Tokyo" {
+		t.Errorf("location = %s after a failed reload, want Asia/Tokyo", got)
+	}
+	if st := getStatement(t, s, "/clientes/1/extrato"); !strings.HasSuffix(st.Balance.Date, "+09:00") {
+		t.Errorf("data_extrato = %s, want it in Asia/Tokyo", st.Balance.Date)
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	const base = `{"server": {"api_key": "admin"}, "transactions": {"audit_log": "off"}}`
+	tests := []struct {
+		name                string
+		file                string
+		key                 string
+		wantStatus          int
+		wantApplied         []string
+		wantRestartRequired []string
+		check               func(*Server) bool
+	}{
+		{"nothing changed", base, "admin", http.StatusOK, []string{}, []string{}, nil},
+		{"log level", `{"server": {"api_key": "admin", "log_level": "debug"}, "transactions": {"audit_log": "off"}}`, "admin", http.StatusOK,
+			[]string{"server.log_level"}, []string{},
+			func(s *Server) bool { return s.logLevel.Level() == slog.LevelDebug }},
+		{"statement query timeout", `{"server": {"api_key": "admin", "statement_query_timeout": "750ms"}, "transactions": {"audit_log": "off"}}`, "admin", http.StatusOK,
+			[]string{"server.statement_query_timeout"}, []string{},
+			func(s *Server) bool { return time.Duration(s.statementQueryTimeout.Load()) == 750*time.Millisecond }},
+		{"pool size", `{"server": {"api_key": "admin"}, "db": {"max_conns": 80}, "transactions": {"audit_log": "off"}}`, "admin", http.StatusOK,
+			[]string{}, []string{"db.max_conns"},
+			func(s *Server) bool { return s.cfg.DB.MaxConns != 80 }},
+		{"mixed", `{"server": {"api_key": "admin", "log_level": "warn", "timezone": "UTC"}, "db": {"min_conns": 1}, "transactions": {"audit_log": "off"}}`, "admin", http.StatusOK,
+			[]string{"server.log_level", "server.timezone"}, []string{"db.min_conns"},
+			func(s *Server) bool {
+				return s.logLevel.Level() == slog.LevelWarn && s.location.Load().String() == "UTC"
+			}},
+		{"invalid config", `{"server": {"api_key": "admin", "log_level": "debug"`, "admin", http.StatusUnprocessableEntity, nil, nil,
+			func(s *Server) bool { return s.logLevel.Level() == slog.LevelInfo }},
+		{"unknown timezone", `{"server": {"api_key": "admin", "log_level": "debug", "timezone": "Not/A_Zone"}, "transactions": {"audit_log": "off"}}`, "admin", http.StatusUnprocessableEntity, nil, nil,
+			func(s *Server) bool { return s.logLevel.Level() == slog.LevelInfo }},
+		{"wrong key", `{"server": {"api_key": "admin", "log_level": "debug"}, "transactions": {"audit_log": "off"}}`, "nope", http.StatusUnauthorized, nil, nil,
+			func(s *Server) bool { return s.logLevel.Level() == slog.LevelInfo }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeConfigFile(t, base)
+			cfg, err := LoadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := newTestServer(t, cfg, newFakeStore())
+			writeConfigFile(t, tt.file)
+
+			w := do(s, "POST", "/admin/reload", "", "X-API-Key", tt.key)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				var res reloadResult
+				if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+					t.Fatalf("decoding %q: %v", w.Body, err)
+				}
+				if !slices.Equal(res.Applied, tt.wantApplied) || !slices.Equal(res.RestartRequired, tt.wantRestartRequired) {
+					t.Errorf("reload = %+v, want applied %v and restart required %v", res, tt.wantApplied, tt.wantRestartRequired)
+				}
+			}
+			if tt.check != nil && !tt.check(s) {
+				t.Error("reload didn't leave the server as expected")
+			}
+		})
+	}
+}
+
+func TestAdminReloadWithoutKey(t *testing.T) {
+	s := newTestServer(t, testConfig(), newFakeStore())
+	if w := do(s, "POST", "/admin/reload", ""); w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want 403 without an admin key configured", w.Code)
+	}
+}
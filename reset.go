@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handleReset zeroes the balance of the customer, and with
+// ?transactions=true deletes its transactions, answering with the customer
+// as left. Unless enabled it's refused with 403, so it can't run by accident
+// against real accounts.
+func (s *Server) handleReset(store Store, enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !enabled {
+			writeError(w, r, http.StatusForbidden, "", "reset is disabled")
+			return
+		}
+
+		customerID, err := parseCustomerID(r.PathValue("id"))
+		if err != nil || customerID < 1 {
+			writeError(w, r, http.StatusNotFound, "", "customer not found")
+			return
+		}
+
+		c, err := store.ResetCustomer(r.Context(), customerID, r.URL.Query().Get("transactions") == "true")
+		if err != nil {
+			s.writeStoreError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(customerRes{ID: c.ID, Limit: c.Limit, Balance: c.Balance, Currency: c.Currency})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReset(t *testing.T) {
+	tests := []struct {
+		name             string
+		enabled          bool
+		target           string
+		wantStatus       int
+		wantTransactions int
+	}{
+		{"balance only", true, "/clientes/1/reset", http.StatusOK, 2},
+		{"with transactions", true, "/clientes/1/reset?transactions=true", http.StatusOK, 0},
+		{"disabled", false, "/clientes/1/reset?transactions=true", http.StatusForbidden, 2},
+		{"unknown customer", true, "/clientes/6/reset", http.StatusNotFound, 2},
+		{"invalid id", true, "/clientes/x/reset", http.StatusNotFound, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Server.EnableReset = tt.enabled
+			store := newFakeStore()
+			s := newTestServer(t, cfg, store)
+			seed(t, s,
+				`{"valor": 1000, "tipo": "c", "descricao": "x"}`,
+				`{"valor": 300, "tipo": "d", "descricao": "x"}`,
+			)
+
+			w := do(s, "POST", tt.target, "")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			wantBalance := 700
+			if tt.wantStatus == http.StatusOK {
+				wantBalance = 0
+				var got customerRes
+				if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+					t.Fatalf("decoding %q: %v", w.Body, err)
+				}
+				if want := (customerRes{ID: 1, Limit: 100000, Balance: 0, Currency: "BRL"}); got != want {
+					t.Errorf("reset answered %+v, want %+v", got, want)
+				}
+			}
+			st := getStatement(t, s, "/clientes/1/extrato")
+			if st.Balance.Total.String() != strconv.Itoa(wantBalance) {
+				t.Errorf("saldo = %s, want %d", st.Balance.Total, wantBalance)
+			}
+			if len(st.Transactions) != tt.wantTransactions {
+				t.Errorf("%d transactions left, want %d", len(st.Transactions), tt.wantTransactions)
+			}
+		})
+	}
+}
+
+func TestResetInvalidatesCache(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.EnableReset = true
+	cfg.Server.StatementCacheTTL = Duration{time.Minute}
+	s := newTestServer(t, cfg, newFakeStore())
+	seed(t, s, `{"valor": 1000, "tipo": "c", "descricao": "x"}`)
+	if got := getStatement(t, s, "/clientes/1/extrato").Balance.Total.String(); got != "1000" {
+		t.Fatalf("saldo = %s, want 1000", got)
+	}
+
+	if w := do(s, "POST", "/clientes/1/reset?transactions=true", ""); w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	st := getStatement(t, s, "/clientes/1/extrato")
+	if st.Balance.Total.String() != "0" || len(st.Transactions) != 0 {
+		t.Errorf("statement after the reset = %+v, want it empty", st)
+	}
+}
+
+func TestPgStoreResetCustomer(t *testing.T) {
+	store := testPgStore(t)
+	ctx := context.Background()
+	id, err := store.CreateCustomer(ctx, 1000, "BRL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	customerID := int(id)
+	for _, clearTransactions := range []bool{false, true} {
+		if _, err := store.Credit(ctx, customerID, 500, "x"); err != nil {
+			t.Fatal(err)
+		}
+		c, err := store.ResetCustomer(ctx, customerID, clearTransactions)
+		if err != nil {
+			t.Fatalf("ResetCustomer: %v", err)
+		}
+		if c.Balance != 0 || c.Limit != 1000 {
+			t.Errorf("reset to %+v, want a zero balance and the limit kept", c)
+		}
+		n, err := store.TransactionCount(ctx, customerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if clearTransactions && n != 0 || !clearTransactions && n == 0 {
+			t.Errorf("clearing transactions %v left %d", clearTransactions, n)
+		}
+	}
+}
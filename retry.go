@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var errRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// retryBudget is a token bucket shared by every request, refilled at rate
+// tokens per second up to a second's worth. Each retry takes a token, so
+// however many requests fail at once, a failure storm adds at most rate
+// queries per second to the load on the database.
+type retryBudget struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRetryBudget(rate float64) *retryBudget {
+	burst := max(rate, 1)
+	return &retryBudget{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// setRate changes the refill rate, and the burst along with it.
+func (b *retryBudget) setRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = rate
+	b.burst = max(rate, 1)
+	b.tokens = min(b.tokens, b.burst)
+}
+
+// take reports whether a retry may run, consuming a token if so.
+func (b *retryBudget) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// retryStore runs credits and debits again, up to max times, when they fail
+// with a serialization failure or a deadlock, both of which leave nothing
+// applied. Retries are drawn from budget; once it runs out the operation
+// fails with errRetryBudgetExhausted, which is answered with 503.
+type retryStore struct {
+	Store
+	max    int
+	budget *retryBudget
+}
+
+func (s *retryStore) Credit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	return s.retry(ctx, func() (TransactionResult, error) {
+		return s.Store.Credit(ctx, customerID, value, desc)
+	})
+}
+
+func (s *retryStore) Debit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	return s.retry(ctx, func() (TransactionResult, error) {
+		return s.Store.Debit(ctx, customerID, value, desc)
+	})
+}
+
+func (s *retryStore) ApplyIfBalance(ctx context.Context, customerID, value int, typ, desc string, expected int) (TransactionResult, error) {
+	return s.retry(ctx, func() (TransactionResult, error) {
+		return s.Store.ApplyIfBalance(ctx, customerID, value, typ, desc, expected)
+	})
+}
+
+func (s *retryStore) retry(ctx context.Context, fn func() (TransactionResult, error)) (TransactionResult, error) {
+	res, err := fn()
+	for i := 0; i < s.max && isRetryable(err) && ctx.Err() == nil; i++ {
+		if !s.budget.take() {
+			return res, fmt.Errorf("%w: %w", errRetryBudgetExhausted, err)
+		}
+		res, err = fn()
+	}
+	return res, err
+}
+
+// isRetryable reports whether err is a serialization failure or a deadlock.
+func isRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == "40001" || pgErr.Code == "40P01"
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// flakyStore fails the first failures credits with err.
+type flakyStore struct {
+	Store
+	err      error
+	failures int
+	calls    atomic.Int64
+}
+
+func (s *flakyStore) Credit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	if n := s.calls.Add(1); s.failures < 0 || n <= int64(s.failures) {
+		return TransactionResult{}, s.err
+	}
+	return s.Store.Credit(ctx, customerID, value, desc)
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		failures   int // -1 fails every call
+		maxRetries int
+		wantStatus int
+		wantCalls  int64
+	}{
+		{"serialization failure once", &pgconn.PgError{Code: "40001"}, 1, 3, http.StatusOK, 2},
+		{"deadlock twice", &pgconn.PgError{Code: "40P01"}, 2, 3, http.StatusOK, 3},
+		{"serialization failure throughout", &pgconn.PgError{Code: "40001"}, -1, 3, http.StatusServiceUnavailable, 4},
+		{"not retryable", &pgconn.PgError{Code: "42601"}, 1, 3, http.StatusInternalServerError, 1},
+		{"retries off", &pgconn.PgError{Code: "40001"}, 1, 0, http.StatusServiceUnavailable, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Transactions.MaxRetries = tt.maxRetries
+			cfg.Transactions.RetryBudget = 100
+			store := &flakyStore{Store: newFakeStore(), err: tt.err, failures: tt.failures}
+			s := newTestServer(t, cfg, store)
+
+			w := do(s, "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := store.calls.Load(); got != tt.wantCalls {
+				t.Errorf("credit called %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     float64
+		requests int
+	}{
+		{"small", 5, 50},
+		{"large", 50, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const maxRetries = 3
+			cfg := testConfig()
+			cfg.Transactions.MaxRetries = maxRetries
+			cfg.Transactions.RetryBudget = tt.rate
+			store := &flakyStore{Store: newFakeStore(), err: &pgconn.PgError{Code: "40001"}, failures: -1}
+			s := newTestServer(t, cfg, store)
+
+			start := time.Now()
+			var wg sync.WaitGroup
+			var unavailable atomic.Int64
+			for range tt.requests {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					w := do(s, "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`)
+					if w.Code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") != "" {
+						unavailable.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+			elapsed := time.Since(start)
+
+			retries := float64(store.calls.Load()) - float64(tt.requests)
+			// The bucket starts full with a second's worth and refills at
+			// rate while the requests run.
+			budget := max(tt.rate, 1) + tt.rate*elapsed.Seconds()
+			if retries > budget {
+				t.Errorf("%v retries in %s, over the budget of %.1f", retries, elapsed, budget)
+			}
+			if retries >= float64(tt.requests*maxRetries) {
+				t.Errorf("%v retries: every request retried in full", retries)
+			}
+			if got := unavailable.Load(); got != int64(tt.requests) {
+				t.Errorf("%d requests shed with 503 and Retry-After, want %d", got, tt.requests)
+			}
+		})
+	}
+}
+
+func TestRetryBudgetTake(t *testing.T) {
+	tests := []struct {
+		name      string
+		rate      float64
+		wantBurst int
+	}{
+		{"rate of 4", 4, 4},
+		{"rate below 1", 0.5, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newRetryBudget(tt.rate)
+			for i := range tt.wantBurst {
+				if !b.take() {
+					t.Fatalf("take %d failed within the burst of %d", i, tt.wantBurst)
+				}
+			}
+			if b.take() {
+				t.Fatal("take succeeded past the burst")
+			}
+			// Move the last refill back by the time a token takes.
+			b.last = b.last.Add(-time.Duration(float64(time.Second) / tt.rate))
+			if !b.take() {
+				t.Error("take failed after a token's worth of refill")
+			}
+		})
+	}
+}
+
+func TestRetryBudgetSetRate(t *testing.T) {
+	b := newRetryBudget(10)
+	b.setRate(2)
+	taken := 0
+	for b.take() {
+		taken++
+	}
+	if taken != 2 {
+		t.Errorf("took %d tokens after lowering the rate to 2, want 2", taken)
+	}
+}
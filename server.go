@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/netutil"
+)
+
+// Server is the whole service: its config, the DB pool, the stores built on
+// top of it and the metrics registry. NewServer sets up everything but the
+// database, which Run connects to before serving. Built WithStore, the
+// Server needs no database at all and Routes can be served on its own, e.g.
+// with httptest.
+type Server struct {
+	// Logger receives everything the service logs. NewServer sets it to a
+	// text logger on stdout unless built WithLogger.
+	Logger *slog.Logger
+
+	cfg Config
+	db  *pgxpool.Pool
+	reg *prometheus.Registry
+
+	// store serves reads and customer management, txStore transactions, with
+	// the decorators that only apply to them.
+	store   Store
+	txStore Store
+	cache   *statementCache
+	// audit records the transaction attempts, nil when the audit log is
+	// off.
+	audit *AuditLogger
+	// closers are closed once Run is done serving, e.g. the audit log file.
+	closers []io.Closer
+
+	// The settings below are worked out from cfg once rather than on every
+	// request.
+	descriptionLabels map[string]bool
+	allowedDescricoes map[string]bool
+	deniedDescricoes  map[string]bool
+	accessLog         *accessLogger
+
+	// validationFailures holds the last validation failures for
+	// /debug/validation.
+	validationFailures *failureRing
+
+	// reconnectingUntil is when, in Unix nanoseconds, the window after the
+	// connection to the database was lost ends.
+	reconnectingUntil atomic.Int64
+
+	// The settings below change when the config is reloaded; current is
+	// the config they were last reloaded from.
+	reloadMu              sync.Mutex
+	current               Config
+	logLevel              slog.LevelVar
+	location              atomic.Pointer[time.Location]
+	statementQueryTimeout atomic.Int64
+	retryBudget           *retryBudget
+}
+
+// Option customizes the Server built by NewServer.
+type Option func(*Server)
+
+// WithStore has the Server serve from store instead of connecting to the
+// database, e.g. a fake one in tests. The decorators enabled in the config
+// are still added on top of it.
+func WithStore(store Store) Option {
+	return func(s *Server) { s.store = store }
+}
+
+// WithRegistry registers the metrics with reg rather than with a registry
+// of the Server's own. The metrics themselves are shared by every Server, so
+// their values are too.
+func WithRegistry(reg *prometheus.Registry) Option {
+	return func(s *Server) { s.reg = reg }
+}
+
+// WithLogger has the Server log to logger. Its level is left as it is, so
+// neither the config nor reloads change it.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) { s.Logger = logger }
+}
+
+// NewServer builds the Server for cfg: it loads the timezone, registers the
+// metrics and, if built WithStore, builds the stores, so Routes is ready to
+// serve.
+func NewServer(cfg Config, opts ...Option) (*Server, error) {
+	s := &Server{cfg: cfg, current: cfg, validationFailures: &failureRing{}}
+	s.logLevel.Set(logLevel(cfg))
+	s.statementQueryTimeout.Store(int64(cfg.Server.StatementQueryTimeout.Duration))
+	s.Logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: &s.logLevel}))
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	// Without the location every date in the responses would be off.
+	loc, err := time.LoadLocation(cfg.Server.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("loading timezone %q (is tzdata installed?): %w", cfg.Server.Timezone, err)
+	}
+	s.location.Store(loc)
+
+	s.allowedDescricoes = descricaoSet(cfg.Transactions.AllowedDescricoes)
+	s.deniedDescricoes = descricaoSet(cfg.Transactions.DeniedDescricoes)
+	if len(cfg.Metrics.Descriptions) > 0 {
+		s.descriptionLabels = make(map[string]bool)
+		for _, d := range cfg.Metrics.Descriptions {
+			s.descriptionLabels[d] = true
+		}
+	}
+	if cfg.Server.AccessLog {
+		s.accessLog = newAccessLogger(os.Stdout, cfg.Server.AccessLogFormat)
+	}
+
+	if s.reg == nil {
+		s.reg = prometheus.NewRegistry()
+	}
+	if err := registerMetrics(s.reg); err != nil {
+		return nil, fmt.Errorf("registering metrics: %w", err)
+	}
+	if err := registerRuntimeCollectors(s.reg); err != nil {
+		return nil, fmt.Errorf("registering runtime collectors: %w", err)
+	}
+
+	if s.store != nil {
+		if err := s.buildStores(s.store); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// poolConfig builds the pool config from cfg, each shard of the pool getting
+// an equal part of the connections.
+func (s *Server) poolConfig() (*pgxpool.Config, error) {
+	cfg := s.cfg
+	poolConfig, err := pgxpool.ParseConfig(cfg.DB.URL)
+	if err != nil {
+		return nil, err
+	}
+	poolConfig.MaxConns = cfg.DB.MaxConns / int32(cfg.DB.Shards)
+	poolConfig.MinConns = cfg.DB.MinConns / int32(cfg.DB.Shards)
+	poolConfig.MaxConnIdleTime = 10 * time.Minute
+	poolConfig.MaxConnLifetime = 2 * time.Hour
+	poolConfig.MaxConnLifetimeJitter = cfg.DB.MaxConnLifetimeJitter.Duration
+	poolConfig.HealthCheckPeriod = cfg.DB.HealthCheckPeriod.Duration
+
+	// PgBouncer in transaction mode may hand each query to a different server
+	// connection, where statements prepared and cached on another one don't
+	// exist. QueryExecModeExec only uses the unnamed statement.
+	if cfg.DB.PgBouncerCompat {
+		poolConfig.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeExec
+		poolConfig.ConnConfig.StatementCacheCapacity = 0
+		poolConfig.ConnConfig.DescriptionCacheCapacity = 0
+	}
+
+	// Poolers such as PgBouncer in transaction mode can't handle the prepared
+	// statements used by the extended protocol.
+	if cfg.DB.PreferSimpleProtocol {
+		poolConfig.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+	}
+
+	if cfg.DB.Trace {
+		poolConfig.ConnConfig.Tracer = newQueryTracer(s.Logger)
+	}
+
+	// Both timeouts are set after connecting rather than as startup
+	// parameters, which PgBouncer refuses unless told to ignore them. Either
+	// way they last for the whole connection.
+	var settings []string
+	// Fail fast instead of queueing behind the per-customer lock of a hot
+	// account.
+	if cfg.DB.LockTimeout.Duration > 0 {
+		settings = append(settings, "SET lock_timeout = "+strconv.FormatInt(cfg.DB.LockTimeout.Milliseconds(), 10))
+	}
+	if cfg.DB.StatementTimeout.Duration > 0 {
+		settings = append(settings, "SET statement_timeout = "+strconv.FormatInt(cfg.DB.StatementTimeout.Milliseconds(), 10))
+	}
+	if len(settings) > 0 {
+		poolConfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+			for _, sql := range settings {
+				if _, err := conn.Exec(ctx, sql); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return poolConfig, nil
+}
+
+// connect connects to the database, retrying for a while as it may still be
+// starting, and builds the stores on top of it. It returns the pgStore and
+// every pool it opened, by name, for Run to drain and close.
+func (s *Server) connect(ctx context.Context) (*pgStore, map[string]*pgxpool.Pool, error) {
+	cfg := s.cfg
+	poolConfig, err := s.poolConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing DB config: %w", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		s.db, err = pgxpool.NewWithConfig(ctx, poolConfig)
+		if err == nil {
+			break
+		} else {
+			s.Logger.Warn("connecting to DB, retrying in 5 seconds", "err", err)
+			time.Sleep(5 * time.Second)
+		}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to DB: %w", err)
+	}
+	s.Logger.Info("connected to DB")
+
+	pg := &pgStore{db: s.db, strict: cfg.Transactions.StrictConsistency, orderBy: cfg.DB.StatementOrderBy}
+	pools := map[string]*pgxpool.Pool{"primary": s.db}
+	closePools := func() {
+		for _, pool := range pools {
+			pool.Close()
+		}
+	}
+	if cfg.DB.Shards > 1 {
+		pg.shards = []*pgxpool.Pool{s.db}
+		pools = map[string]*pgxpool.Pool{"primary-0": s.db}
+		for i := 1; i < cfg.DB.Shards; i++ {
+			shard, err := pgxpool.NewWithConfig(ctx, poolConfig.Copy())
+			if err != nil {
+				closePools()
+				return nil, nil, fmt.Errorf("connecting pool shard %d: %w", i, err)
+			}
+			pg.shards = append(pg.shards, shard)
+			pools["primary-"+strconv.Itoa(i)] = shard
+		}
+	}
+	if cfg.DB.ReplicaURL != "" {
+		replica, err := pgxpool.New(ctx, cfg.DB.ReplicaURL)
+		if err != nil {
+			closePools()
+			return nil, nil, fmt.Errorf("connecting to replica: %w", err)
+		}
+		pg.replica = replica
+		pools["replica"] = replica
+	}
+
+	for name, pool := range pools {
+		if err := s.reg.Register(newPoolCollector(pool, name)); err != nil {
+			closePools()
+			return nil, nil, fmt.Errorf("registering pool collector: %w", err)
+		}
+	}
+
+	if err := s.buildStores(pg); err != nil {
+		closePools()
+		return nil, nil, err
+	}
+	return pg, pools, nil
+}
+
+// buildStores adds the decorators enabled in the config on top of base,
+// setting the stores the handlers are served from.
+func (s *Server) buildStores(base Store) error {
+	cfg := s.cfg
+	store := base
+	if cfg.Chaos.Enabled {
+		s.Logger.Warn("chaos mode enabled, injecting failures into the database calls")
+		store = &chaosStore{Store: store, cfg: cfg.Chaos}
+	}
+	if cfg.DB.MaxConcurrentPerCustomer > 0 {
+		store = newCustomerLimitStore(store, cfg.DB.MaxConcurrentPerCustomer)
+	}
+	if cfg.DB.MaxConcurrentReads > 0 {
+		store = newReadLimitStore(store, cfg.DB.MaxConcurrentReads)
+	}
+	switch cfg.Transactions.AuditLog {
+	case "off":
+	case "stdout":
+		s.audit = NewAuditLogger(os.Stdout, s.now)
+	default:
+		f, err := os.OpenFile(cfg.Transactions.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return fmt.Errorf("opening audit log: %w", err)
+		}
+		s.closers = append(s.closers, f)
+		s.audit = NewAuditLogger(f, s.now)
+	}
+
+	if cfg.Server.StatementCacheTTL.Duration > 0 {
+		s.cache = newStatementCache(cfg.Server.StatementCacheTTL.Duration)
+		store = &invalidatingStore{Store: store, cache: s.cache}
+	}
+	s.store = store
+
+	txStore := store
+	if cfg.Transactions.MaxRetries > 0 {
+		s.retryBudget = newRetryBudget(cfg.Transactions.RetryBudget)
+		txStore = &retryStore{Store: txStore, max: cfg.Transactions.MaxRetries, budget: s.retryBudget}
+	}
+	if cfg.Transactions.MaxPerCustomer > 0 {
+		txStore = &transactionCapStore{Store: txStore, max: cfg.Transactions.MaxPerCustomer}
+	}
+	if cfg.Transactions.Workers > 0 {
+		workers := newWorkerPoolStore(txStore, cfg.Transactions.Workers, cfg.Transactions.QueueSize)
+		s.closers = append(s.closers, workers)
+		txStore = workers
+	}
+	if cfg.Transactions.GroupCommitWindow.Duration > 0 {
+		groupCommit := newGroupCommitStore(txStore, cfg.Transactions.GroupCommitWindow.Duration)
+		s.closers = append(s.closers, groupCommit)
+		txStore = groupCommit
+	}
+	if cfg.Transactions.DedupWindow.Duration > 0 {
+		txStore = newDedupStore(txStore, cfg.Transactions.DedupWindow.Duration)
+	}
+	// Outermost, so a credit failing anywhere below for lack of a connection,
+	// including the count read by the cap, is buffered.
+	if cfg.Transactions.CreditBuffer != "" {
+		buffer, err := newCreditBufferStore(txStore, cfg.Transactions.CreditBuffer, s.Logger, s.audit)
+		if err != nil {
+			return fmt.Errorf("opening credit buffer: %w", err)
+		}
+		s.closers = append(s.closers, buffer)
+		txStore = buffer
+	}
+	if s.audit != nil {
+		txStore = &auditStore{Store: txStore, log: s.audit}
+	}
+	s.txStore = txStore
+	return nil
+}
+
+// close closes the closers, such as the audit log file, last added first so
+// a store stops before what it writes to is closed.
+func (s *Server) close() {
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		s.closers[i].Close()
+	}
+	s.closers = nil
+}
+
+// Run connects to the DB, unless built WithStore, and serves until ctx is
+// done, then shuts the HTTP server down gracefully and drains the pool.
+func (s *Server) Run(ctx context.Context) error {
+	cfg := s.cfg
+	defer s.close()
+	s.reloadOnHUP(ctx)
+
+	var pools map[string]*pgxpool.Pool
+	if s.store == nil {
+		var pg *pgStore
+		var err error
+		pg, pools, err = s.connect(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			for _, pool := range pools {
+				pool.Close()
+			}
+		}()
+		if cfg.Transactions.ReconcileInterval.Duration > 0 {
+			go s.reconcile(ctx, pg, cfg.Transactions.ReconcileInterval.Duration)
+		}
+	}
+
+	if cfg.Metrics.Persist {
+		if err := restoreCounters(cfg.Metrics.PersistFile); err != nil {
+			return fmt.Errorf("restoring metrics: %w", err)
+		}
+	}
+
+	addr := cfg.Server.ListenAddr
+	ln, err := listen(addr)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", addr, err)
+	}
+
+	if cfg.Server.MaxConnections > 0 {
+		ln = netutil.LimitListener(ln, cfg.Server.MaxConnections)
+	}
+
+	srv := &http.Server{Handler: s.Routes(), MaxHeaderBytes: cfg.Server.MaxHeaderBytes}
+	srv.SetKeepAlivesEnabled(cfg.Server.KeepAlives)
+	shutdownDone := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout.Duration)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			s.Logger.Warn("closing connections with requests still in flight", "err", err)
+			srv.Close()
+		}
+		close(shutdownDone)
+	}()
+
+	s.Logger.Info("listening", "addr", addr)
+	if cfg.Server.TLSCertFile != "" {
+		err = srv.ServeTLS(ln, cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile)
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serving: %w", err)
+	}
+
+	// Serve returns as soon as Shutdown is called, but Shutdown itself waits
+	// for the handlers to finish.
+	<-shutdownDone
+	for _, pool := range pools {
+		s.drainPool(pool, cfg.DB.DrainTimeout.Duration)
+	}
+	if cfg.Metrics.Persist {
+		if err := saveCounters(cfg.Metrics.PersistFile); err != nil {
+			return fmt.Errorf("saving metrics: %w", err)
+		}
+	}
+	return nil
+}
+
+// Routes returns the handler serving every endpoint from the stores and the
+// registry of s, under the configured path prefix.
+func (s *Server) Routes() http.Handler {
+	cfg := s.cfg
+	mux := http.NewServeMux()
+	s.handle(mux, "GET /clientes", requireAPIKey(cfg.Server.APIKey, s.handleListCustomers(s.store)))
+	s.handle(mux, "GET /clientes/saldos", requireAPIKey(cfg.Server.APIKey, s.handleBalances(s.store)))
+	s.handle(mux, "POST /clientes", requireAPIKey(cfg.Server.APIKey, s.handleCreateCustomer(s.store, cfg.Transactions.DefaultCreditLimit)))
+	customer := func(next http.HandlerFunc) http.HandlerFunc {
+		return requireCustomerKey(cfg.Server.APIKey, cfg.Server.CustomerAPIKeys, next)
+	}
+	s.handle(mux, "POST /clientes/{id}/transacoes", customer(s.handleTransactions(s.txStore, cfg.Transactions.Created201)))
+	s.handle(mux, "POST /clientes/{id}/transacoes/stream", customer(s.handleTransactionsStream(s.txStore)))
+	s.handle(mux, "POST /clientes/{id}/reset", customer(s.handleReset(s.store, cfg.Server.EnableReset)))
+	s.handle(mux, "GET /clientes/{id}/export", customer(s.handleExport(s.store)))
+	s.handle(mux, "GET /clientes/{id}/extrato", customer(s.handleStatement(s.store, s.cache, cfg.Server.StatementMaxAge.Duration, cfg.Server.FastJSON)))
+	mux.HandleFunc("POST /admin/reload", requireAdminKey(cfg.Server.APIKey, s.handleReload))
+	mux.HandleFunc("GET /debug/validation", requireAdminKey(cfg.Server.APIKey, s.handleValidationDebug))
+	mux.HandleFunc("GET /{$}", handleRoot)
+	mux.HandleFunc("GET /health", handleHealth(s.store, cfg.DB.ReplicaURL != "", cfg.DB.MaxReplicaLag.Duration))
+	mux.HandleFunc("GET /healthz", handleHealthz(s.store, cfg.DB.ReplicaURL != "", cfg.DB.MaxReplicaLag.Duration))
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(s.reg, promhttp.HandlerFor(s.reg, promhttp.HandlerOpts{EnableOpenMetrics: cfg.Metrics.Exemplars})))
+	if cfg.Server.PathPrefix != "" {
+		return stripPathPrefix(cfg.Server.PathPrefix, mux)
+	}
+	return mux
+}
+
+// stripPathPrefix serves the requests under prefix from next with the prefix
+// removed. Unlike http.StripPrefix alone it answers 404 to paths that only
+// start with the same characters, such as /apix for /api, rather than
+// routing what's left of them.
+func stripPathPrefix(prefix string, next http.Handler) http.Handler {
+	strip := http.StripPrefix(prefix, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, prefix+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		strip.ServeHTTP(w, r)
+	})
+}
+
+// drainPool waits up to timeout for every acquired connection to go back to
+// the pool, so closing it doesn't cancel queries still in flight, e.g. from the
+// group commit worker.
+func (s *Server) drainPool(pool *pgxpool.Pool, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		active := pool.Stat().AcquiredConns()
+		if active == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			s.Logger.Warn("closing DB pool with connections still active", "active", active)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// handle registers next on mux for pattern, instrumented with the path of the
+// pattern, without its method, as the metrics label.
+func (s *Server) handle(mux *http.ServeMux, pattern string, next http.HandlerFunc) {
+	path := pattern
+	if _, p, ok := strings.Cut(pattern, " "); ok {
+		path = p
+	}
+	mux.HandleFunc(pattern, s.instrument(path, next))
+}
@@ -0,0 +1,797 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPoolConfig(t *testing.T) {
+	defaults, err := pgx.ParseConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		setup     func(*Config)
+		wantMode  pgx.QueryExecMode
+		wantCache bool
+	}{
+		{"default", func(*Config) {}, pgx.QueryExecModeCacheStatement, true},
+		{"simple protocol", func(c *Config) { c.DB.PreferSimpleProtocol = true }, pgx.QueryExecModeSimpleProtocol, true},
+		{"pgbouncer compat", func(c *Config) { c.DB.PgBouncerCompat = true }, pgx.QueryExecModeExec, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			tt.setup(&cfg)
+			s := newTestServer(t, cfg, newFakeStore())
+
+			pc, err := s.poolConfig()
+			if err != nil {
+				t.Fatalf("poolConfig: %v", err)
+			}
+			if got := pc.ConnConfig.DefaultQueryExecMode; got != tt.wantMode {
+				t.Errorf("query exec mode = %v, want %v", got, tt.wantMode)
+			}
+			wantStatements, wantDescriptions := 0, 0
+			if tt.wantCache {
+				wantStatements, wantDescriptions = defaults.StatementCacheCapacity, defaults.DescriptionCacheCapacity
+			}
+			if got := pc.ConnConfig.StatementCacheCapacity; got != wantStatements {
+				t.Errorf("statement cache capacity = %d, want %d", got, wantStatements)
+			}
+			if got := pc.ConnConfig.DescriptionCacheCapacity; got != wantDescriptions {
+				t.Errorf("description cache capacity = %d, want %d", got, wantDescriptions)
+			}
+		})
+	}
+}
+
+func TestPoolHealthCheckPeriod(t *testing.T) {
+	tests := []struct {
+		name   string
+		period time.Duration
+	}{
+		{"default", defaultConfig().DB.HealthCheckPeriod.Duration},
+		{"configured", 15 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DB.HealthCheckPeriod = Duration{tt.period}
+			s := newTestServer(t, cfg, newFakeStore())
+
+			pc, err := s.poolConfig()
+			if err != nil {
+				t.Fatalf("poolConfig: %v", err)
+			}
+			// Without idle connections to keep, the pool doesn't connect.
+			pc.MinConns = 0
+			db, err := pgxpool.NewWithConfig(context.Background(), pc)
+			if err != nil {
+				t.Fatalf("creating pool: %v", err)
+			}
+			defer db.Close()
+			if got := db.Config().HealthCheckPeriod; got != tt.period {
+				t.Errorf("health check period = %s, want %s", got, tt.period)
+			}
+		})
+	}
+}
+
+func TestPoolConnLifetimeJitter(t *testing.T) {
+	tests := []struct {
+		name   string
+		jitter time.Duration
+	}{
+		{"default", defaultConfig().DB.MaxConnLifetimeJitter.Duration},
+		{"configured", 5 * time.Minute},
+		{"off", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DB.MaxConnLifetimeJitter = Duration{tt.jitter}
+			s := newTestServer(t, cfg, newFakeStore())
+
+			pc, err := s.poolConfig()
+			if err != nil {
+				t.Fatalf("poolConfig: %v", err)
+			}
+			pc.MinConns = 0
+			db, err := pgxpool.NewWithConfig(context.Background(), pc)
+			if err != nil {
+				t.Fatalf("creating pool: %v", err)
+			}
+			defer db.Close()
+			// The pool works from its own copy, so it must have been set
+			// before creating it.
+			if got := db.Config().MaxConnLifetimeJitter; got != tt.jitter {
+				t.Errorf("max conn lifetime jitter = %s, want %s", got, tt.jitter)
+			}
+			if lifetime := db.Config().MaxConnLifetime; tt.jitter >= lifetime {
+				t.Errorf("jitter %s isn't a fraction of the %s lifetime", tt.jitter, lifetime)
+			}
+		})
+	}
+}
+
+func TestPoolConfigShards(t *testing.T) {
+	tests := []struct {
+		shards           int
+		wantMax, wantMin int32
+	}{
+		{1, 20, 4},
+		{2, 10, 2},
+		{4, 5, 1},
+		{20, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.shards), func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DB.MaxConns, cfg.DB.MinConns = 20, 4
+			cfg.DB.Shards = tt.shards
+			s := newTestServer(t, cfg, newFakeStore())
+
+			pc, err := s.poolConfig()
+			if err != nil {
+				t.Fatalf("poolConfig: %v", err)
+			}
+			if pc.MaxConns != tt.wantMax || pc.MinConns != tt.wantMin {
+				t.Errorf("each shard gets %d to %d connections, want %d to %d", pc.MinConns, pc.MaxConns, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestPoolConfigTimeouts(t *testing.T) {
+	tests := []struct {
+		name             string
+		lock, statement  time.Duration
+		wantAfterConnect bool
+	}{
+		{"none", 0, 0, false},
+		{"lock timeout", 200 * time.Millisecond, 0, true},
+		{"statement timeout", 0, time.Second, true},
+		{"both", 200 * time.Millisecond, time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DB.LockTimeout = Duration{tt.lock}
+			cfg.DB.StatementTimeout = Duration{tt.statement}
+			s := newTestServer(t, cfg, newFakeStore())
+
+			pc, err := s.poolConfig()
+			if err != nil {
+				t.Fatalf("poolConfig: %v", err)
+			}
+			// PgBouncer refuses unknown startup parameters.
+			for _, param := range []string{"lock_timeout", "statement_timeout"} {
+				if v, ok := pc.ConnConfig.RuntimeParams[param]; ok {
+					t.Errorf("%s sent as a startup parameter: %q", param, v)
+				}
+			}
+			if got := pc.AfterConnect != nil; got != tt.wantAfterConnect {
+				t.Errorf("AfterConnect set = %v, want %v", got, tt.wantAfterConnect)
+			}
+		})
+	}
+}
+
+// runServer runs a server over store on a Unix socket until the test ends,
+// returning the socket path.
+func runServer(t *testing.T, cfg Config, store Store) string {
+	t.Helper()
+	path := t.TempDir() + "/api.sock"
+	cfg.Server.ListenAddr = "unix:" + path
+	s := newTestServer(t, cfg, store)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	})
+
+	for range 100 {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server didn't start listening")
+	return ""
+}
+
+// roundTrip writes a GET for target on conn and reads the response, failing
+// once timeout passes.
+func roundTrip(conn net.Conn, br *bufio.Reader, target string, header string, timeout time.Duration) (*http.Response, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte("GET " + target + " HTTP/1.1\r\nHost: unix\r\n" + header + "\r\n")); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func TestServerConnectionLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(*Config)
+		header    string
+		wantCode  int
+		wantClose bool
+	}{
+		{"defaults", func(*Config) {}, "", http.StatusOK, false},
+		{"keep-alives disabled", func(c *Config) { c.Server.KeepAlives = false }, "", http.StatusOK, true},
+		{"header too large", func(c *Config) { c.Server.MaxHeaderBytes = 1 << 10 }, "X-Pad: " + strings.Repeat("a", 8<<10) + "\r\n", http.StatusRequestHeaderFieldsTooLarge, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			tt.setup(&cfg)
+			path := runServer(t, cfg, newFakeStore())
+			conn, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			resp, err := roundTrip(conn, bufio.NewReader(conn), "/health", tt.header, 2*time.Second)
+			if err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if resp.Close != tt.wantClose {
+				t.Errorf("connection closed = %v, want %v", resp.Close, tt.wantClose)
+			}
+		})
+	}
+}
+
+func TestServerMaxConnections(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.MaxConnections = 1
+	path := runServer(t, cfg, newFakeStore())
+
+	first, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if _, err := roundTrip(first, bufio.NewReader(first), "/health", "", 2*time.Second); err != nil {
+		t.Fatalf("first connection: %v", err)
+	}
+
+	// The kernel accepts the second connection, but the server doesn't take
+	// it while the first one is open.
+	second, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	br := bufio.NewReader(second)
+	if _, err := roundTrip(second, br, "/health", "", 200*time.Millisecond); err == nil {
+		t.Fatal("second connection served while the first one is open")
+	}
+
+	first.Close()
+	second.SetDeadline(time.Now().Add(2 * time.Second))
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("second connection after closing the first: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+}
+
+// writeSelfSignedCert writes a certificate for the host "unix", the one
+// requests over runServer's socket are made to, and its key into dir.
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "unix"},
+		DNSNames:     []string{"unix"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = dir+"/cert.pem", dir+"/key.pem"
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestServerTLS(t *testing.T) {
+	tests := []struct {
+		name      string
+		tls       bool
+		wantProto int
+	}{
+		{"plaintext", false, 1},
+		{"tls", true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			transport := &http.Transport{ForceAttemptHTTP2: true}
+			scheme := "http"
+			if tt.tls {
+				var pool *x509.CertPool
+				cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile, pool = writeSelfSignedCert(t, t.TempDir())
+				transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+				scheme = "https"
+			}
+			path := runServer(t, cfg, newFakeStore())
+			transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			}
+			defer transport.CloseIdleConnections()
+
+			resp, err := (&http.Client{Transport: transport}).Get(scheme + "://unix/clientes/1/extrato")
+			if err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status = %d, want 200", resp.StatusCode)
+			}
+			if resp.ProtoMajor != tt.wantProto {
+				t.Errorf("protocol = %s, want HTTP/%d", resp.Proto, tt.wantProto)
+			}
+		})
+	}
+}
+
+// blockingStore holds every statement until release is closed.
+type blockingStore struct {
+	Store
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Statement(ctx context.Context, customerID int, opts StatementOptions) (Statement, error) {
+	close(s.started)
+	<-s.release
+	return s.Store.Statement(ctx, customerID, opts)
+}
+
+func TestServerShutdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		wantCode int
+	}{
+		{"request finishes", 5 * time.Second, http.StatusOK},
+		{"deadline passes", 100 * time.Millisecond, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &blockingStore{Store: newFakeStore(), started: make(chan struct{}), release: make(chan struct{})}
+			path := t.TempDir() + "/api.sock"
+			cfg := testConfig()
+			cfg.Server.ListenAddr = "unix:" + path
+			cfg.Server.ShutdownTimeout = Duration{tt.timeout}
+			s := newTestServer(t, cfg, store)
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- s.Run(ctx) }()
+			for range 100 {
+				if _, err := os.Stat(path); err == nil {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			conn, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte("GET /clientes/1/extrato HTTP/1.1\r\nHost: unix\r\n\r\n")); err != nil {
+				t.Fatal(err)
+			}
+			<-store.started
+			cancel()
+			if tt.wantCode == 0 {
+				// Run gives up on the request at the deadline.
+				if err := <-done; err != nil {
+					t.Errorf("Run: %v", err)
+				}
+				close(store.release)
+				if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil {
+					t.Error("got a response from a connection closed at the deadline")
+				}
+				return
+			}
+
+			time.Sleep(100 * time.Millisecond)
+			close(store.release)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("request in flight at shutdown: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if err := <-done; err != nil {
+				t.Errorf("Run: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewServerTimezone(t *testing.T) {
+	tests := []struct {
+		timezone string
+		wantErr  bool
+	}{
+		{"America/Sao_Paulo", false},
+		{"UTC", false},
+		{"America/Nowhere", true},
+		{"not a zone", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.timezone, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Server.Timezone = tt.timezone
+			s, err := NewServer(cfg, WithStore(newFakeStore()), WithRegistry(prometheus.NewRegistry()))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("NewServer succeeded, want an error")
+				}
+				if !strings.Contains(err.Error(), tt.timezone) || !strings.Contains(err.Error(), "tzdata") {
+					t.Errorf("error %q doesn't name the timezone and tzdata", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewServer: %v", err)
+			}
+			defer s.close()
+			if got := s.now().Location().String(); got != tt.timezone {
+				t.Errorf("location = %s, want %s", got, tt.timezone)
+			}
+		})
+	}
+}
+
+// TestMainExits runs main in a subprocess of the test binary, for
+// TestStartupFailsOnUnknownTimezone.
+func TestMainExits(t *testing.T) {
+	if os.Getenv("RUN_MAIN") != "1" {
+		t.Skip("only run as a subprocess")
+	}
+	main()
+}
+
+func TestStartupFailsOnUnknownTimezone(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMainExits$")
+	cmd.Env = append(os.Environ(), "RUN_MAIN=1", "TIMEZONE=America/Nowhere")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Fatalf("main exited with %v, want status 1; output:\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "America/Nowhere") {
+		t.Errorf("output doesn't name the timezone:\n%s", out)
+	}
+}
+
+func TestServerRegistry(t *testing.T) {
+	tests := []struct {
+		name     string
+		injected bool
+	}{
+		{"own registry", false},
+		{"injected registry", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Two servers register the same metrics without colliding.
+			for i := 0; i < 2; i++ {
+				opts := []Option{WithStore(newFakeStore())}
+				var reg *prometheus.Registry
+				if tt.injected {
+					reg = prometheus.NewRegistry()
+					opts = append(opts, WithRegistry(reg))
+				}
+				s, err := NewServer(testConfig(), opts...)
+				if err != nil {
+					t.Fatalf("NewServer %d: %v", i, err)
+				}
+				defer s.close()
+				if tt.injected && s.reg != reg {
+					t.Error("server didn't use the injected registry")
+				}
+
+				extra := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_only_total", Help: "Registered by the test."})
+				if err := s.reg.Register(extra); err != nil {
+					t.Fatalf("registering with the server's registry: %v", err)
+				}
+				do(s, "GET", "/clientes/1/extrato", "")
+				body := do(s, "GET", "/metrics", "").Body.String()
+				for _, want := range []string{"test_only_total", "http_request_total"} {
+					if !strings.Contains(body, want) {
+						t.Errorf("/metrics doesn't serve %s", want)
+					}
+				}
+			}
+		})
+	}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if name := f.GetName(); name == "http_request_total" || name == "test_only_total" {
+			t.Errorf("%s registered with the default registry", name)
+		}
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	failing := newFakeStore()
+	failing.failWith("Statement", errors.New("relation \"clientes\" does not exist"))
+	chaos := testConfig()
+	chaos.Chaos.Enabled = true
+
+	tests := []struct {
+		name                 string
+		cfg                  Config
+		store                Store
+		method, target, body string
+		want                 []string
+	}{
+		{"at startup", chaos, newFakeStore(), "", "", "",
+			[]string{"level=WARN", "chaos mode enabled"}},
+		{"store error", testConfig(), failing, "GET", "/clientes/1/extrato", "",
+			[]string{"level=ERROR", `msg="store error"`, "path=/clientes/1/extrato"}},
+		{"refused credit", testConfig(), refusingStore{newFakeStore()}, "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`,
+			[]string{"level=ERROR", `msg="credit function refused credit"`, "customer=1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs, other bytes.Buffer
+			s, err := NewServer(tt.cfg,
+				WithStore(tt.store),
+				WithRegistry(prometheus.NewRegistry()),
+				WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+			)
+			if err != nil {
+				t.Fatalf("NewServer: %v", err)
+			}
+			defer s.close()
+			// A second server logs to its own logger only.
+			s2, err := NewServer(tt.cfg,
+				WithStore(newFakeStore()),
+				WithRegistry(prometheus.NewRegistry()),
+				WithLogger(slog.New(slog.NewTextHandler(&other, nil))),
+			)
+			if err != nil {
+				t.Fatalf("NewServer: %v", err)
+			}
+			defer s2.close()
+			other.Reset()
+
+			if tt.target != "" {
+				do(s, tt.method, tt.target, tt.body)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(logs.String(), want) {
+					t.Errorf("log %q doesn't contain %q", logs.String(), want)
+				}
+			}
+			if other.Len() != 0 {
+				t.Errorf("the other server logged %q", other.String())
+			}
+		})
+	}
+}
+
+func TestDefaultLogger(t *testing.T) {
+	s, err := NewServer(testConfig(), WithStore(newFakeStore()), WithRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.close()
+	if s.Logger == nil {
+		t.Fatal("Logger is nil without WithLogger")
+	}
+	if s.Logger.Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("default logger logs at debug level")
+	}
+	if !s.Logger.Enabled(context.Background(), slog.LevelInfo) {
+		t.Error("default logger doesn't log at info level")
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	s := newTestServer(t, testConfig(), newFakeStore())
+	ts := httptest.NewServer(s.Routes())
+	defer ts.Close()
+
+	// The steps run in order against the same server.
+	steps := []struct {
+		method, target, body string
+		wantStatus           int
+		wantBody             string
+	}{
+		{"GET", "/", "", http.StatusOK, ""},
+		{"POST", "/clientes/1/transacoes", `{"valor": 1000, "tipo": "c", "descricao": "credito"}`, http.StatusOK, `"saldo":1000`},
+		{"POST", "/clientes/1/transacoes", `{"valor": 400, "tipo": "d", "descricao": "debito"}`, http.StatusOK, `"saldo":600`},
+		{"POST", "/clientes/1/transacoes", `{"valor": 1000000, "tipo": "d", "descricao": "debito"}`, http.StatusUnprocessableEntity, ""},
+		{"GET", "/clientes/1/extrato", "", http.StatusOK, `"descricao":"debito"`},
+		{"GET", "/clientes/2/extrato", "", http.StatusOK, `"ultimas_transacoes":[]`},
+		{"GET", "/clientes/6/extrato", "", http.StatusNotFound, ""},
+		{"DELETE", "/clientes/1/extrato", "", http.StatusMethodNotAllowed, ""},
+		{"GET", "/healthz", "", http.StatusOK, ""},
+		{"GET", "/metrics", "", http.StatusOK, "transactions_total"},
+		{"GET", "/nope", "", http.StatusNotFound, ""},
+	}
+	for _, st := range steps {
+		req, err := http.NewRequest(st.method, ts.URL+st.target, strings.NewReader(st.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", st.method, st.target, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != st.wantStatus {
+			t.Errorf("%s %s: status = %d, want %d: %s", st.method, st.target, resp.StatusCode, st.wantStatus, body)
+		}
+		if compact := strings.ReplaceAll(string(body), " ", ""); !strings.Contains(compact, st.wantBody) {
+			t.Errorf("%s %s: body %s doesn't contain %s", st.method, st.target, body, st.wantBody)
+		}
+	}
+}
+
+func TestServersIndependent(t *testing.T) {
+	a := newTestServer(t, testConfig(), newFakeStore())
+	b := newTestServer(t, testConfig(), newFakeStore())
+	if w := do(a, "POST", "/clientes/1/transacoes", `{"valor": 1000, "tipo": "c", "descricao": "x"}`); w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		name        string
+		s           *Server
+		wantBalance string
+	}{
+		{"written", a, "1000"},
+		{"other", b, "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getStatement(t, tt.s, "/clientes/1/extrato").Balance.Total.String(); got != tt.wantBalance {
+				t.Errorf("saldo = %s, want %s", got, tt.wantBalance)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	path := runServer(t, testConfig(), newFakeStore())
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://unix/clientes/1/extrato")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	tests := []struct {
+		name                 string
+		prefix               string
+		method, target, body string
+		wantStatus           int
+		// wantPath is the path label the request is counted under, if any.
+		wantPath string
+	}{
+		{"statement", "/api", "GET", "/api/clientes/3/extrato", "", http.StatusOK, "/clientes/{id}/extrato"},
+		{"transaction", "/api", "POST", "/api/clientes/3/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`, http.StatusOK, "/clientes/{id}/transacoes"},
+		{"nested prefix", "/rinha/v1", "GET", "/rinha/v1/clientes/3/extrato", "", http.StatusOK, "/clientes/{id}/extrato"},
+		{"health", "/api", "GET", "/api/healthz", "", http.StatusOK, ""},
+		{"root", "/api", "GET", "/api/", "", http.StatusOK, ""},
+		{"unprefixed", "/api", "GET", "/clientes/3/extrato", "", http.StatusNotFound, ""},
+		{"other prefix", "/api", "GET", "/apix/clientes/3/extrato", "", http.StatusNotFound, ""},
+		{"prefix alone", "/api", "GET", "/api", "", http.StatusNotFound, ""},
+		{"no prefix", "", "GET", "/clientes/3/extrato", "", http.StatusOK, "/clientes/{id}/extrato"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Server.PathPrefix = tt.prefix
+			s := newTestServer(t, cfg, newFakeStore())
+			var before float64
+			if tt.wantPath != "" {
+				before = counterValue(t, httpRequestTotal.WithLabelValues("200", tt.method, tt.wantPath))
+			}
+
+			w := do(s, tt.method, tt.target, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantPath == "" {
+				return
+			}
+			if got := counterValue(t, httpRequestTotal.WithLabelValues("200", tt.method, tt.wantPath)) - before; got != 1 {
+				t.Errorf("http_request_total for %s went up by %v, want 1", tt.wantPath, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSafeInteger is the largest integer a float64, and so JavaScript, holds
+// exactly.
+const maxSafeInteger = 1<<53 - 1
+
+// moneyFormat is how amounts are rendered: as decimal strings such as "10.50"
+// rather than cents, and, for cents, as strings when beyond maxSafeInteger so
+// JavaScript clients don't lose precision parsing them.
+type moneyFormat struct {
+	decimal        bool
+	largeAsStrings bool
+}
+
+// money is an amount in cents, rendered as a JSON number or as format says.
+type money struct {
+	cents  int
+	format moneyFormat
+}
+
+func (m money) MarshalJSON() ([]byte, error) {
+	return m.appendJSON(nil), nil
+}
+
+func (m money) appendJSON(b []byte) []byte {
+	if !m.format.decimal {
+		if m.format.largeAsStrings && (m.cents > maxSafeInteger || m.cents < -maxSafeInteger) {
+			b = append(b, '"')
+			b = strconv.AppendInt(b, int64(m.cents), 10)
+			return append(b, '"')
+		}
+		return strconv.AppendInt(b, int64(m.cents), 10)
+	}
+
+	b = append(b, '"')
+	cents := m.cents
+	if cents < 0 {
+		b = append(b, '-')
+		cents = -cents
+	}
+	b = strconv.AppendInt(b, int64(cents/100), 10)
+	return append(b, '.', byte('0'+cents%100/10), byte('0'+cents%10), '"')
+}
+
+type balanceRes struct {
+	Total    money  `json:"total"`
+	Date     string `json:"data_extrato"` // "2024-01-17T02:34:38.543030Z"
+	Limit    money  `json:"limite"`
+	Currency string `json:"moeda"`
+}
+
+type transactionRes struct {
+	Value money  `json:"valor"`
+	Type  string `json:"tipo"`
+	Desc  string `json:"descricao"`
+	Date  string `json:"realizada_em"` // "2024-01-17T02:34:38.543030Z"
+	// BalanceAfter is only set with ?withBalance=true.
+	BalanceAfter *money `json:"saldo_apos,omitempty"`
+	// ID is only set with ?since=.
+	ID *int64 `json:"id,omitempty"`
+}
+
+// projectedTransactionRes is a transactionRes restricted to the fields asked
+// for with ?fields=; the others are nil and left out.
+type projectedTransactionRes struct {
+	Value        *money  `json:"valor,omitempty"`
+	Type         *string `json:"tipo,omitempty"`
+	Desc         *string `json:"descricao,omitempty"`
+	Date         *string `json:"realizada_em,omitempty"`
+	BalanceAfter *money  `json:"saldo_apos,omitempty"`
+	ID           *int64  `json:"id,omitempty"`
+}
+
+type projectedStatementResponse struct {
+	Balance      balanceRes                `json:"saldo"`
+	Transactions []projectedTransactionRes `json:"ultimas_transacoes"`
+}
+
+// fieldColumns maps the transaction fields accepted by ?fields= to the
+// columns they are read from.
+var fieldColumns = map[string]string{
+	"valor":        "amount",
+	"tipo":         "type",
+	"descricao":    "description",
+	"realizada_em": "created_at",
+}
+
+type statementResponse struct {
+	Balance      balanceRes       `json:"saldo"`
+	Transactions []transactionRes `json:"ultimas_transacoes"`
+}
+
+type summaryRes struct {
+	Count int     `json:"total_transacoes"`
+	Last  *string `json:"ultima_transacao_em"`
+}
+
+type statementSummaryResponse struct {
+	Balance balanceRes `json:"saldo"`
+	Summary summaryRes `json:"resumo"`
+}
+
+// statementBufferPool holds the buffers statements are encoded into.
+var statementBufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// statementLimit is both the default and the largest number of transactions
+// in a statement.
+const statementLimit = 10
+
+// handleStatement serves the balance and the last transactions of a customer.
+// With fastJSON the response is written by appendJSON instead of
+// encoding/json. With ?summary=true only the transaction count and the time
+// of the last one are returned. ?order=asc lists the same last transactions
+// oldest first; the default is "desc". ?limit=N returns at most N of them,
+// zero only reading the balance. ?fields=valor,tipo reads and returns only
+// those transaction fields. ?withBalance=true adds the balance right after
+// each transaction as saldo_apos. ?since=ID lists the transactions after ID
+// instead, oldest first and with their id, for clients following the
+// history. ?pretty=true indents the JSON. A non-nil
+// cache serves repeated statements without reading or encoding them again.
+// Last-Modified is when the balance last changed, and If-Modified-Since is
+// answered with 304 when it hasn't since. The statement query timeout, if
+// set, bounds the queries, answering 503 past it.
+func (s *Server) handleStatement(store Store, cache *statementCache, maxAge time.Duration, fastJSON bool) http.HandlerFunc {
+	cacheControl := "no-store"
+	if maxAge > 0 {
+		cacheControl = "private, max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		customerIDStr := r.PathValue("id")
+		customerID, err := parseCustomerID(customerIDStr)
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, "", "customer not found")
+			return
+		}
+
+		if customerID < 1 {
+			writeError(w, r, http.StatusNotFound, "", "customer not found")
+			return
+		}
+
+		decimal := r.URL.Query().Get("decimal") == "true"
+		format := moneyFormat{decimal: decimal, largeAsStrings: s.cfg.Server.LargeNumbersAsStrings}
+		pretty := r.URL.Query().Get("pretty") == "true"
+
+		order := r.URL.Query().Get("order")
+		if order != "" && order != "asc" && order != "desc" {
+			writeError(w, r, http.StatusUnprocessableEntity, "", "order must be \"asc\" or \"desc\"")
+			return
+		}
+
+		var since *int64
+		if v := r.URL.Query().Get("since"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				writeError(w, r, http.StatusUnprocessableEntity, "", "since must be a non-negative integer")
+				return
+			}
+			since = &n
+			if order == "desc" {
+				writeError(w, r, http.StatusUnprocessableEntity, "", "since always lists transactions in ascending order")
+				return
+			}
+		}
+
+		limit := statementLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit < 0 || limit > statementLimit {
+				writeError(w, r, http.StatusUnprocessableEntity, "", "limit must be between 0 and "+strconv.Itoa(statementLimit))
+				return
+			}
+		}
+
+		var fields, columns []string
+		if v := r.URL.Query().Get("fields"); v != "" {
+			fields = strings.Split(v, ",")
+			for _, f := range fields {
+				c, ok := fieldColumns[f]
+				if !ok {
+					writeError(w, r, http.StatusUnprocessableEntity, "", "unknown field")
+					return
+				}
+				columns = append(columns, c)
+			}
+		}
+
+		// The running balance is worked out from the amount and type of each
+		// transaction, so those are read even if not asked for.
+		withBalance := r.URL.Query().Get("withBalance") == "true"
+		// The running balance goes back from the current balance, which
+		// only works from the last transaction.
+		if withBalance && since != nil {
+			writeError(w, r, http.StatusUnprocessableEntity, "", "withBalance can't be combined with since")
+			return
+		}
+		if withBalance && columns != nil {
+			for _, c := range []string{"amount", "type"} {
+				if !slices.Contains(columns, c) {
+					columns = append(columns, c)
+				}
+			}
+		}
+
+		ctx := r.Context()
+		if queryTimeout := time.Duration(s.statementQueryTimeout.Load()); queryTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, queryTimeout)
+			defer cancel()
+		}
+
+		if r.URL.Query().Get("summary") == "true" {
+			sum, err := store.Summary(ctx, customerID)
+			if err != nil {
+				s.writeStoreError(w, r, err)
+				return
+			}
+
+			resp := statementSummaryResponse{
+				Balance: balanceRes{
+					Total:    money{sum.Balance, format},
+					Date:     s.now().Format(time.RFC3339Nano),
+					Limit:    money{sum.Limit, format},
+					Currency: sum.Currency,
+				},
+				Summary: summaryRes{Count: sum.TransactionCount},
+			}
+			if sum.LastTransactionAt != nil {
+				last := sum.LastTransactionAt.In(s.location.Load()).Format(time.RFC3339Nano)
+				resp.Summary.Last = &last
+			}
+
+			w.Header().Set("Cache-Control", cacheControl)
+			w.WriteHeader(http.StatusOK)
+			enc := json.NewEncoder(w)
+			if pretty {
+				enc.SetIndent("", "  ")
+			}
+			enc.Encode(resp)
+			return
+		}
+
+		variant := "order=" + order + "&limit=" + strconv.Itoa(limit) + "&decimal=" + strconv.FormatBool(decimal) + "&fields=" + strings.Join(fields, ",") + "&withBalance=" + strconv.FormatBool(withBalance)
+		if since != nil {
+			variant += "&since=" + strconv.FormatInt(*since, 10)
+		}
+		date := s.now().Format(time.RFC3339Nano)
+		var gen uint64
+		if cache != nil {
+			var body []byte
+			var modified time.Time
+			var ok bool
+			if body, modified, gen, ok = cache.get(customerID, variant, date); ok {
+				writeStatement(w, r, body, modified, cacheControl, pretty)
+				return
+			}
+		}
+
+		st, err := store.Statement(ctx, customerID, StatementOptions{Limit: limit, Columns: columns, Since: since})
+		if err != nil {
+			s.writeStoreError(w, r, err)
+			return
+		}
+		statementRowsReturned.Observe(float64(len(st.Transactions)))
+
+		// Times are scanned in time.Local, which in the image is UTC.
+		loc := s.location.Load()
+		for i := range st.Transactions {
+			st.Transactions[i].CreatedAt = st.Transactions[i].CreatedAt.In(loc)
+		}
+
+		var balances []int
+		if withBalance {
+			balances = runningBalances(st.Balance, st.Transactions)
+		}
+		if order == "asc" && since == nil {
+			slices.Reverse(st.Transactions)
+			slices.Reverse(balances)
+		}
+
+		b := balanceRes{
+			Total:    money{st.Balance, format},
+			Date:     date,
+			Limit:    money{st.Limit, format},
+			Currency: st.Currency,
+		}
+
+		buf := statementBufferPool.Get().(*bytes.Buffer)
+		defer releaseBuffer(&statementBufferPool, buf)
+		encodeStart := time.Now()
+		switch {
+		case fields != nil:
+			resp := projectedStatementResponse{Balance: b, Transactions: projectTransactions(st.Transactions, balances, fields, format)}
+			json.NewEncoder(buf).Encode(resp)
+		case fastJSON:
+			resp := statementResponse{Balance: b, Transactions: transactionsRes(st.Transactions, balances, format)}
+			buf.Write(resp.appendJSON(buf.AvailableBuffer()))
+		default:
+			resp := statementResponse{Balance: b, Transactions: transactionsRes(st.Transactions, balances, format)}
+			json.NewEncoder(buf).Encode(resp)
+		}
+		jsonEncodeDuration.Observe(time.Since(encodeStart).Seconds())
+		if cache != nil {
+			// buf goes back to the pool, so the cache gets its own copy.
+			cache.put(customerID, variant, gen, bytes.Clone(buf.Bytes()), date, st.LastModified)
+		}
+
+		writeStatement(w, r, buf.Bytes(), st.LastModified, cacheControl, pretty)
+	}
+}
+
+// writeStatement writes the encoded statement body, indented if pretty, or
+// 304 if it wasn't modified since If-Modified-Since. The body is always
+// encoded and cached compact, so indenting is only paid for when asked.
+func writeStatement(w http.ResponseWriter, r *http.Request, body []byte, modified time.Time, cacheControl string, pretty bool) {
+	w.Header().Set("Cache-Control", cacheControl)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		// HTTP dates have no fraction of a second.
+		since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err == nil && !modified.Truncate(time.Second).After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	if !pretty {
+		w.Write(body)
+		return
+	}
+	var out bytes.Buffer
+	json.Indent(&out, body, "", "  ")
+	w.Write(out.Bytes())
+}
+
+// runningBalances returns the balance right after each of transactions,
+// newest first, going back from the current balance. It costs nothing beyond
+// a pass over the transactions already read, whatever the limit.
+func runningBalances(balance int, transactions []Transaction) []int {
+	balances := make([]int, len(transactions))
+	for i, t := range transactions {
+		balances[i] = balance
+		if t.Type == "c" {
+			balance -= t.Value
+		} else {
+			balance += t.Value
+		}
+	}
+	return balances
+}
+
+// transactionsRes builds the transactions of the response, with their
+// running balance when balances isn't nil.
+func transactionsRes(transactions []Transaction, balances []int, format moneyFormat) []transactionRes {
+	res := make([]transactionRes, 0, len(transactions))
+	for i, t := range transactions {
+		tr := transactionRes{
+			Value: money{t.Value, format},
+			Type:  t.Type,
+			Desc:  t.Description,
+			Date:  t.CreatedAt.Format(time.RFC3339Nano),
+		}
+		if balances != nil {
+			tr.BalanceAfter = &money{balances[i], format}
+		}
+		if t.ID != 0 {
+			tr.ID = &t.ID
+		}
+		res = append(res, tr)
+	}
+	return res
+}
+
+func projectTransactions(transactions []Transaction, balances []int, fields []string, format moneyFormat) []projectedTransactionRes {
+	res := make([]projectedTransactionRes, len(transactions))
+	for i, t := range transactions {
+		if balances != nil {
+			res[i].BalanceAfter = &money{balances[i], format}
+		}
+		if t.ID != 0 {
+			res[i].ID = &t.ID
+		}
+		for _, f := range fields {
+			switch f {
+			case "valor":
+				res[i].Value = &money{t.Value, format}
+			case "tipo":
+				res[i].Type = &t.Type
+			case "descricao":
+				res[i].Desc = &t.Description
+			case "realizada_em":
+				date := t.CreatedAt.Format(time.RFC3339Nano)
+				res[i].Date = &date
+			}
+		}
+	}
+	return res
+}
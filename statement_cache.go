@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+)
+
+// statementCache keeps the encoded statement responses of each customer for
+// a short while, so polling clients are served without touching the database
+// or encoding anything. Entries of a customer are dropped as soon as one of
+// its transactions is applied by this process. The data_extrato of a cached
+// body is overwritten on every hit, so it's always the time of the request.
+//
+// get only looks customers up: put adds them once their statement was read,
+// and invalidate once one of their transactions was applied, so unknown ids
+// aren't kept. Expired entries, and customers left without any, are swept
+// at most once per TTL.
+type statementCache struct {
+	ttl time.Duration
+
+	mu sync.Mutex
+	// gen is bumped on every invalidation, so a response read from the
+	// database before a transaction isn't stored after it.
+	gen       uint64
+	customers map[int]*cachedCustomer
+	// sweptGen is gen at the last sweep, which may have dropped invalidated
+	// customers.
+	sweptGen  uint64
+	nextSweep time.Time
+}
+
+type cachedCustomer struct {
+	// gen is the cache's gen at the customer's last invalidation, or the
+	// one its first statement was read at.
+	gen     uint64
+	entries map[string]cachedStatement
+}
+
+type cachedStatement struct {
+	body []byte
+	// dateAt and dateLen locate data_extrato in body, dateAt being -1 if it
+	// wasn't found.
+	dateAt, dateLen int
+	modified        time.Time
+	expires         time.Time
+}
+
+func newStatementCache(ttl time.Duration) *statementCache {
+	return &statementCache{ttl: ttl, customers: make(map[int]*cachedCustomer)}
+}
+
+// get returns the cached body of the statement of customerID rendered as
+// variant, with date as its data_extrato, and when its balance last changed,
+// along with the generation to pass to put on a miss.
+func (c *statementCache) get(customerID int, variant, date string) ([]byte, time.Time, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cc, ok := c.customers[customerID]
+	if !ok {
+		return nil, time.Time{}, c.gen, false
+	}
+	e, ok := cc.entries[variant]
+	if !ok {
+		return nil, time.Time{}, cc.gen, false
+	}
+	if time.Now().After(e.expires) {
+		delete(cc.entries, variant)
+		return nil, time.Time{}, cc.gen, false
+	}
+	if e.dateAt < 0 {
+		return e.body, e.modified, cc.gen, true
+	}
+	body := make([]byte, 0, len(e.body)-e.dateLen+len(date))
+	body = append(body, e.body[:e.dateAt]...)
+	body = append(body, date...)
+	body = append(body, e.body[e.dateAt+e.dateLen:]...)
+	return body, e.modified, cc.gen, true
+}
+
+// put stores body, whose data_extrato is date, unless the customer was
+// invalidated since gen was read. The balance comes before the transactions,
+// so the first occurrence of date is data_extrato.
+//
+// A customer missing from the cache wasn't invalidated since gen was read,
+// which would have added it, unless a sweep ran since and dropped it.
+func (c *statementCache) put(customerID int, variant string, gen uint64, body []byte, date string, modified time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	cc, ok := c.customers[customerID]
+	if !ok {
+		if gen < c.sweptGen {
+			return
+		}
+		cc = &cachedCustomer{gen: gen, entries: make(map[string]cachedStatement)}
+		c.customers[customerID] = cc
+	}
+	if cc.gen != gen {
+		return
+	}
+	cc.entries[variant] = cachedStatement{
+		body:     body,
+		dateAt:   bytes.Index(body, []byte(date)),
+		dateLen:  len(date),
+		modified: modified,
+		expires:  now.Add(c.ttl),
+	}
+
+	if now.After(c.nextSweep) {
+		c.sweep(now)
+		c.nextSweep = now.Add(c.ttl)
+	}
+}
+
+func (c *statementCache) invalidate(customerID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	cc, ok := c.customers[customerID]
+	if !ok {
+		cc = &cachedCustomer{entries: make(map[string]cachedStatement)}
+		c.customers[customerID] = cc
+	}
+	cc.gen = c.gen
+	clear(cc.entries)
+}
+
+// sweep drops the entries expired by now, and the customers left without
+// any.
+func (c *statementCache) sweep(now time.Time) {
+	for id, cc := range c.customers {
+		for variant, e := range cc.entries {
+			if now.After(e.expires) {
+				delete(cc.entries, variant)
+			}
+		}
+		if len(cc.entries) == 0 {
+			delete(c.customers, id)
+		}
+	}
+	c.sweptGen = c.gen
+}
+
+// invalidatingStore is a Store that invalidates the statement cache of the
+// customers whose transactions it applies.
+type invalidatingStore struct {
+	Store
+	cache *statementCache
+}
+
+func (s *invalidatingStore) Credit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	res, err := s.Store.Credit(ctx, customerID, value, desc)
+	if err == nil && res.Applied {
+		s.cache.invalidate(customerID)
+	}
+	return res, err
+}
+
+func (s *invalidatingStore) Debit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	res, err := s.Store.Debit(ctx, customerID, value, desc)
+	if err == nil && res.Applied {
+		s.cache.invalidate(customerID)
+	}
+	return res, err
+}
+
+func (s *invalidatingStore) ApplyIfBalance(ctx context.Context, customerID, value int, typ, desc string, expected int) (TransactionResult, error) {
+	res, err := s.Store.ApplyIfBalance(ctx, customerID, value, typ, desc, expected)
+	if err == nil && res.Applied {
+		s.cache.invalidate(customerID)
+	}
+	return res, err
+}
+
+func (s *invalidatingStore) ResetCustomer(ctx context.Context, customerID int, clearTransactions bool) (Customer, error) {
+	c, err := s.Store.ResetCustomer(ctx, customerID, clearTransactions)
+	if err == nil {
+		s.cache.invalidate(customerID)
+	}
+	return c, err
+}
+
+func (s *invalidatingStore) BeginBatch(ctx context.Context) (Batch, error) {
+	b, err := s.Store.BeginBatch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &invalidatingBatch{Batch: b, cache: s.cache}, nil
+}
+
+// invalidatingBatch invalidates on Apply as well as on Commit: a statement
+// cached in between would still show the balance from before the batch.
+type invalidatingBatch struct {
+	Batch
+	cache   *statementCache
+	touched []int
+}
+
+func (b *invalidatingBatch) Apply(ctx context.Context, customerID, value int, typ, desc string) (TransactionResult, error) {
+	res, err := b.Batch.Apply(ctx, customerID, value, typ, desc)
+	if err == nil && res.Applied {
+		b.cache.invalidate(customerID)
+		b.touched = append(b.touched, customerID)
+	}
+	return res, err
+}
+
+func (b *invalidatingBatch) Commit(ctx context.Context) error {
+	err := b.Batch.Commit(ctx)
+	for _, id := range b.touched {
+		b.cache.invalidate(id)
+	}
+	b.touched = nil
+	return err
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestStatementCache(t *testing.T) {
+	credit := `{"valor": 100, "tipo": "c", "descricao": "x"}`
+	tests := []struct {
+		name        string
+		ttl         time.Duration
+		between     func(t *testing.T, s *Server)
+		second      string
+		wantQueries int
+	}{
+		{"hit", time.Minute, func(*testing.T, *Server) {}, "/clientes/1/extrato", 1},
+		{"other variant", time.Minute, func(*testing.T, *Server) {}, "/clientes/1/extrato?order=asc", 2},
+		{"other customer's transaction", time.Minute, func(t *testing.T, s *Server) {
+			do(s, "POST", "/clientes/2/transacoes", credit)
+		}, "/clientes/1/extrato", 1},
+		{"transaction", time.Minute, func(t *testing.T, s *Server) { seed(t, s, credit) }, "/clientes/1/extrato", 2},
+		{"rejected transaction", time.Minute, func(t *testing.T, s *Server) {
+			do(s, "POST", "/clientes/1/transacoes", `{"valor": 1000000, "tipo": "d", "descricao": "x"}`)
+		}, "/clientes/1/extrato", 1},
+		{"stream", time.Minute, func(t *testing.T, s *Server) {
+			do(s, "POST", "/clientes/1/transacoes/stream", ndjson(2))
+		}, "/clientes/1/extrato", 2},
+		{"expired", 20 * time.Millisecond, func(*testing.T, *Server) { time.Sleep(30 * time.Millisecond) }, "/clientes/1/extrato", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			cfg := testConfig()
+			cfg.Server.StatementCacheTTL = Duration{tt.ttl}
+			s := newTestServer(t, cfg, store)
+
+			first := do(s, "GET", "/clientes/1/extrato", "")
+			tt.between(t, s)
+			second := do(s, "GET", tt.second, "")
+			if first.Code != http.StatusOK || second.Code != http.StatusOK {
+				t.Fatalf("statuses %d and %d, want 200", first.Code, second.Code)
+			}
+			if got := store.count("Statement"); got != tt.wantQueries {
+				t.Errorf("statement read %d times, want %d", got, tt.wantQueries)
+			}
+		})
+	}
+}
+
+func TestStatementCacheFreshDate(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.StatementCacheTTL = Duration{time.Minute}
+	s := newTestServer(t, cfg, newFakeStore())
+	seed(t, s, `{"valor": 100, "tipo": "c", "descricao": "x"}`)
+
+	first := getStatement(t, s, "/clientes/1/extrato")
+	time.Sleep(2 * time.Millisecond)
+	second := getStatement(t, s, "/clientes/1/extrato")
+
+	if first.Balance.Date == second.Balance.Date {
+		t.Errorf("cached statement kept data_extrato %s", first.Balance.Date)
+	}
+	if second.Balance.Total != first.Balance.Total || len(second.Transactions) != 1 || second.Transactions[0] != first.Transactions[0] {
+		t.Errorf("cached statement %+v differs from %+v beyond data_extrato", second, first)
+	}
+	w := do(s, "GET", "/clientes/1/extrato", "")
+	date := regexp.MustCompile(`"data_extrato":"[^"]*"`)
+	if n := len(date.FindAllString(w.Body.String(), -1)); n != 1 {
+		t.Errorf("cached body has %d data_extrato: %s", n, w.Body)
+	}
+}
+
+func TestStatementCacheGeneration(t *testing.T) {
+	c := newStatementCache(time.Minute)
+	_, _, gen, ok := c.get(1, "v", "d1")
+	if ok {
+		t.Fatal("hit on an empty cache")
+	}
+	// A transaction lands between reading the statement and storing it.
+	c.invalidate(1)
+	c.put(1, "v", gen, []byte(`{"data_extrato":"d1"}`), "d1", time.Time{})
+	if _, _, _, ok := c.get(1, "v", "d2"); ok {
+		t.Error("stored a statement read before an invalidation")
+	}
+
+	_, _, gen, _ = c.get(1, "v", "d1")
+	c.put(1, "v", gen, []byte(`{"data_extrato":"d1"}`), "d1", time.Time{})
+	body, _, _, ok := c.get(1, "v", "date2")
+	if !ok || string(body) != `{"data_extrato":"date2"}` {
+		t.Errorf("get = %s, %v; want the body with the new date", body, ok)
+	}
+}
+
+func TestStatementCachePut(t *testing.T) {
+	body := []byte(`{"data_extrato":"d1"}`)
+	tests := []struct {
+		name string
+		// cached stores another variant of customer 1 first.
+		cached bool
+		// between runs after reading the generation and before the put.
+		between func(c *statementCache)
+		wantHit bool
+	}{
+		{"stored", false, func(*statementCache) {}, true},
+		{"invalidated", false, func(c *statementCache) { c.invalidate(1) }, false},
+		{"other customer invalidated", false, func(c *statementCache) { c.invalidate(2) }, true},
+		{"swept", false, func(c *statementCache) { c.sweep(time.Now()) }, true},
+		{"invalidated then swept", false, func(c *statementCache) {
+			c.invalidate(1)
+			c.sweep(time.Now())
+		}, false},
+		{"cached and invalidated", true, func(c *statementCache) { c.invalidate(1) }, false},
+		{"cached and other customer invalidated", true, func(c *statementCache) { c.invalidate(2) }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newStatementCache(time.Minute)
+			if tt.cached {
+				_, _, gen, _ := c.get(1, "other", "d1")
+				c.put(1, "other", gen, body, "d1", time.Time{})
+			}
+			_, _, gen, _ := c.get(1, "v", "d1")
+			tt.between(c)
+			c.put(1, "v", gen, body, "d1", time.Time{})
+			if _, _, _, ok := c.get(1, "v", "d2"); ok != tt.wantHit {
+				t.Errorf("hit = %v, want %v", ok, tt.wantHit)
+			}
+		})
+	}
+}
+
+func TestStatementCacheSize(t *testing.T) {
+	const ttl = 20 * time.Millisecond
+	tests := []struct {
+		name          string
+		fill          func(c *statementCache)
+		wantCustomers int
+	}{
+		{"unknown customers read", func(c *statementCache) {
+			for id := range 1000 {
+				c.get(id, "v", "d1")
+			}
+		}, 0},
+		{"customers cached", func(c *statementCache) {
+			for id := range 1000 {
+				_, _, gen, _ := c.get(id, "v", "d1")
+				c.put(id, "v", gen, []byte(`{}`), "d1", time.Time{})
+			}
+		}, 1000},
+		{"expired customers swept", func(c *statementCache) {
+			for id := range 1000 {
+				_, _, gen, _ := c.get(id, "v", "d1")
+				c.put(id, "v", gen, []byte(`{}`), "d1", time.Time{})
+				c.invalidate(id + 1000)
+			}
+			time.Sleep(ttl + 10*time.Millisecond)
+			_, _, gen, _ := c.get(1, "v", "d1")
+			c.put(1, "v", gen, []byte(`{}`), "d1", time.Time{})
+		}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newStatementCache(ttl)
+			tt.fill(c)
+			if got := len(c.customers); got != tt.wantCustomers {
+				t.Errorf("%d customers in the cache, want %d", got, tt.wantCustomers)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"unicode/utf8"
+)
+
+// appendJSON appends the response encoded exactly as json.Encoder would,
+// trailing newline included, without going through reflection.
+func (resp statementResponse) appendJSON(b []byte) []byte {
+	b = append(b, `{"saldo":{"total":`...)
+	b = resp.Balance.Total.appendJSON(b)
+	b = append(b, `,"data_extrato":`...)
+	b = appendJSONString(b, resp.Balance.Date)
+	b = append(b, `,"limite":`...)
+	b = resp.Balance.Limit.appendJSON(b)
+	b = append(b, `,"moeda":`...)
+	b = appendJSONString(b, resp.Balance.Currency)
+	b = append(b, `},"ultimas_transacoes":[`...)
+	for i, t := range resp.Transactions {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, `{"valor":`...)
+		b = t.Value.appendJSON(b)
+		b = append(b, `,"tipo":`...)
+		b = appendJSONString(b, t.Type)
+		b = append(b, `,"descricao":`...)
+		b = appendJSONString(b, t.Desc)
+		b = append(b, `,"realizada_em":`...)
+		b = appendJSONString(b, t.Date)
+		if t.BalanceAfter != nil {
+			b = append(b, `,"saldo_apos":`...)
+			b = t.BalanceAfter.appendJSON(b)
+		}
+		if t.ID != nil {
+			b = append(b, `,"id":`...)
+			b = strconv.AppendInt(b, *t.ID, 10)
+		}
+		b = append(b, '}')
+	}
+	return append(b, "]}\n"...)
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends s as a JSON string, escaping it the same way
+// encoding/json does by default, HTML characters included.
+func appendJSONString(b []byte, s string) []byte {
+	// How invalid UTF-8 is replaced has changed between Go versions, so leave
+	// that rare case to encoding/json itself.
+	if !utf8.ValidString(s) {
+		enc, _ := json.Marshal(s)
+		return append(b, enc...)
+	}
+
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			b = append(b, s[start:i]...)
+			switch c {
+			case '\\', '"':
+				b = append(b, '\\', c)
+			case '\b':
+				b = append(b, '\\', 'b')
+			case '\f':
+				b = append(b, '\\', 'f')
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			case '\t':
+				b = append(b, '\\', 't')
+			default:
+				b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == '\u2028' || r == '\u2029' {
+			b = append(b, s[start:i]...)
+			b = append(b, '\\', 'u', '2', '0', '2', hexDigits[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStatementResponse is a full statement of customer 1, with every
+// optional field set when detailed.
+func testStatementResponse(n int, format moneyFormat, detailed bool) statementResponse {
+	now := time.Date(2024, 1, 17, 2, 34, 38, 543030000, time.UTC)
+	transactions := make([]Transaction, n)
+	var balances []int
+	for i := range transactions {
+		transactions[i] = Transaction{Value: 1000 + i, Type: "c", Description: "descricao", CreatedAt: now.Add(-time.Duration(i) * time.Second)}
+		if detailed {
+			transactions[i].ID = int64(n - i)
+			balances = append(balances, 1000*(n-i))
+		}
+	}
+	return statementResponse{
+		Balance: balanceRes{
+			Total:    money{1000 * n, format},
+			Date:     now.Format(time.RFC3339Nano),
+			Limit:    money{100000, format},
+			Currency: "BRL",
+		},
+		Transactions: transactionsRes(transactions, balances, format),
+	}
+}
+
+func TestStatementAppendJSON(t *testing.T) {
+	withDesc := func(desc string) statementResponse {
+		resp := testStatementResponse(1, moneyFormat{}, false)
+		resp.Transactions[0].Desc = desc
+		return resp
+	}
+	tests := []struct {
+		name string
+		resp statementResponse
+	}{
+		{"no transactions", testStatementResponse(0, moneyFormat{}, false)},
+		{"ten transactions", testStatementResponse(10, moneyFormat{}, false)},
+		{"balances and ids", testStatementResponse(10, moneyFormat{}, true)},
+		{"decimal", testStatementResponse(3, moneyFormat{decimal: true}, true)},
+		{"negative decimal", func() statementResponse {
+			resp := testStatementResponse(1, moneyFormat{decimal: true}, false)
+			resp.Balance.Total.cents = -5
+			return resp
+		}()},
+		{"large numbers as strings", func() statementResponse {
+			resp := testStatementResponse(1, moneyFormat{largeAsStrings: true}, false)
+			resp.Balance.Total.cents = -(maxSafeInteger + 1)
+			resp.Balance.Limit.cents = maxSafeInteger + 1
+			return resp
+		}()},
+		{"quotes and backslashes", withDesc(`a"b\c`)},
+		{"control characters", withDesc("a\nb\tc\r\x00\x1f\b\f")},
+		{"html", withDesc("<a>&amp;")},
+		{"line separators", withDesc("a\u2028b\u2029")},
+		{"multibyte", withDesc("pão ção 🍞")},
+		{"invalid utf-8", withDesc("a\xffb\xc3")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var want bytes.Buffer
+			if err := json.NewEncoder(&want).Encode(tt.resp); err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.resp.appendJSON(nil); !bytes.Equal(got, want.Bytes()) {
+				t.Errorf("appendJSON =\n%s\nencoding/json =\n%s", got, want.Bytes())
+			}
+		})
+	}
+}
+
+func TestStatementFastJSON(t *testing.T) {
+	// Both servers read the same transactions, so only data_extrato, the
+	// time of the request, tells their bodies apart.
+	store := newFakeStore()
+	date := regexp.MustCompile(`"data_extrato":"[^"]*"`)
+	bodies := make(map[bool]string)
+	for _, fast := range []bool{false, true} {
+		cfg := testConfig()
+		cfg.Server.FastJSON = fast
+		s := newTestServer(t, cfg, store)
+		if !fast {
+			seed(t, s,
+				`{"valor": 1000, "tipo": "c", "descricao": "<pão>"}`,
+				`{"valor": 300, "tipo": "d", "descricao": "a\"b"}`,
+			)
+		}
+
+		w := do(s, "GET", "/clientes/1/extrato?withBalance=true", "")
+		if w.Code != 200 {
+			t.Fatalf("fast json %v: status %d", fast, w.Code)
+		}
+		bodies[fast] = date.ReplaceAllString(w.Body.String(), `"data_extrato":""`)
+	}
+	if bodies[true] != bodies[false] {
+		t.Errorf("fast json body =\n%s\nencoding/json body =\n%s", bodies[true], bodies[false])
+	}
+	if !strings.Contains(bodies[true], `\u003cpão\u003e`) {
+		t.Errorf("body %s doesn't escape HTML like encoding/json", bodies[true])
+	}
+}
+
+func BenchmarkStatementEncoding(b *testing.B) {
+	resp := testStatementResponse(statementLimit, moneyFormat{}, false)
+	b.Run("encoding/json", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf bytes.Buffer
+		for i := 0; i < b.N; i++ {
+			buf.Reset()
+			json.NewEncoder(&buf).Encode(resp)
+		}
+	})
+	b.Run("appendJSON", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf bytes.Buffer
+		for i := 0; i < b.N; i++ {
+			buf.Reset()
+			buf.Write(resp.appendJSON(buf.AvailableBuffer()))
+		}
+	})
+}
@@ -0,0 +1,919 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// decodedStatement is a statement response as a client reads it.
+type decodedStatement struct {
+	Balance struct {
+		Total    json.Number `json:"total"`
+		Date     string      `json:"data_extrato"`
+		Limit    json.Number `json:"limite"`
+		Currency string      `json:"moeda"`
+	} `json:"saldo"`
+	Transactions []struct {
+		Value        json.Number  `json:"valor"`
+		Type         string       `json:"tipo"`
+		Desc         string       `json:"descricao"`
+		Date         string       `json:"realizada_em"`
+		BalanceAfter *json.Number `json:"saldo_apos"`
+		ID           *int64       `json:"id"`
+	} `json:"ultimas_transacoes"`
+}
+
+// getStatement requests target and decodes the statement it answers.
+func getStatement(t *testing.T, s *Server, target string, header ...string) decodedStatement {
+	t.Helper()
+	w := do(s, "GET", target, "", header...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", target, w.Code, w.Body)
+	}
+	var st decodedStatement
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body, err)
+	}
+	return st
+}
+
+// seed applies the transactions in bodies to customer 1.
+func seed(t *testing.T, s *Server, bodies ...string) {
+	t.Helper()
+	for _, body := range bodies {
+		if w := do(s, "POST", "/clientes/1/transacoes", body); w.Code != http.StatusOK {
+			t.Fatalf("seeding %s: status %d: %s", body, w.Code, w.Body)
+		}
+	}
+}
+
+func TestStatement(t *testing.T) {
+	s := newTestServer(t, testConfig(), newFakeStore())
+	seed(t, s,
+		`{"valor": 1000, "tipo": "c", "descricao": "primeira"}`,
+		`{"valor": 300, "tipo": "d", "descricao": "segunda"}`,
+	)
+
+	st := getStatement(t, s, "/clientes/1/extrato")
+	if st.Balance.Total != "700" || st.Balance.Limit != "100000" || st.Balance.Date == "" {
+		t.Errorf("saldo = %+v, want total 700, limite 100000 and a date", st.Balance)
+	}
+	if len(st.Transactions) != 2 || st.Transactions[0].Desc != "segunda" || st.Transactions[1].Desc != "primeira" {
+		t.Errorf("ultimas_transacoes = %+v, want newest first", st.Transactions)
+	}
+
+	if w := do(s, "GET", "/clientes/6/extrato", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown customer: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestStatementLimit(t *testing.T) {
+	s := newTestServer(t, testConfig(), newFakeStore())
+	for i := 0; i < statementLimit+5; i++ {
+		seed(t, s, `{"valor": 1, "tipo": "c", "descricao": "x"}`)
+	}
+
+	st := getStatement(t, s, "/clientes/1/extrato")
+	if len(st.Transactions) != statementLimit {
+		t.Errorf("got %d transactions, want %d", len(st.Transactions), statementLimit)
+	}
+}
+
+func TestStatementCacheControl(t *testing.T) {
+	tests := []struct {
+		name   string
+		maxAge time.Duration
+		target string
+		want   string
+	}{
+		{"disabled", 0, "/clientes/1/extrato", "no-store"},
+		{"max age", 5 * time.Second, "/clientes/1/extrato", "private, max-age=5"},
+		{"summary", 5 * time.Second, "/clientes/1/extrato?summary=true", "private, max-age=5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Server.StatementMaxAge = Duration{tt.maxAge}
+			s := newTestServer(t, cfg, newFakeStore())
+
+			w := do(s, "GET", tt.target, "")
+			if got := w.Header().Get("Cache-Control"); got != tt.want {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Transactions change the balance, so they are never cached.
+	s := newTestServer(t, testConfig(), newFakeStore())
+	w := do(s, "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`)
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("transaction Cache-Control = %q, want no-store", got)
+	}
+}
+
+// parseDecimal turns a decimal amount such as "-10.50" back into cents.
+func parseDecimal(t *testing.T, s string) int {
+	t.Helper()
+	units, frac, ok := strings.Cut(strings.TrimPrefix(s, "-"), ".")
+	if !ok || len(frac) != 2 {
+		t.Fatalf("%q doesn't have two decimal places", s)
+	}
+	cents, err := strconv.Atoi(units + frac)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", s, err)
+	}
+	if strings.HasPrefix(s, "-") {
+		cents = -cents
+	}
+	return cents
+}
+
+func TestMoneyDecimal(t *testing.T) {
+	tests := []struct {
+		cents int
+		want  string
+	}{
+		{0, `"0.00"`},
+		{5, `"0.05"`},
+		{1050, `"10.50"`},
+		{-1050, `"-10.50"`},
+		{-7, `"-0.07"`},
+		{maxSafeInteger + 1, `"90071992547409.92"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			got := string(money{cents: tt.cents, format: moneyFormat{decimal: true}}.appendJSON(nil))
+			if got != tt.want {
+				t.Fatalf("rendered %d cents as %s, want %s", tt.cents, got, tt.want)
+			}
+			if back := parseDecimal(t, strings.Trim(got, `"`)); back != tt.cents {
+				t.Errorf("%s parses back to %d cents, want %d", got, back, tt.cents)
+			}
+		})
+	}
+}
+
+func TestStatementDecimal(t *testing.T) {
+	s := newTestServer(t, testConfig(), newFakeStore())
+	seed(t, s,
+		`{"valor": 1050, "tipo": "c", "descricao": "deposito"}`,
+		`{"valor": 2075, "tipo": "d", "descricao": "saque"}`,
+	)
+
+	tests := []struct {
+		target                   string
+		wantTotal, wantLimit     string
+		wantLatest, wantPrevious string
+	}{
+		{"/clientes/1/extrato", "-1025", "100000", "2075", "1050"},
+		{"/clientes/1/extrato?decimal=true", "-10.25", "1000.00", "20.75", "10.50"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			st := getStatement(t, s, tt.target)
+			if st.Balance.Total.String() != tt.wantTotal || st.Balance.Limit.String() != tt.wantLimit {
+				t.Errorf("saldo total %s, limite %s; want %s and %s", st.Balance.Total, st.Balance.Limit, tt.wantTotal, tt.wantLimit)
+			}
+			if len(st.Transactions) != 2 || st.Transactions[0].Value.String() != tt.wantLatest || st.Transactions[1].Value.String() != tt.wantPrevious {
+				t.Errorf("ultimas_transacoes = %+v, want valor %s then %s", st.Transactions, tt.wantLatest, tt.wantPrevious)
+			}
+		})
+	}
+}
+
+func TestStatementSummary(t *testing.T) {
+	tests := []struct {
+		name      string
+		seed      int
+		wantCount int
+	}{
+		{"no transactions", 0, 0},
+		{"transactions", 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			s := newTestServer(t, testConfig(), store)
+			for i := 0; i < tt.seed; i++ {
+				seed(t, s, `{"valor": 100, "tipo": "c", "descricao": "x"}`)
+			}
+
+			w := do(s, "GET", "/clientes/1/extrato?summary=true", "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			var resp struct {
+				Balance      map[string]any `json:"saldo"`
+				Transactions []any          `json:"ultimas_transacoes"`
+				Summary      struct {
+					Count int     `json:"total_transacoes"`
+					Last  *string `json:"ultima_transacao_em"`
+				} `json:"resumo"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decoding %q: %v", w.Body, err)
+			}
+			if got, want := resp.Balance["total"], float64(100*tt.seed); got != want {
+				t.Errorf("saldo total = %v, want %v", got, want)
+			}
+			if resp.Summary.Count != tt.wantCount || (resp.Summary.Last != nil) != (tt.wantCount > 0) {
+				t.Errorf("resumo = %d transactions, last %v; want %d", resp.Summary.Count, resp.Summary.Last, tt.wantCount)
+			}
+			if resp.Transactions != nil {
+				t.Errorf("summary lists transactions: %v", resp.Transactions)
+			}
+			if n := store.count("Statement"); n != 0 {
+				t.Errorf("transactions were queried %d times in summary mode", n)
+			}
+			if n := store.count("Summary"); n != 1 {
+				t.Errorf("summary was queried %d times, want 1", n)
+			}
+		})
+	}
+}
+
+func TestStatementOrder(t *testing.T) {
+	s := newTestServer(t, testConfig(), newFakeStore())
+	for i := 1; i <= statementLimit+2; i++ {
+		seed(t, s, `{"valor": 1, "tipo": "c", "descricao": "t`+strconv.Itoa(i)+`"}`)
+	}
+	seq := func(from, to int) string {
+		var descs []string
+		for i := from; ; {
+			descs = append(descs, "t"+strconv.Itoa(i))
+			if i == to {
+				return strings.Join(descs, ",")
+			}
+			if from < to {
+				i++
+			} else {
+				i--
+			}
+		}
+	}
+
+	tests := []struct {
+		target     string
+		wantStatus int
+		want       string
+	}{
+		{"/clientes/1/extrato", http.StatusOK, seq(12, 3)},
+		{"/clientes/1/extrato?order=desc", http.StatusOK, seq(12, 3)},
+		{"/clientes/1/extrato?order=asc", http.StatusOK, seq(3, 12)},
+		{"/clientes/1/extrato?order=desc&limit=3", http.StatusOK, seq(12, 10)},
+		{"/clientes/1/extrato?order=asc&limit=3", http.StatusOK, seq(10, 12)},
+		{"/clientes/1/extrato?since=5", http.StatusOK, seq(6, 12)},
+		{"/clientes/1/extrato?since=0&order=asc&limit=2", http.StatusOK, seq(1, 2)},
+		{"/clientes/1/extrato?since=5&order=desc", http.StatusUnprocessableEntity, ""},
+		{"/clientes/1/extrato?order=newest", http.StatusUnprocessableEntity, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			if tt.wantStatus != http.StatusOK {
+				if w := do(s, "GET", tt.target, ""); w.Code != tt.wantStatus {
+					t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+				}
+				return
+			}
+			st := getStatement(t, s, tt.target)
+			var descs []string
+			for _, tr := range st.Transactions {
+				descs = append(descs, tr.Desc)
+			}
+			if got := strings.Join(descs, ","); got != tt.want {
+				t.Errorf("transactions %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatementSince(t *testing.T) {
+	s := newTestServer(t, testConfig(), newFakeStore())
+	for i := 1; i <= 12; i++ {
+		seed(t, s, `{"valor": `+strconv.Itoa(i)+`, "tipo": "c", "descricao": "t`+strconv.Itoa(i)+`"}`)
+	}
+
+	tests := []struct {
+		target     string
+		wantStatus int
+		wantIDs    []int64
+	}{
+		{"/clientes/1/extrato?since=0", http.StatusOK, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{"/clientes/1/extrato?since=9", http.StatusOK, []int64{10, 11, 12}},
+		{"/clientes/1/extrato?since=9&limit=2", http.StatusOK, []int64{10, 11}},
+		{"/clientes/1/extrato?since=9&order=asc", http.StatusOK, []int64{10, 11, 12}},
+		{"/clientes/1/extrato?since=12", http.StatusOK, nil},
+		{"/clientes/1/extrato?since=1000", http.StatusOK, nil},
+		{"/clientes/1/extrato?since=3&limit=0", http.StatusOK, nil},
+		{"/clientes/1/extrato?since=-1", http.StatusUnprocessableEntity, nil},
+		{"/clientes/1/extrato?since=abc", http.StatusUnprocessableEntity, nil},
+		{"/clientes/1/extrato?since=1.5", http.StatusUnprocessableEntity, nil},
+		{"/clientes/1/extrato?since=99999999999999999999", http.StatusUnprocessableEntity, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			if tt.wantStatus != http.StatusOK {
+				if w := do(s, "GET", tt.target, ""); w.Code != tt.wantStatus {
+					t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+				}
+				return
+			}
+			st := getStatement(t, s, tt.target)
+			var ids []int64
+			for _, tr := range st.Transactions {
+				if tr.ID == nil {
+					t.Fatalf("transaction %+v without id", tr)
+				}
+				ids = append(ids, *tr.ID)
+			}
+			if !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("ids %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+
+	// Following the last id pages through the whole history once.
+	var seen []int64
+	since := int64(0)
+	for range 10 {
+		st := getStatement(t, s, "/clientes/1/extrato?limit=5&since="+strconv.FormatInt(since, 10))
+		if len(st.Transactions) == 0 {
+			break
+		}
+		for _, tr := range st.Transactions {
+			seen = append(seen, *tr.ID)
+		}
+		since = seen[len(seen)-1]
+	}
+	if len(seen) != 12 || seen[0] != 1 || seen[11] != 12 {
+		t.Errorf("paging with since saw %v, want 1 to 12", seen)
+	}
+}
+
+// statementOptionsStore records the options of every statement read.
+type statementOptionsStore struct {
+	Store
+	opts []StatementOptions
+}
+
+func (s *statementOptionsStore) Statement(ctx context.Context, customerID int, opts StatementOptions) (Statement, error) {
+	s.opts = append(s.opts, opts)
+	return s.Store.Statement(ctx, customerID, opts)
+}
+
+func TestStatementLimitZero(t *testing.T) {
+	tests := []struct {
+		target     string
+		wantStatus int
+		wantLimit  int
+	}{
+		{"/clientes/1/extrato?limit=0", http.StatusOK, 0},
+		{"/clientes/1/extrato?limit=2", http.StatusOK, 2},
+		{"/clientes/1/extrato?limit=-1", http.StatusUnprocessableEntity, 0},
+		{"/clientes/1/extrato?limit=11", http.StatusUnprocessableEntity, 0},
+		{"/clientes/1/extrato?limit=many", http.StatusUnprocessableEntity, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			store := &statementOptionsStore{Store: newFakeStore()}
+			s := newTestServer(t, testConfig(), store)
+			seed(t, s, `{"valor": 100, "tipo": "c", "descricao": "x"}`, `{"valor": 100, "tipo": "c", "descricao": "y"}`)
+
+			w := do(s, "GET", tt.target, "")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if len(store.opts) != 0 {
+					t.Error("statement read for an invalid limit")
+				}
+				return
+			}
+			if len(store.opts) != 1 || store.opts[0].Limit != tt.wantLimit {
+				t.Fatalf("statement reads = %+v, want one with limit %d", store.opts, tt.wantLimit)
+			}
+			var resp struct {
+				Transactions json.RawMessage `json:"ultimas_transacoes"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantLimit == 0 && string(resp.Transactions) != "[]" {
+				t.Errorf("ultimas_transacoes = %s, want []", resp.Transactions)
+			}
+		})
+	}
+}
+
+func TestStatementFields(t *testing.T) {
+	tests := []struct {
+		fields      string
+		wantStatus  int
+		wantKeys    string
+		wantColumns string
+	}{
+		{"", http.StatusOK, "descricao,realizada_em,tipo,valor", ""},
+		{"valor,tipo", http.StatusOK, "tipo,valor", "amount,type"},
+		{"realizada_em", http.StatusOK, "realizada_em", "created_at"},
+		{"valor,saldo", http.StatusUnprocessableEntity, "", ""},
+		{"id", http.StatusUnprocessableEntity, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fields, func(t *testing.T) {
+			store := &statementOptionsStore{Store: newFakeStore()}
+			s := newTestServer(t, testConfig(), store)
+			seed(t, s, `{"valor": 100, "tipo": "c", "descricao": "x"}`)
+			target := "/clientes/1/extrato"
+			if tt.fields != "" {
+				target += "?fields=" + tt.fields
+			}
+
+			w := do(s, "GET", target, "")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var resp struct {
+				Transactions []map[string]any `json:"ultimas_transacoes"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Transactions) != 1 {
+				t.Fatalf("got %d transactions, want 1", len(resp.Transactions))
+			}
+			var keys []string
+			for k := range resp.Transactions[0] {
+				keys = append(keys, k)
+			}
+			slices.Sort(keys)
+			if got := strings.Join(keys, ","); got != tt.wantKeys {
+				t.Errorf("transaction fields = %s, want %s", got, tt.wantKeys)
+			}
+			if got := strings.Join(store.opts[0].Columns, ","); got != tt.wantColumns {
+				t.Errorf("columns read = %q, want %q", got, tt.wantColumns)
+			}
+		})
+	}
+}
+
+func TestLargeNumbersAsStrings(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		balance int
+		want    string
+	}{
+		{"off past the boundary", false, maxSafeInteger + 1, `"total":9007199254740992`},
+		{"at the boundary", true, maxSafeInteger, `"total":9007199254740991`},
+		{"past the boundary", true, maxSafeInteger + 1, `"total":"9007199254740992"`},
+		{"negative at the boundary", true, -maxSafeInteger, `"total":-9007199254740991`},
+		{"negative past the boundary", true, -maxSafeInteger - 1, `"total":"-9007199254740992"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			store.customers[1].Balance = tt.balance
+			cfg := testConfig()
+			cfg.Server.LargeNumbersAsStrings = tt.enabled
+			s := newTestServer(t, cfg, store)
+
+			w := do(s, "GET", "/clientes/1/extrato", "")
+			if !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("body %s doesn't contain %s", w.Body, tt.want)
+			}
+			if !strings.Contains(w.Body.String(), `"limite":100000`) {
+				t.Errorf("body %s doesn't keep the small limite numeric", w.Body)
+			}
+		})
+	}
+}
+
+func TestStatementWithBalance(t *testing.T) {
+	s := newTestServer(t, testConfig(), newFakeStore())
+	seed(t, s,
+		`{"valor": 1000, "tipo": "c", "descricao": "a"}`,
+		`{"valor": 300, "tipo": "d", "descricao": "b"}`,
+		`{"valor": 2000, "tipo": "d", "descricao": "c"}`,
+		`{"valor": 50, "tipo": "c", "descricao": "d"}`,
+	)
+
+	tests := []struct {
+		target     string
+		wantStatus int
+		want       []string
+	}{
+		{"/clientes/1/extrato?withBalance=true", http.StatusOK, []string{"-1250", "-1300", "700", "1000"}},
+		{"/clientes/1/extrato?withBalance=true&order=asc", http.StatusOK, []string{"1000", "700", "-1300", "-1250"}},
+		{"/clientes/1/extrato?withBalance=true&limit=2", http.StatusOK, []string{"-1250", "-1300"}},
+		{"/clientes/1/extrato?withBalance=true&decimal=true", http.StatusOK, []string{"-12.50", "-13.00", "7.00", "10.00"}},
+		{"/clientes/1/extrato", http.StatusOK, nil},
+		{"/clientes/1/extrato?withBalance=true&since=1", http.StatusUnprocessableEntity, nil},
+		{"/clientes/1/extrato?withBalance=true&fields=valor", http.StatusOK, []string{"-1250", "-1300", "700", "1000"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			if tt.wantStatus != http.StatusOK {
+				if w := do(s, "GET", tt.target, ""); w.Code != tt.wantStatus {
+					t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+				}
+				return
+			}
+			st := getStatement(t, s, tt.target)
+			var got []string
+			for _, tr := range st.Transactions {
+				if tr.BalanceAfter != nil {
+					got = append(got, tr.BalanceAfter.String())
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("saldo_apos = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Statements are encoded into pooled buffers, so concurrent ones must not
+// see each other's bytes.
+func TestStatementBufferReuse(t *testing.T) {
+	s := newTestServer(t, testConfig(), newFakeStore())
+	for id := 1; id <= 5; id++ {
+		for i := 0; i < id; i++ {
+			do(s, "POST", "/clientes/"+strconv.Itoa(id)+"/transacoes", `{"valor": 1, "tipo": "c", "descricao": "c`+strconv.Itoa(id)+`"}`)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for id := 1; id <= 5; id++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			want := "c" + strconv.Itoa(id)
+			for i := 0; i < 50; i++ {
+				var st decodedStatement
+				w := do(s, "GET", "/clientes/"+strconv.Itoa(id)+"/extrato", "")
+				if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+					t.Errorf("decoding %q: %v", w.Body, err)
+					return
+				}
+				if st.Balance.Total.String() != strconv.Itoa(id) || len(st.Transactions) != id {
+					t.Errorf("customer %d got saldo %s with %d transactions", id, st.Balance.Total, len(st.Transactions))
+					return
+				}
+				for _, tr := range st.Transactions {
+					if tr.Desc != want {
+						t.Errorf("customer %d got a transaction of %s", id, tr.Desc)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkStatementBuffer compares encoding a statement straight to the
+// response with json.NewEncoder(w) against encoding it into a pooled buffer
+// written out afterwards, as handleStatement does. encoding/json pools its
+// own state already, so the pooled buffer pays off with appendJSON, which
+// then allocates nothing.
+func BenchmarkStatementBuffer(b *testing.B) {
+	resp := testStatementResponse(statementLimit, moneyFormat{}, false)
+	b.Run("encoder per response", func(b *testing.B) {
+		b.ReportAllocs()
+		w := httptest.NewRecorder()
+		for i := 0; i < b.N; i++ {
+			w.Body.Reset()
+			json.NewEncoder(w).Encode(resp)
+		}
+	})
+	b.Run("pooled buffer", func(b *testing.B) {
+		b.ReportAllocs()
+		w := httptest.NewRecorder()
+		for i := 0; i < b.N; i++ {
+			w.Body.Reset()
+			buf := statementBufferPool.Get().(*bytes.Buffer)
+			json.NewEncoder(buf).Encode(resp)
+			w.Write(buf.Bytes())
+			releaseBuffer(&statementBufferPool, buf)
+		}
+	})
+	b.Run("pooled buffer appendJSON", func(b *testing.B) {
+		b.ReportAllocs()
+		w := httptest.NewRecorder()
+		for i := 0; i < b.N; i++ {
+			w.Body.Reset()
+			buf := statementBufferPool.Get().(*bytes.Buffer)
+			buf.Write(resp.appendJSON(buf.AvailableBuffer()))
+			w.Write(buf.Bytes())
+			releaseBuffer(&statementBufferPool, buf)
+		}
+	})
+}
+
+func TestStatementRowsReturned(t *testing.T) {
+	tests := []struct {
+		name     string
+		seeded   int
+		targets  []string
+		cacheTTL time.Duration
+		// wantObserved are the row counts observed, one per statement read
+		// from the store.
+		wantObserved []int
+	}{
+		{"no transactions", 0, []string{"/clientes/1/extrato"}, 0, []int{0}},
+		{"a few", 3, []string{"/clientes/1/extrato"}, 0, []int{3}},
+		{"more than the limit", 12, []string{"/clientes/1/extrato"}, 0, []int{statementLimit}},
+		{"explicit limit", 5, []string{"/clientes/1/extrato?limit=2"}, 0, []int{2}},
+		{"two reads", 4, []string{"/clientes/1/extrato", "/clientes/1/extrato?limit=1"}, 0, []int{4, 1}},
+		{"cache hit", 4, []string{"/clientes/1/extrato", "/clientes/1/extrato"}, time.Minute, []int{4}},
+		{"summary", 4, []string{"/clientes/1/extrato?summary=true"}, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Server.StatementCacheTTL = Duration{tt.cacheTTL}
+			s := newTestServer(t, cfg, newFakeStore())
+			for range tt.seeded {
+				seed(t, s, `{"valor": 1, "tipo": "c", "descricao": "x"}`)
+			}
+			before := collectOne(t, statementRowsReturned).Histogram
+
+			for _, target := range tt.targets {
+				if w := do(s, "GET", target, ""); w.Code != http.StatusOK {
+					t.Fatalf("GET %s: status %d: %s", target, w.Code, w.Body)
+				}
+			}
+
+			after := collectOne(t, statementRowsReturned).Histogram
+			wantSum := 0
+			for _, n := range tt.wantObserved {
+				wantSum += n
+			}
+			if got := after.GetSampleCount() - before.GetSampleCount(); got != uint64(len(tt.wantObserved)) {
+				t.Errorf("observed %d statements, want %d", got, len(tt.wantObserved))
+			}
+			if got := after.GetSampleSum() - before.GetSampleSum(); got != float64(wantSum) {
+				t.Errorf("observed %v rows in total, want %d", got, wantSum)
+			}
+		})
+	}
+}
+
+func TestStatementPretty(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		fastJSON   bool
+		cacheTTL   time.Duration
+		wantIndent bool
+	}{
+		{"default", "/clientes/1/extrato", false, 0, false},
+		{"pretty", "/clientes/1/extrato?pretty=true", false, 0, true},
+		{"pretty false", "/clientes/1/extrato?pretty=false", false, 0, false},
+		{"pretty summary", "/clientes/1/extrato?pretty=true&summary=true", false, 0, true},
+		{"summary", "/clientes/1/extrato?summary=true", false, 0, false},
+		{"pretty fast json", "/clientes/1/extrato?pretty=true", true, 0, true},
+		{"pretty from the cache", "/clientes/1/extrato?pretty=true", false, time.Minute, true},
+		{"compact from the cache", "/clientes/1/extrato", false, time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Server.FastJSON = tt.fastJSON
+			cfg.Server.StatementCacheTTL = Duration{tt.cacheTTL}
+			s := newTestServer(t, cfg, newFakeStore())
+			seed(t, s, `{"valor": 1000, "tipo": "c", "descricao": "x"}`)
+			if tt.cacheTTL > 0 {
+				// Fill the cache with the other rendering first.
+				do(s, "GET", "/clientes/1/extrato?pretty="+strconv.FormatBool(!tt.wantIndent), "")
+			}
+			size := httpResponseSize.WithLabelValues("/clientes/{id}/extrato").(prometheus.Histogram)
+			before := collectOne(t, size).Histogram
+
+			w := do(s, "GET", tt.target, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			body := w.Body.Bytes()
+			if !json.Valid(body) {
+				t.Fatalf("invalid JSON: %s", body)
+			}
+			if indented := bytes.Contains(body, []byte("\n  \"saldo\"")); indented != tt.wantIndent {
+				t.Errorf("indented = %v, want %v:\n%s", indented, tt.wantIndent, body)
+			}
+			var compact bytes.Buffer
+			json.Compact(&compact, body)
+			if trimmed := bytes.TrimSpace(body); tt.wantIndent == (compact.Len() == len(trimmed)) {
+				t.Errorf("body is %d bytes, %d compacted", len(trimmed), compact.Len())
+			}
+
+			after := collectOne(t, size).Histogram
+			if got := after.GetSampleSum() - before.GetSampleSum(); got != float64(len(body)) {
+				t.Errorf("http_response_size_bytes observed %v bytes, want %d", got, len(body))
+			}
+		})
+	}
+}
+
+func TestStatementLastModified(t *testing.T) {
+	t1 := time.Date(2024, 1, 2, 10, 0, 0, 500_000_000, time.UTC)
+	t2 := t1.Add(2 * time.Second)
+	const (
+		h1 = "Tue, 02 Jan 2024 10:00:00 GMT"
+		h2 = "Tue, 02 Jan 2024 10:00:02 GMT"
+	)
+	// The steps run in order; credit, when set, is the time the customer is
+	// modified at by a credit before the request.
+	steps := []struct {
+		name             string
+		credit           time.Time
+		ifModifiedSince  string
+		wantStatus       int
+		wantLastModified string
+	}{
+		{"never modified", time.Time{}, "", http.StatusOK, ""},
+		{"after a credit", t1, "", http.StatusOK, h1},
+		{"not modified since", time.Time{}, h1, http.StatusNotModified, h1},
+		{"modified since", time.Time{}, "Tue, 02 Jan 2024 09:59:59 GMT", http.StatusOK, h1},
+		{"after another credit", t2, h1, http.StatusOK, h2},
+		{"not modified since the last", time.Time{}, h2, http.StatusNotModified, h2},
+		{"invalid date", time.Time{}, "yesterday", http.StatusOK, h2},
+	}
+	for _, ttl := range []time.Duration{0, time.Minute} {
+		t.Run("cache "+ttl.String(), func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Server.StatementCacheTTL = Duration{ttl}
+			store := newFakeStore()
+			s := newTestServer(t, cfg, store)
+
+			for _, st := range steps {
+				if !st.credit.IsZero() {
+					seed(t, s, `{"valor": 1, "tipo": "c", "descricao": "x"}`)
+					store.mu.Lock()
+					store.modified[1] = st.credit
+					store.mu.Unlock()
+				}
+				var header []string
+				if st.ifModifiedSince != "" {
+					header = []string{"If-Modified-Since", st.ifModifiedSince}
+				}
+
+				w := do(s, "GET", "/clientes/1/extrato", "", header...)
+				if w.Code != st.wantStatus {
+					t.Fatalf("%s: status = %d, want %d", st.name, w.Code, st.wantStatus)
+				}
+				if got := w.Header().Get("Last-Modified"); got != st.wantLastModified {
+					t.Errorf("%s: Last-Modified = %q, want %q", st.name, got, st.wantLastModified)
+				}
+				if st.wantStatus == http.StatusNotModified && w.Body.Len() != 0 {
+					t.Errorf("%s: 304 with a body: %s", st.name, w.Body)
+				}
+			}
+		})
+	}
+}
+
+// slowStatementStore takes delay to read statements and summaries, giving
+// up when ctx is done as a query would, and records whether ctx had a
+// deadline.
+type slowStatementStore struct {
+	Store
+	delay time.Duration
+
+	mu          sync.Mutex
+	deadlineSet []bool
+}
+
+func (s *slowStatementStore) wait(ctx context.Context) error {
+	_, ok := ctx.Deadline()
+	s.mu.Lock()
+	s.deadlineSet = append(s.deadlineSet, ok)
+	s.mu.Unlock()
+	select {
+	case <-time.After(s.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *slowStatementStore) Statement(ctx context.Context, customerID int, opts StatementOptions) (Statement, error) {
+	if err := s.wait(ctx); err != nil {
+		return Statement{}, err
+	}
+	return s.Store.Statement(ctx, customerID, opts)
+}
+
+func (s *slowStatementStore) Summary(ctx context.Context, customerID int) (Summary, error) {
+	if err := s.wait(ctx); err != nil {
+		return Summary{}, err
+	}
+	return s.Store.Summary(ctx, customerID)
+}
+
+func (s *slowStatementStore) Credit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	if err := s.wait(ctx); err != nil {
+		return TransactionResult{}, err
+	}
+	return s.Store.Credit(ctx, customerID, value, desc)
+}
+
+func TestStatementQueryTimeout(t *testing.T) {
+	tests := []struct {
+		name                 string
+		timeout, delay       time.Duration
+		method, target, body string
+		wantStatus           int
+		wantDeadline         bool
+	}{
+		{"no timeout", 0, 50 * time.Millisecond, "GET", "/clientes/1/extrato", "", http.StatusOK, false},
+		{"within timeout", time.Second, 0, "GET", "/clientes/1/extrato", "", http.StatusOK, true},
+		{"statement over timeout", 20 * time.Millisecond, time.Second, "GET", "/clientes/1/extrato", "", http.StatusServiceUnavailable, true},
+		{"summary over timeout", 20 * time.Millisecond, time.Second, "GET", "/clientes/1/extrato?summary=true", "", http.StatusServiceUnavailable, true},
+		// Transactions aren't bound by the read timeout.
+		{"credit slower than timeout", 20 * time.Millisecond, 50 * time.Millisecond, "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`, http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Server.StatementQueryTimeout = Duration{tt.timeout}
+			store := &slowStatementStore{Store: newFakeStore(), delay: tt.delay}
+			s := newTestServer(t, cfg, store)
+
+			start := time.Now()
+			w := do(s, tt.method, tt.target, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusServiceUnavailable {
+				if elapsed := time.Since(start); elapsed > tt.delay/2 {
+					t.Errorf("answered after %s, past the %s timeout", elapsed, tt.timeout)
+				}
+				if w.Header().Get("Retry-After") == "" {
+					t.Error("503 without Retry-After")
+				}
+			}
+			if len(store.deadlineSet) != 1 || store.deadlineSet[0] != tt.wantDeadline {
+				t.Errorf("deadlines set = %v, want [%v]", store.deadlineSet, tt.wantDeadline)
+			}
+		})
+	}
+}
+
+func TestJSONEncodeDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		fastJSON bool
+		cacheTTL time.Duration
+		storeErr error
+		// requests is how many times target is fetched, once if zero.
+		requests  int
+		wantCount uint64
+	}{
+		{name: "statement", target: "/clientes/1/extrato", wantCount: 1},
+		{name: "fast json", target: "/clientes/1/extrato", fastJSON: true, wantCount: 1},
+		{name: "projected fields", target: "/clientes/1/extrato?fields=valor,tipo", wantCount: 1},
+		{name: "each request", target: "/clientes/1/extrato", requests: 3, wantCount: 3},
+		{name: "cached", target: "/clientes/1/extrato", cacheTTL: time.Minute, requests: 3, wantCount: 1},
+		{name: "summary", target: "/clientes/1/extrato?summary=true", wantCount: 0},
+		{name: "store failure", target: "/clientes/1/extrato", storeErr: context.DeadlineExceeded, wantCount: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Server.FastJSON = tt.fastJSON
+			cfg.Server.StatementCacheTTL = Duration{tt.cacheTTL}
+			store := newFakeStore()
+			s := newTestServer(t, cfg, store)
+			seed(t, s, `{"valor": 1000, "tipo": "c", "descricao": "primeira"}`)
+			store.failWith("Statement", tt.storeErr)
+			before := collectOne(t, jsonEncodeDuration).Histogram
+
+			for range max(tt.requests, 1) {
+				do(s, "GET", tt.target, "")
+			}
+			after := collectOne(t, jsonEncodeDuration).Histogram
+			if got := after.GetSampleCount() - before.GetSampleCount(); got != tt.wantCount {
+				t.Errorf("json_encode_duration_seconds observed %d times, want %d", got, tt.wantCount)
+			}
+			if tt.wantCount > 0 && after.GetSampleSum() <= before.GetSampleSum() {
+				t.Errorf("json_encode_duration_seconds sum went from %v to %v, want it to grow", before.GetSampleSum(), after.GetSampleSum())
+			}
+		})
+	}
+}
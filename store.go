@@ -0,0 +1,745 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Store is what the handlers need from the database.
+type Store interface {
+	Credit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error)
+	Debit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error)
+	// ApplyIfBalance runs a credit (typ "c") or debit (typ "d") only if the
+	// balance is still expected, returning errBalanceMismatch otherwise.
+	ApplyIfBalance(ctx context.Context, customerID, value int, typ, desc string, expected int) (TransactionResult, error)
+	// Statement returns the balance and the last transactions, newest first.
+	Statement(ctx context.Context, customerID int, opts StatementOptions) (Statement, error)
+	// Summary returns the balance with aggregates over the transactions,
+	// without reading them.
+	Summary(ctx context.Context, customerID int) (Summary, error)
+	// TransactionCount returns how many transactions the customer has. It's
+	// read on the way to applying a transaction, so unlike Summary it isn't
+	// capped by DB_MAX_CONCURRENT_READS.
+	TransactionCount(ctx context.Context, customerID int) (int, error)
+	// ExportTransactions calls fn with every transaction of the customer,
+	// oldest first, reading them in chunks so memory doesn't grow with the
+	// history. An error from fn stops the export and is returned.
+	ExportTransactions(ctx context.Context, customerID int, fn func(Transaction) error) error
+	// BeginBatch starts a DB transaction for applying many operations at
+	// once, as done by the NDJSON stream endpoint.
+	BeginBatch(ctx context.Context) (Batch, error)
+
+	CreateCustomer(ctx context.Context, limit int, currency string) (int64, error)
+	// CustomerCurrency returns the currency the customer's account is in.
+	CustomerCurrency(ctx context.Context, customerID int) (string, error)
+	// ResetCustomer zeroes the balance, and deletes the transactions if
+	// clearTransactions is set, returning the customer as left.
+	ResetCustomer(ctx context.Context, customerID int, clearTransactions bool) (Customer, error)
+	ListCustomers(ctx context.Context) ([]Customer, error)
+	// Balances returns the customers among ids, in no particular order,
+	// leaving out the ids that don't exist.
+	Balances(ctx context.Context, ids []int) ([]Customer, error)
+
+	Ping(ctx context.Context) error
+	// ReplicaLag returns how far behind the replica is, or nil if the
+	// replica hasn't replayed anything yet.
+	ReplicaLag(ctx context.Context) (*time.Duration, error)
+}
+
+// Batch applies operations inside a single DB transaction.
+type Batch interface {
+	// Apply runs a credit (typ "c") or debit (typ "d"). A failed operation
+	// doesn't affect the ones already applied in the batch.
+	Apply(ctx context.Context, customerID, value int, typ, desc string) (TransactionResult, error)
+	// TransactionCount is Store.TransactionCount read within the batch, so
+	// it includes the operations already applied.
+	TransactionCount(ctx context.Context, customerID int) (int, error)
+	Commit(ctx context.Context) error
+	Rollback(ctx context.Context) error
+}
+
+type TransactionResult struct {
+	Balance int
+	Limit   int
+	// Applied is false when the operation was rejected by the business
+	// rules, e.g. a debit above the limit.
+	Applied bool
+	// ID is the id of the transaction created, zero if not applied.
+	ID int64
+	// Duplicate is set when this is the result of an identical operation
+	// that came earlier, and nothing was applied this time.
+	Duplicate bool
+}
+
+type Transaction struct {
+	// ID is only read for StatementOptions.Since, zero otherwise.
+	ID          int64
+	Value       int
+	Type        string
+	Description string
+	CreatedAt   time.Time
+}
+
+type Statement struct {
+	Balance  int
+	Limit    int
+	Currency string
+	// LastModified is when the balance last changed.
+	LastModified time.Time
+	Transactions []Transaction
+}
+
+type StatementOptions struct {
+	// Limit is how many transactions to read. Zero reads only the balance.
+	Limit int
+	// Columns lists the transactions columns to read, from amount, type,
+	// description and created_at. Empty reads all of them.
+	Columns []string
+	// Since, when set, reads the transactions with an id above it, oldest
+	// first, instead of the last ones, along with their id.
+	Since *int64
+}
+
+type Summary struct {
+	Balance          int
+	Limit            int
+	Currency         string
+	TransactionCount int
+	// LastTransactionAt is nil when the customer has no transactions.
+	LastTransactionAt *time.Time
+}
+
+type Customer struct {
+	ID       int
+	Limit    int
+	Balance  int
+	Currency string
+}
+
+var errInconsistentBalance = errors.New("balance below limit after debit")
+
+var errBalanceMismatch = errors.New("balance differs from the expected one")
+
+// statusForDBError maps an error returned by the database to the HTTP status
+// that best describes it to the client. Errors that are safe to retry, such
+// as lock_timeout or the database being unreachable, map to 503.
+func statusForDBError(err error) int {
+	if errors.Is(err, errQueueFull) || errors.Is(err, errWorkerPoolClosed) || errors.Is(err, errCustomerBusy) || errors.Is(err, errRetryBudgetExhausted) || errors.Is(err, errReadsBusy) {
+		return http.StatusServiceUnavailable
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusServiceUnavailable
+	}
+
+	if isConnectionError(err) {
+		return http.StatusServiceUnavailable
+	}
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return http.StatusInternalServerError
+	}
+	switch pgErr.Code {
+	case "55P03", // lock_not_available
+		"57014", // query_canceled
+		"40001", // serialization_failure
+		"40P01": // deadlock_detected
+		return http.StatusServiceUnavailable
+	}
+	switch sqlStateClass(pgErr.Code) {
+	case "22", // data exception
+		"23": // integrity constraint violation
+		return http.StatusUnprocessableEntity
+	case "08", // connection exception
+		"53", // insufficient resources
+		"57": // operator intervention
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// isConnectionError reports whether err comes from failing to reach the
+// database, either while the pool establishes a connection or from the
+// connection exception class, rather than from a query.
+func isConnectionError(err error) bool {
+	var connErr *pgconn.ConnectError
+	if errors.As(err, &connErr) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && sqlStateClass(pgErr.Code) == "08"
+}
+
+// sqlStateClass returns the class of a SQLSTATE code, its first two
+// characters, or "" when code is too short to have one.
+func sqlStateClass(code string) string {
+	if len(code) < 2 {
+		return ""
+	}
+	return code[:2]
+}
+
+// isConnectionLost reports whether err means the database went away, as when
+// Postgres restarts: besides failing to connect, connections already in the
+// pool break mid-query or are terminated by the shutdown.
+//
+// Timeouts are not a lost connection: a slow query hitting its deadline must
+// not open the reconnect window, so context and pgconn timeout errors, which
+// also satisfy net.Error, are left out.
+func isConnectionLost(err error) bool {
+	if isConnectionError(err) {
+		return true
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || pgconn.Timeout(err) {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && !opErr.Timeout() {
+		return true
+	}
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "57P01", // admin_shutdown
+			"57P02", // crash_shutdown
+			"57P03": // cannot_connect_now
+			return true
+		}
+	}
+	return false
+}
+
+// writeStoreError is where every error returned by the Store ends up. The
+// client only gets the status from statusForDBError and an empty body, as
+// the error itself may carry SQL or schema details; it is logged instead.
+//
+// Once the connection to the database is lost, errors that would be 500 are
+// answered with 503 for the reconnect window, as the pool throws away the
+// broken connections in the meantime with errors of all sorts.
+func (s *Server) writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	code := statusForDBError(err)
+	if isConnectionError(err) {
+		dbConnectionErrorTotal.Inc()
+	}
+	now := time.Now()
+	if isConnectionLost(err) {
+		s.reconnectingUntil.Store(now.Add(s.cfg.DB.ReconnectWindow.Duration).UnixNano())
+	}
+	if code == http.StatusInternalServerError && now.UnixNano() < s.reconnectingUntil.Load() {
+		code = http.StatusServiceUnavailable
+	}
+	s.Logger.Error("store error", "method", r.Method, "path", r.URL.Path, "err", err)
+	if code == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+	var detail string
+	switch code {
+	case http.StatusNotFound:
+		detail = "customer not found"
+	case http.StatusServiceUnavailable:
+		detail = "the database is busy, retry later"
+	}
+	writeError(w, r, code, "", detail)
+}
+
+// pgStore is the Store backed by the credit/debit functions in db.sql.
+type pgStore struct {
+	db      *pgxpool.Pool
+	replica *pgxpool.Pool
+	// shards, when set, are sub-pools customers are spread across by
+	// consistent hashing, db being the first of them.
+	shards []*pgxpool.Pool
+
+	// strict re-checks the balance against the limit after each debit,
+	// rolling it back if the invariant doesn't hold.
+	strict bool
+	// orderBy is the column statements read the latest transactions by,
+	// "id" or "created_at".
+	orderBy string
+}
+
+// acquire takes a connection from the pool of customerID, zero for operations
+// not tied to a customer, observing how long it waited in dbAcquireDuration.
+// Going through it rather than the pool methods keeps the wait apart from the
+// query time.
+func (s *pgStore) acquire(ctx context.Context, customerID int) (*pgxpool.Conn, error) {
+	start := time.Now()
+	conn, err := s.pool(customerID).Acquire(ctx)
+	dbAcquireDuration.Observe(time.Since(start).Seconds())
+	return conn, err
+}
+
+// pool returns the sub-pool customerID is sharded to, or db without shards
+// or customer.
+func (s *pgStore) pool(customerID int) *pgxpool.Pool {
+	if len(s.shards) == 0 || customerID == 0 {
+		return s.db
+	}
+	return s.shards[jumpHash(uint64(customerID), len(s.shards))]
+}
+
+// jumpHash is the jump consistent hash of Lamping and Veach: it maps key to
+// one of n buckets so that going from n to n+1 only moves 1/(n+1) of the
+// keys, the ones that land in the new bucket.
+func jumpHash(key uint64, n int) int {
+	var b, j int64 = -1, 0
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+func (s *pgStore) Credit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	var res TransactionResult
+	conn, err := s.acquire(ctx, customerID)
+	if err != nil {
+		return res, err
+	}
+	defer conn.Release()
+
+	err = conn.QueryRow(ctx, "SELECT * FROM credit($1, $2, $3)", customerID, value, desc).Scan(&res.Balance, &res.Applied, &res.Limit, &res.ID)
+	return res, err
+}
+
+func (s *pgStore) Debit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	if s.strict {
+		return s.debitChecked(ctx, customerID, value, desc)
+	}
+
+	var res TransactionResult
+	conn, err := s.acquire(ctx, customerID)
+	if err != nil {
+		return res, err
+	}
+	defer conn.Release()
+
+	err = conn.QueryRow(ctx, "SELECT * FROM debit($1, $2, $3)", customerID, value, desc).Scan(&res.Balance, &res.Applied, &res.Limit, &res.ID)
+	return res, err
+}
+
+// debitChecked runs the debit function and, within the same DB transaction,
+// re-reads the customer to make sure the balance didn't go below the limit.
+// On violation the debit is rolled back and errInconsistentBalance returned.
+func (s *pgStore) debitChecked(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	var res TransactionResult
+	conn, err := s.acquire(ctx, customerID)
+	if err != nil {
+		return res, err
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, "SELECT * FROM debit($1, $2, $3)", customerID, value, desc).Scan(&res.Balance, &res.Applied, &res.Limit, &res.ID)
+	if err != nil || !res.Applied {
+		return res, err
+	}
+
+	var balance, limit int
+	err = tx.QueryRow(ctx, "SELECT balance, \"limit\" FROM customers WHERE id = $1", customerID).Scan(&balance, &limit)
+	if err != nil {
+		return res, err
+	}
+	if balance < -limit {
+		return TransactionResult{Balance: balance, Limit: limit}, errInconsistentBalance
+	}
+
+	return res, tx.Commit(ctx)
+}
+
+func (s *pgStore) ApplyIfBalance(ctx context.Context, customerID, value int, typ, desc string, expected int) (TransactionResult, error) {
+	var res TransactionResult
+	conn, err := s.acquire(ctx, customerID)
+	if err != nil {
+		return res, err
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Taking the lock credit and debit take keeps the balance from changing
+	// between the check and the operation. They take it again, which is a
+	// no-op within the same transaction.
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", customerID); err != nil {
+		return res, err
+	}
+	err = tx.QueryRow(ctx, "SELECT balance, \"limit\" FROM customers WHERE id = $1", customerID).Scan(&res.Balance, &res.Limit)
+	if err != nil {
+		return res, err
+	}
+	if res.Balance != expected {
+		return res, errBalanceMismatch
+	}
+
+	fn := "debit"
+	if typ == "c" {
+		fn = "credit"
+	}
+	err = tx.QueryRow(ctx, "SELECT * FROM "+fn+"($1, $2, $3)", customerID, value, desc).Scan(&res.Balance, &res.Applied, &res.Limit, &res.ID)
+	if err != nil || !res.Applied {
+		return res, err
+	}
+	return res, tx.Commit(ctx)
+}
+
+// transactionColumns maps each column of transactions a statement can read to
+// the Transaction field it is scanned into.
+var transactionColumns = map[string]func(*Transaction) any{
+	"amount":      func(t *Transaction) any { return &t.Value },
+	"type":        func(t *Transaction) any { return &t.Type },
+	"description": func(t *Transaction) any { return &t.Description },
+	"created_at":  func(t *Transaction) any { return &t.CreatedAt },
+	"id":          func(t *Transaction) any { return &t.ID },
+}
+
+var allTransactionColumns = []string{"amount", "type", "description", "created_at"}
+
+// latestTransactionsQuery selects columns of the latest transactions of
+// customer $1, at most $2 of them. The ORDER BY matches the index db.sql
+// documents for orderBy column for column, so Postgres reads the index in
+// order and stops at the limit instead of sorting. Ties on created_at are
+// broken by id.
+func latestTransactionsQuery(columns []string, orderBy string) string {
+	order := "id DESC"
+	if orderBy == "created_at" {
+		order = "created_at DESC, id DESC"
+	}
+	return "SELECT " + strings.Join(columns, ", ") + " FROM transactions WHERE customer_id = $1 ORDER BY " + order + " LIMIT $2"
+}
+
+func (s *pgStore) Statement(ctx context.Context, customerID int, opts StatementOptions) (Statement, error) {
+	var st Statement
+	conn, err := s.acquire(ctx, customerID)
+	if err != nil {
+		return st, err
+	}
+	defer conn.Release()
+
+	if opts.Limit == 0 {
+		st.Transactions = make([]Transaction, 0)
+		err := conn.QueryRow(ctx, "SELECT \"limit\", balance, currency, updated_at FROM customers WHERE id = $1", customerID).Scan(&st.Limit, &st.Balance, &st.Currency, &st.LastModified)
+		return st, err
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return st, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, "SELECT \"limit\", balance, currency, updated_at FROM customers WHERE id = $1", customerID).Scan(&st.Limit, &st.Balance, &st.Currency, &st.LastModified)
+	if err != nil {
+		return st, err
+	}
+
+	columns := opts.Columns
+	if len(columns) == 0 {
+		columns = allTransactionColumns
+	}
+	for _, c := range columns {
+		if transactionColumns[c] == nil {
+			return st, fmt.Errorf("unknown transactions column %q", c)
+		}
+	}
+	var rows pgx.Rows
+	if opts.Since != nil {
+		columns = append(slices.Clip(columns), "id")
+		rows, err = tx.Query(ctx, "SELECT "+strings.Join(columns, ", ")+" FROM transactions WHERE customer_id = $1 AND id > $3 ORDER BY id LIMIT $2", customerID, opts.Limit, *opts.Since)
+	} else {
+		rows, err = tx.Query(ctx, latestTransactionsQuery(columns, s.orderBy), customerID, opts.Limit)
+	}
+	if err != nil {
+		return st, err
+	}
+	defer rows.Close()
+
+	st.Transactions = make([]Transaction, 0)
+	dest := make([]any, len(columns))
+	for rows.Next() {
+		var t Transaction
+		for i, c := range columns {
+			dest[i] = transactionColumns[c](&t)
+		}
+		rows.Scan(dest...)
+		st.Transactions = append(st.Transactions, t)
+	}
+	if err := rows.Err(); err != nil {
+		return st, err
+	}
+
+	return st, tx.Commit(ctx)
+}
+
+func (s *pgStore) Summary(ctx context.Context, customerID int) (Summary, error) {
+	var sum Summary
+	conn, err := s.acquire(ctx, customerID)
+	if err != nil {
+		return sum, err
+	}
+	defer conn.Release()
+
+	err = conn.QueryRow(ctx, `
+		SELECT c."limit", c.balance, c.currency, count(t.id), max(t.created_at)
+		FROM customers c
+		LEFT JOIN transactions t ON t.customer_id = c.id
+		WHERE c.id = $1
+		GROUP BY c.id`, customerID).Scan(&sum.Limit, &sum.Balance, &sum.Currency, &sum.TransactionCount, &sum.LastTransactionAt)
+	return sum, err
+}
+
+func (s *pgStore) TransactionCount(ctx context.Context, customerID int) (int, error) {
+	var n int
+	conn, err := s.acquire(ctx, customerID)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	err = conn.QueryRow(ctx, "SELECT count(*) FROM transactions WHERE customer_id = $1", customerID).Scan(&n)
+	return n, err
+}
+
+// exportFetchSize is how many rows each FETCH of the export cursor reads.
+const exportFetchSize = 500
+
+func (s *pgStore) ExportTransactions(ctx context.Context, customerID int, fn func(Transaction) error) error {
+	conn, err := s.acquire(ctx, customerID)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var exists int
+	if err := tx.QueryRow(ctx, "SELECT 1 FROM customers WHERE id = $1", customerID).Scan(&exists); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, "DECLARE export NO SCROLL CURSOR FOR SELECT amount, type, description, created_at FROM transactions WHERE customer_id = $1 ORDER BY id", customerID)
+	if err != nil {
+		return err
+	}
+	for {
+		rows, err := tx.Query(ctx, "FETCH "+strconv.Itoa(exportFetchSize)+" FROM export")
+		if err != nil {
+			return err
+		}
+		n := 0
+		for rows.Next() {
+			var t Transaction
+			if err := rows.Scan(&t.Value, &t.Type, &t.Description, &t.CreatedAt); err != nil {
+				rows.Close()
+				return err
+			}
+			if err := fn(t); err != nil {
+				rows.Close()
+				return err
+			}
+			n++
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if n < exportFetchSize {
+			return tx.Commit(ctx)
+		}
+	}
+}
+
+func (s *pgStore) BeginBatch(ctx context.Context) (Batch, error) {
+	conn, err := s.acquire(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		conn.Release()
+		return nil, err
+	}
+	return &pgBatch{conn: conn, tx: tx}, nil
+}
+
+func (s *pgStore) CreateCustomer(ctx context.Context, limit int, currency string) (int64, error) {
+	var id int64
+	conn, err := s.acquire(ctx, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	err = conn.QueryRow(ctx, "INSERT INTO customers (\"limit\", currency) VALUES ($1, $2) RETURNING id", limit, currency).Scan(&id)
+	return id, err
+}
+
+func (s *pgStore) ListCustomers(ctx context.Context) ([]Customer, error) {
+	conn, err := s.acquire(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT id, \"limit\", balance, currency FROM customers ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	customers := make([]Customer, 0)
+	for rows.Next() {
+		var c Customer
+		rows.Scan(&c.ID, &c.Limit, &c.Balance, &c.Currency)
+		customers = append(customers, c)
+	}
+	return customers, rows.Err()
+}
+
+func (s *pgStore) Balances(ctx context.Context, ids []int) ([]Customer, error) {
+	conn, err := s.acquire(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT id, \"limit\", balance, currency FROM customers WHERE id = ANY($1)", ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	customers := make([]Customer, 0, len(ids))
+	for rows.Next() {
+		var c Customer
+		rows.Scan(&c.ID, &c.Limit, &c.Balance, &c.Currency)
+		customers = append(customers, c)
+	}
+	return customers, rows.Err()
+}
+
+func (s *pgStore) CustomerCurrency(ctx context.Context, customerID int) (string, error) {
+	var currency string
+	conn, err := s.acquire(ctx, customerID)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Release()
+
+	err = conn.QueryRow(ctx, "SELECT currency FROM customers WHERE id = $1", customerID).Scan(&currency)
+	return currency, err
+}
+
+func (s *pgStore) ResetCustomer(ctx context.Context, customerID int, clearTransactions bool) (Customer, error) {
+	c := Customer{ID: customerID}
+	conn, err := s.acquire(ctx, customerID)
+	if err != nil {
+		return c, err
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return c, err
+	}
+	defer tx.Rollback(ctx)
+
+	// The same lock credit and debit take, so none runs halfway through.
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", customerID); err != nil {
+		return c, err
+	}
+	err = tx.QueryRow(ctx, "UPDATE customers SET balance = 0, updated_at = now() WHERE id = $1 RETURNING \"limit\", balance, currency", customerID).Scan(&c.Limit, &c.Balance, &c.Currency)
+	if err != nil {
+		return c, err
+	}
+	if clearTransactions {
+		if _, err := tx.Exec(ctx, "DELETE FROM transactions WHERE customer_id = $1", customerID); err != nil {
+			return c, err
+		}
+	}
+	return c, tx.Commit(ctx)
+}
+
+func (s *pgStore) Ping(ctx context.Context) error {
+	return s.db.Ping(ctx)
+}
+
+func (s *pgStore) ReplicaLag(ctx context.Context) (*time.Duration, error) {
+	var lag *time.Duration
+	err := s.replica.QueryRow(ctx, "SELECT now() - pg_last_xact_replay_timestamp()").Scan(&lag)
+	return lag, err
+}
+
+// pgBatch holds its connection until the batch is committed or rolled back.
+type pgBatch struct {
+	conn *pgxpool.Conn
+	tx   pgx.Tx
+}
+
+func (b *pgBatch) Apply(ctx context.Context, customerID, value int, typ, desc string) (TransactionResult, error) {
+	var res TransactionResult
+
+	// Each operation runs in its own savepoint so a failing statement does
+	// not abort the ones already applied in this batch.
+	sp, err := b.tx.Begin(ctx)
+	if err != nil {
+		return res, err
+	}
+	defer sp.Rollback(ctx)
+
+	fn := "debit"
+	if typ == "c" {
+		fn = "credit"
+	}
+	err = sp.QueryRow(ctx, "SELECT * FROM "+fn+"($1, $2, $3)", customerID, value, desc).Scan(&res.Balance, &res.Applied, &res.Limit, &res.ID)
+	if err != nil || !res.Applied {
+		return res, err
+	}
+	return res, sp.Commit(ctx)
+}
+
+func (b *pgBatch) TransactionCount(ctx context.Context, customerID int) (int, error) {
+	var n int
+	err := b.tx.QueryRow(ctx, "SELECT count(*) FROM transactions WHERE customer_id = $1", customerID).Scan(&n)
+	return n, err
+}
+
+func (b *pgBatch) Commit(ctx context.Context) error {
+	defer b.conn.Release()
+	return b.tx.Commit(ctx)
+}
+
+func (b *pgBatch) Rollback(ctx context.Context) error {
+	defer b.conn.Release()
+	return b.tx.Rollback(ctx)
+}
@@ -0,0 +1,760 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// testPgStore connects to the database of TEST_DATABASE_URL, which must
+// have been set up with db.sql, skipping the test when it isn't set.
+func testPgStore(t *testing.T) *pgStore {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := pgxpool.New(context.Background(), url)
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	t.Cleanup(db.Close)
+	return &pgStore{db: db, orderBy: "id"}
+}
+
+func TestPgStoreUnknownCustomer(t *testing.T) {
+	store := testPgStore(t)
+	ctx := context.Background()
+	const unknown = 1 << 30
+
+	if _, err := store.Credit(ctx, unknown, 1, "x"); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("Credit: err = %v, want pgx.ErrNoRows", err)
+	}
+	if _, err := store.Debit(ctx, unknown, 1, "x"); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("Debit: err = %v, want pgx.ErrNoRows", err)
+	}
+	n, err := store.TransactionCount(ctx, unknown)
+	if err != nil || n != 0 {
+		t.Errorf("TransactionCount = %d, %v; want no transactions left behind", n, err)
+	}
+}
+
+func TestPgStoreStrictDebit(t *testing.T) {
+	store := testPgStore(t)
+	store.strict = true
+	ctx := context.Background()
+
+	c, err := store.ResetCustomer(ctx, 2, true)
+	if err != nil {
+		t.Fatalf("ResetCustomer: %v", err)
+	}
+	res, err := store.Debit(ctx, 2, c.Limit, "limite")
+	if err != nil || !res.Applied || res.Balance != -c.Limit {
+		t.Fatalf("debit up to the limit = %+v, %v; want applied with saldo %d", res, err, -c.Limit)
+	}
+	res, err = store.Debit(ctx, 2, 1, "acima")
+	if err != nil || res.Applied {
+		t.Errorf("debit over the limit = %+v, %v; want refused", res, err)
+	}
+}
+
+func TestPoolConfigTimeoutsApplied(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	cfg := testConfig()
+	cfg.DB.URL = url
+	cfg.DB.LockTimeout = Duration{250 * time.Millisecond}
+	cfg.DB.StatementTimeout = Duration{2 * time.Second}
+	s := newTestServer(t, cfg, newFakeStore())
+	pc, err := s.poolConfig()
+	if err != nil {
+		t.Fatalf("poolConfig: %v", err)
+	}
+	db, err := pgxpool.NewWithConfig(context.Background(), pc)
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	defer db.Close()
+
+	for setting, want := range map[string]string{"lock_timeout": "250ms", "statement_timeout": "2s"} {
+		var got string
+		if err := db.QueryRow(context.Background(), "SHOW "+setting).Scan(&got); err != nil {
+			t.Fatalf("SHOW %s: %v", setting, err)
+		}
+		if got != want {
+			t.Errorf("%s = %s, want %s", setting, got, want)
+		}
+	}
+}
+
+func TestStatementTimeoutAborts(t *testing.T) {
+	tests := []struct {
+		name       string
+		timeout    time.Duration
+		wantStatus int
+	}{
+		{"over the timeout", 100 * time.Millisecond, http.StatusServiceUnavailable},
+		{"within the timeout", 5 * time.Second, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := testPgStore(t)
+			ctx := context.Background()
+			id, err := store.CreateCustomer(ctx, 1000, "BRL")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := testConfig()
+			cfg.DB.URL = os.Getenv("TEST_DATABASE_URL")
+			cfg.DB.StatementTimeout = Duration{tt.timeout}
+			pc, err := newTestServer(t, cfg, newFakeStore()).poolConfig()
+			if err != nil {
+				t.Fatalf("poolConfig: %v", err)
+			}
+			db, err := pgxpool.NewWithConfig(ctx, pc)
+			if err != nil {
+				t.Fatalf("connecting: %v", err)
+			}
+			defer db.Close()
+			s := newTestServer(t, cfg, &pgStore{db: db, orderBy: "id"})
+
+			// The credit waits on the customer's row, locked here for
+			// longer than the short timeout.
+			tx, err := store.db.Begin(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback(ctx)
+			if _, err := tx.Exec(ctx, "SELECT 1 FROM customers WHERE id = $1 FOR UPDATE", id); err != nil {
+				t.Fatal(err)
+			}
+			release := time.AfterFunc(time.Second, func() { tx.Rollback(ctx) })
+			defer release.Stop()
+
+			w := do(s, "POST", "/clientes/"+strconv.FormatInt(id, 10)+"/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestDrainPool(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      time.Duration
+		timeout    time.Duration
+		wantActive int32
+	}{
+		{"query finishes", 300 * time.Millisecond, 5 * time.Second, 0},
+		{"deadline passes", 2 * time.Second, 100 * time.Millisecond, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := testPgStore(t).db
+			s := &Server{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+			done := make(chan error, 1)
+			go func() {
+				_, err := pool.Exec(context.Background(), "SELECT pg_sleep($1)", tt.query.Seconds())
+				done <- err
+			}()
+			for pool.Stat().AcquiredConns() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			s.drainPool(pool, tt.timeout)
+			if got := pool.Stat().AcquiredConns(); got != tt.wantActive {
+				t.Errorf("active connections after draining = %d, want %d", got, tt.wantActive)
+			}
+			if tt.wantActive == 0 {
+				select {
+				case err := <-done:
+					if err != nil {
+						t.Errorf("query in flight: %v", err)
+					}
+				default:
+					t.Error("drain returned before the query in flight")
+				}
+			}
+			<-done
+		})
+	}
+}
+
+func TestStatusForDBError(t *testing.T) {
+	pgErr := func(code string) error { return fmt.Errorf("query: %w", &pgconn.PgError{Code: code}) }
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"unique violation", pgErr("23505"), http.StatusUnprocessableEntity},
+		{"check violation", pgErr("23514"), http.StatusUnprocessableEntity},
+		{"numeric out of range", pgErr("22003"), http.StatusUnprocessableEntity},
+		{"too many connections", pgErr("53300"), http.StatusServiceUnavailable},
+		{"connection failure", pgErr("08006"), http.StatusServiceUnavailable},
+		{"admin shutdown", pgErr("57P01"), http.StatusServiceUnavailable},
+		{"lock timeout", pgErr("55P03"), http.StatusServiceUnavailable},
+		{"statement timeout", pgErr("57014"), http.StatusServiceUnavailable},
+		{"serialization failure", pgErr("40001"), http.StatusServiceUnavailable},
+		{"deadlock", pgErr("40P01"), http.StatusServiceUnavailable},
+		{"syntax error", pgErr("42601"), http.StatusInternalServerError},
+		{"undefined function", pgErr("42883"), http.StatusInternalServerError},
+		{"empty code", pgErr(""), http.StatusInternalServerError},
+		{"one character code", pgErr("0"), http.StatusInternalServerError},
+		{"no rows", fmt.Errorf("customer: %w", pgx.ErrNoRows), http.StatusNotFound},
+		{"deadline", context.DeadlineExceeded, http.StatusServiceUnavailable},
+		{"queue full", errQueueFull, http.StatusServiceUnavailable},
+		{"other", errors.New("boom"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statusForDBError(tt.err); got != tt.want {
+				t.Errorf("statusForDBError(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlersMapDBErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		failing string
+		code    string
+		want    int
+	}{
+		{"transaction constraint", "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`, "Credit", "23514", http.StatusUnprocessableEntity},
+		{"transaction out of connections", "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "d", "descricao": "x"}`, "Debit", "53300", http.StatusServiceUnavailable},
+		{"transaction syntax error", "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`, "Credit", "42601", http.StatusInternalServerError},
+		{"statement out of connections", "GET", "/clientes/1/extrato", "", "Statement", "53300", http.StatusServiceUnavailable},
+		{"statement syntax error", "GET", "/clientes/1/extrato", "", "Statement", "42601", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			store.failWith(tt.failing, &pgconn.PgError{Code: tt.code})
+			s := newTestServer(t, testConfig(), store)
+
+			w := do(s, tt.method, tt.target, tt.body)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoreErrorsNotLeaked(t *testing.T) {
+	leaked := &pgconn.PgError{
+		Code:    "42P01",
+		Message: `relation "transactions" does not exist`,
+		Where:   "PL/pgSQL function credit(integer,integer,character varying) line 7",
+	}
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		failing string
+	}{
+		{"transaction", "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`, "Credit"},
+		{"statement", "GET", "/clientes/1/extrato", "", "Statement"},
+		{"stream", "POST", "/clientes/1/transacoes/stream", ndjson(1), "Batch.Commit"},
+	}
+	for _, tt := range tests {
+		for _, accept := range []string{"application/json", "application/problem+json"} {
+			t.Run(tt.name+" "+accept, func(t *testing.T) {
+				store := newFakeStore()
+				store.failWith(tt.failing, fmt.Errorf("applying: %w", leaked))
+				var logs bytes.Buffer
+				s, err := NewServer(testConfig(),
+					WithStore(store),
+					WithRegistry(prometheus.NewRegistry()),
+					WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer s.close()
+
+				w := do(s, tt.method, tt.target, tt.body, "Accept", accept)
+				if w.Code != http.StatusInternalServerError {
+					t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+				}
+				for _, text := range []string{"relation", "transactions", "credit(", "42P01", "applying"} {
+					if strings.Contains(w.Body.String(), text) {
+						t.Errorf("response %s leaks %q", w.Body, text)
+					}
+				}
+				if !strings.Contains(logs.String(), "does not exist") {
+					t.Errorf("error not logged in full: %s", logs.String())
+				}
+			})
+		}
+	}
+}
+
+func TestDBConnectionErrorTotal(t *testing.T) {
+	// Nothing listens on port 1, so acquiring a connection fails.
+	unreachable, err := pgxpool.New(context.Background(), "postgres://rinha@127.0.0.1:1/rinha?connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unreachable.Close()
+	failing := func(err error) Store {
+		store := newFakeStore()
+		store.failWith("Credit", err)
+		return store
+	}
+
+	tests := []struct {
+		name       string
+		store      Store
+		wantStatus int
+		want       float64
+	}{
+		{"acquire", &pgStore{db: unreachable, orderBy: "id"}, http.StatusServiceUnavailable, 1},
+		{"connection exception", failing(&pgconn.PgError{Code: "08006"}), http.StatusServiceUnavailable, 1},
+		{"query error", failing(&pgconn.PgError{Code: "42601"}), http.StatusInternalServerError, 0},
+		{"applied", newFakeStore(), http.StatusOK, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, testConfig(), tt.store)
+			before := counterValue(t, dbConnectionErrorTotal)
+
+			w := do(s, "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := counterValue(t, dbConnectionErrorTotal) - before; got != tt.want {
+				t.Errorf("db_connection_errors_total went up by %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// queryRecorder is a pgx tracer keeping the SQL of every query.
+type queryRecorder struct {
+	mu      sync.Mutex
+	queries []string
+}
+
+func (r *queryRecorder) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queries = append(r.queries, data.SQL)
+	return ctx
+}
+
+func (r *queryRecorder) TraceQueryEnd(context.Context, *pgx.Conn, pgx.TraceQueryEndData) {}
+
+func TestPgStoreStatementLimitZero(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	tests := []struct {
+		limit           int
+		wantTransaction bool
+	}{
+		{0, false},
+		{10, true},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.limit), func(t *testing.T) {
+			pc, err := pgxpool.ParseConfig(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := &queryRecorder{}
+			pc.ConnConfig.Tracer = rec
+			db, err := pgxpool.NewWithConfig(context.Background(), pc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			store := &pgStore{db: db, orderBy: "id"}
+
+			st, err := store.Statement(context.Background(), 1, StatementOptions{Limit: tt.limit})
+			if err != nil {
+				t.Fatalf("Statement: %v", err)
+			}
+			if tt.limit == 0 && (st.Transactions == nil || len(st.Transactions) != 0) {
+				t.Errorf("transactions = %#v, want an empty slice", st.Transactions)
+			}
+			queried := false
+			for _, q := range rec.queries {
+				if strings.Contains(q, "FROM transactions") {
+					queried = true
+				}
+			}
+			if queried != tt.wantTransaction {
+				t.Errorf("transactions queried = %v, want %v; queries: %q", queried, tt.wantTransaction, rec.queries)
+			}
+		})
+	}
+}
+
+// silentListener accepts connections and never answers on them, like a
+// database too busy to get to new clients, until the test ends.
+func silentListener(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestDBAcquireDuration(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	tests := []struct {
+		name     string
+		url      string
+		requests int
+		// minWait is the least time each acquire should be observed waiting.
+		minWait time.Duration
+	}{
+		// Nothing listens on port 1, so acquiring fails right away.
+		{"unreachable", "postgres://rinha@127.0.0.1:1/rinha?connect_timeout=1", 1, 0},
+		// The only connection never becomes ready, so every acquire waits
+		// until its context is done.
+		{"saturated", "postgres://rinha@" + silentListener(t) + "/rinha?connect_timeout=1&pool_max_conns=1", 3, timeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := pgxpool.New(context.Background(), tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			store := &pgStore{db: db, orderBy: "id"}
+			before := collectOne(t, dbAcquireDuration).Histogram
+
+			var wg sync.WaitGroup
+			for range tt.requests {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ctx, cancel := context.WithTimeout(context.Background(), timeout)
+					defer cancel()
+					if _, err := store.Credit(ctx, 1, 1, "x"); err == nil {
+						t.Error("credit succeeded without a database")
+					}
+				}()
+			}
+			wg.Wait()
+
+			after := collectOne(t, dbAcquireDuration).Histogram
+			if got := after.GetSampleCount() - before.GetSampleCount(); got != uint64(tt.requests) {
+				t.Errorf("observed %d acquires, want %d", got, tt.requests)
+			}
+			waited := time.Duration((after.GetSampleSum() - before.GetSampleSum()) * float64(time.Second))
+			if min := time.Duration(tt.requests) * tt.minWait; waited < min {
+				t.Errorf("observed %s waiting in total, want at least %s", waited, min)
+			}
+			if waited > time.Duration(tt.requests)*(timeout+time.Second) {
+				t.Errorf("observed %s waiting in total, more than the requests took", waited)
+			}
+		})
+	}
+}
+
+func TestJumpHash(t *testing.T) {
+	const keys = 10000
+	for _, n := range []int{1, 2, 3, 8, 16} {
+		t.Run(strconv.Itoa(n), func(t *testing.T) {
+			counts := make([]int, n)
+			for key := range uint64(keys) {
+				b := jumpHash(key, n)
+				if b < 0 || b >= n {
+					t.Fatalf("jumpHash(%d, %d) = %d, out of range", key, n, b)
+				}
+				if again := jumpHash(key, n); again != b {
+					t.Fatalf("jumpHash(%d, %d) = %d, then %d", key, n, b, again)
+				}
+				counts[b]++
+
+				// Growing to n+1 buckets only moves keys to the new one.
+				if grown := jumpHash(key, n+1); grown != b && grown != n {
+					t.Fatalf("key %d moved from %d to %d going to %d buckets", key, b, grown, n+1)
+				}
+			}
+			for b, c := range counts {
+				if want := keys / n; c < want*8/10 || c > want*12/10 {
+					t.Errorf("bucket %d got %d keys, want about %d", b, c, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPgStorePool(t *testing.T) {
+	var pools []*pgxpool.Pool
+	for range 4 {
+		// Nothing listens on port 1, which pools only find out on use.
+		pool, err := pgxpool.New(context.Background(), "postgres://rinha@127.0.0.1:1/rinha")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pool.Close()
+		pools = append(pools, pool)
+	}
+
+	tests := []struct {
+		name   string
+		store  *pgStore
+		wantDB bool
+	}{
+		{"single pool", &pgStore{db: pools[0]}, true},
+		{"sharded", &pgStore{db: pools[0], shards: pools}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.store.pool(0); got != pools[0] {
+				t.Error("operations without a customer don't use the first pool")
+			}
+			used := make(map[*pgxpool.Pool]bool)
+			for id := 1; id <= 100; id++ {
+				p := tt.store.pool(id)
+				for range 3 {
+					if tt.store.pool(id) != p {
+						t.Fatalf("customer %d maps to different pools", id)
+					}
+				}
+				if tt.wantDB && p != pools[0] {
+					t.Fatalf("customer %d doesn't use the only pool", id)
+				}
+				if !tt.wantDB && p != pools[jumpHash(uint64(id), len(pools))] {
+					t.Fatalf("customer %d isn't in the shard it hashes to", id)
+				}
+				used[p] = true
+			}
+			if want := len(tt.store.shards); want > 0 && len(used) != want {
+				t.Errorf("100 customers spread over %d shards, want %d", len(used), want)
+			}
+		})
+	}
+}
+
+func TestIsConnectionLost(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, connectErr := pgconn.Connect(ctx, "postgres://rinha@127.0.0.1:1/rinha")
+	if connectErr == nil {
+		t.Fatal("connected to port 1")
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connect error", connectErr, true},
+		{"connection exception", &pgconn.PgError{Code: "08006"}, true},
+		{"admin shutdown", &pgconn.PgError{Code: "57P01"}, true},
+		{"crash shutdown", &pgconn.PgError{Code: "57P02"}, true},
+		{"cannot connect now", &pgconn.PgError{Code: "57P03"}, true},
+		{"connection reset", &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, true},
+		{"closed connection", net.ErrClosed, true},
+		{"unexpected EOF", fmt.Errorf("reading: %w", io.ErrUnexpectedEOF), true},
+		{"EOF", io.EOF, true},
+		{"deadline exceeded", context.DeadlineExceeded, false},
+		{"canceled", context.Canceled, false},
+		{"network timeout", &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, false},
+		{"query canceled", &pgconn.PgError{Code: "57014"}, false},
+		{"serialization failure", &pgconn.PgError{Code: "40001"}, false},
+		{"no rows", pgx.ErrNoRows, false},
+		{"other", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isConnectionLost(tt.err); got != tt.want {
+				t.Errorf("isConnectionLost(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconnectWindow(t *testing.T) {
+	const window = 100 * time.Millisecond
+	// The steps run in order, each making Credit fail with err, or succeed
+	// when it's nil, then waiting for wait. wantStatus is with the window,
+	// wantWithout with it disabled.
+	steps := []struct {
+		name                    string
+		err                     error
+		wait                    time.Duration
+		wantStatus, wantWithout int
+	}{
+		{"healthy", nil, 0, http.StatusOK, http.StatusOK},
+		{"unrelated error before the bounce", errors.New("boom"), 0, http.StatusInternalServerError, http.StatusInternalServerError},
+		{"database shutting down", &pgconn.PgError{Code: "57P01"}, 0, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"connection dropped", io.ErrUnexpectedEOF, 0, http.StatusServiceUnavailable, http.StatusInternalServerError},
+		{"error while reconnecting", errors.New("conn busy"), 0, http.StatusServiceUnavailable, http.StatusInternalServerError},
+		{"recovered", nil, 0, http.StatusOK, http.StatusOK},
+		{"still within the window", errors.New("conn busy"), window + 20*time.Millisecond, http.StatusServiceUnavailable, http.StatusInternalServerError},
+		{"after the window", errors.New("boom"), 0, http.StatusInternalServerError, http.StatusInternalServerError},
+		{"healthy again", nil, 0, http.StatusOK, http.StatusOK},
+	}
+	for _, window := range []time.Duration{window, 0} {
+		t.Run("window "+window.String(), func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DB.ReconnectWindow = Duration{window}
+			store := newFakeStore()
+			s := newTestServer(t, cfg, store)
+
+			for _, st := range steps {
+				store.failWith("Credit", st.err)
+				w := do(s, "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`)
+				want := st.wantStatus
+				if window == 0 {
+					want = st.wantWithout
+				}
+				if w.Code != want {
+					t.Errorf("%s: status = %d, want %d", st.name, w.Code, want)
+				}
+				if w.Code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+					t.Errorf("%s: 503 without Retry-After", st.name)
+				}
+				time.Sleep(st.wait)
+			}
+		})
+	}
+}
+
+func TestPgStoreBalances(t *testing.T) {
+	store := testPgStore(t)
+	ctx := context.Background()
+	id, err := store.CreateCustomer(ctx, 1000, "BRL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	customerID := int(id)
+	if _, err := store.Debit(ctx, customerID, 10, "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	const unknown = 1 << 30
+	got, err := store.Balances(ctx, []int{customerID, unknown})
+	if err != nil {
+		t.Fatalf("Balances: %v", err)
+	}
+	want := Customer{ID: customerID, Limit: 1000, Balance: -10, Currency: "BRL"}
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("Balances = %+v, want only %+v", got, want)
+	}
+}
+
+func TestLatestTransactionsQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		columns []string
+		orderBy string
+		want    string
+	}{
+		{"by id", allTransactionColumns, "id", "SELECT amount, type, description, created_at FROM transactions WHERE customer_id = $1 ORDER BY id DESC LIMIT $2"},
+		{"by created_at", allTransactionColumns, "created_at", "SELECT amount, type, description, created_at FROM transactions WHERE customer_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2"},
+		{"projected by id", []string{"amount", "id"}, "id", "SELECT amount, id FROM transactions WHERE customer_id = $1 ORDER BY id DESC LIMIT $2"},
+		{"projected by created_at", []string{"type"}, "created_at", "SELECT type FROM transactions WHERE customer_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := latestTransactionsQuery(tt.columns, tt.orderBy); got != tt.want {
+				t.Errorf("query = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLatestTransactionsQueryUsesIndex(t *testing.T) {
+	tests := []struct {
+		orderBy string
+		index   string
+	}{
+		{"id", "CREATE INDEX IF NOT EXISTS idx_transactions_id ON transactions (customer_id, id DESC) INCLUDE (amount, type, description, created_at)"},
+		{"created_at", "CREATE INDEX IF NOT EXISTS idx_transactions_created_at ON transactions (customer_id, created_at DESC, id DESC) INCLUDE (amount, type, description)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.orderBy, func(t *testing.T) {
+			store := testPgStore(t)
+			ctx := context.Background()
+			if _, err := store.db.Exec(ctx, tt.index); err != nil {
+				t.Fatalf("creating the index: %v", err)
+			}
+			tx, err := store.db.Begin(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback(ctx)
+			// The test table is too small for the planner to prefer an
+			// index on its own.
+			if _, err := tx.Exec(ctx, "SET LOCAL enable_seqscan = off"); err != nil {
+				t.Fatal(err)
+			}
+
+			rows, err := tx.Query(ctx, "EXPLAIN "+latestTransactionsQuery(allTransactionColumns, tt.orderBy), 1, 10)
+			if err != nil {
+				t.Fatalf("EXPLAIN: %v", err)
+			}
+			var plan []string
+			for rows.Next() {
+				var line string
+				rows.Scan(&line)
+				plan = append(plan, line)
+			}
+			if err := rows.Err(); err != nil {
+				t.Fatal(err)
+			}
+			joined := strings.Join(plan, "\n")
+			if strings.Contains(joined, "Sort") || !strings.Contains(joined, "Index") {
+				t.Errorf("plan sorts instead of reading the index in order:\n%s", joined)
+			}
+		})
+	}
+}
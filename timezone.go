@@ -0,0 +1,10 @@
+package main
+
+import "time"
+
+// now returns the current time in the configured location. The location is
+// swapped when the config is reloaded, so it's kept on the Server rather
+// than in time.Local.
+func (s *Server) now() time.Time {
+	return time.Now().In(s.location.Load())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+var errTransactionLimit = errors.New("customer reached the maximum number of transactions")
+
+// transactionCapStore rejects credits and debits of customers that already
+// have max transactions. The count is read before the operation without
+// locking, so concurrent requests of the same customer may go slightly past
+// the cap.
+type transactionCapStore struct {
+	Store
+	max int
+}
+
+func (s *transactionCapStore) Credit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	if err := s.check(ctx, customerID); err != nil {
+		return TransactionResult{}, err
+	}
+	return s.Store.Credit(ctx, customerID, value, desc)
+}
+
+func (s *transactionCapStore) Debit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	if err := s.check(ctx, customerID); err != nil {
+		return TransactionResult{}, err
+	}
+	return s.Store.Debit(ctx, customerID, value, desc)
+}
+
+func (s *transactionCapStore) ApplyIfBalance(ctx context.Context, customerID, value int, typ, desc string, expected int) (TransactionResult, error) {
+	if err := s.check(ctx, customerID); err != nil {
+		return TransactionResult{}, err
+	}
+	return s.Store.ApplyIfBalance(ctx, customerID, value, typ, desc, expected)
+}
+
+func (s *transactionCapStore) check(ctx context.Context, customerID int) error {
+	n, err := s.Store.TransactionCount(ctx, customerID)
+	if err != nil {
+		return err
+	}
+	if n >= s.max {
+		return errTransactionLimit
+	}
+	return nil
+}
+
+func (s *transactionCapStore) BeginBatch(ctx context.Context) (Batch, error) {
+	b, err := s.Store.BeginBatch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &transactionCapBatch{Batch: b, max: s.max}, nil
+}
+
+// transactionCapBatch checks the cap on every Apply, counting within the
+// batch so the operations it already applied are included.
+type transactionCapBatch struct {
+	Batch
+	max int
+}
+
+func (b *transactionCapBatch) Apply(ctx context.Context, customerID, value int, typ, desc string) (TransactionResult, error) {
+	n, err := b.Batch.TransactionCount(ctx, customerID)
+	if err != nil {
+		return TransactionResult{}, err
+	}
+	if n >= b.max {
+		return TransactionResult{}, errTransactionLimit
+	}
+	return b.Batch.Apply(ctx, customerID, value, typ, desc)
+}
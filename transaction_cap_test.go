@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTransactionCap(t *testing.T) {
+	tests := []struct {
+		name       string
+		max        int
+		seed       int
+		body       string
+		wantStatus int
+	}{
+		{"disabled", 0, 5, `{"valor": 1, "tipo": "c", "descricao": "x"}`, http.StatusOK},
+		{"below the cap", 5, 4, `{"valor": 1, "tipo": "c", "descricao": "x"}`, http.StatusOK},
+		{"credit at the cap", 5, 5, `{"valor": 1, "tipo": "c", "descricao": "x"}`, http.StatusUnprocessableEntity},
+		{"debit at the cap", 5, 5, `{"valor": 1, "tipo": "d", "descricao": "x"}`, http.StatusUnprocessableEntity},
+		{"expected balance at the cap", 5, 5, `{"valor": 1, "tipo": "c", "descricao": "x", "saldo_esperado": 5}`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			cfg := testConfig()
+			cfg.Transactions.MaxPerCustomer = tt.max
+			s := newTestServer(t, cfg, store)
+			for i := 0; i < tt.seed; i++ {
+				seed(t, s, `{"valor": 1, "tipo": "c", "descricao": "x"}`)
+			}
+
+			w := do(s, "POST", "/clientes/1/transacoes", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if want := `{"erro": "transaction_limit_reached"}`; w.Body.String() != want {
+					t.Errorf("body = %s, want %s", w.Body, want)
+				}
+				if n := len(store.transactions[1]); n != tt.seed {
+					t.Errorf("%d transactions after a rejection, want %d", n, tt.seed)
+				}
+			}
+		})
+	}
+}
+
+func TestTransactionCapStream(t *testing.T) {
+	tests := []struct {
+		name         string
+		seed         int
+		lines        int
+		wantApplied  int
+		wantRejected int
+	}{
+		{"room for all", 0, 4, 4, 0},
+		{"reaches the cap", 3, 4, 2, 2},
+		{"already at the cap", 5, 4, 0, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			cfg := testConfig()
+			cfg.Transactions.MaxPerCustomer = 5
+			s := newTestServer(t, cfg, store)
+			for i := 0; i < tt.seed; i++ {
+				seed(t, s, `{"valor": 1, "tipo": "c", "descricao": "x"}`)
+			}
+
+			w := do(s, "POST", "/clientes/1/transacoes/stream", ndjson(tt.lines))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			var got streamCounts
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding %q: %v", w.Body, err)
+			}
+			if got.Applied != tt.wantApplied || got.Rejected != tt.wantRejected {
+				t.Errorf("counts = %+v, want %d applied and %d rejected", got, tt.wantApplied, tt.wantRejected)
+			}
+			if n := len(store.transactions[1]); n > 5 {
+				t.Errorf("customer has %d transactions, past the cap of 5", n)
+			}
+		})
+	}
+}
+
+// Group commit applies credits and debits through batches, so the cap has
+// to hold there as well.
+func TestTransactionCapGroupCommit(t *testing.T) {
+	store := newFakeStore()
+	cfg := testConfig()
+	cfg.Transactions.MaxPerCustomer = 2
+	cfg.Transactions.GroupCommitWindow = Duration{time.Millisecond}
+	s := newTestServer(t, cfg, store)
+
+	codes := make([]int, 4)
+	for i := range codes {
+		codes[i] = do(s, "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`).Code
+	}
+	want := []int{http.StatusOK, http.StatusOK, http.StatusUnprocessableEntity, http.StatusUnprocessableEntity}
+	if !slices.Equal(codes, want) {
+		t.Errorf("statuses = %v, want %v", codes, want)
+	}
+	if n := len(store.transactions[1]); n != 2 {
+		t.Errorf("customer has %d transactions, want the cap of 2", n)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build embedtzdata
+
+package main
+
+// Building with -tags embedtzdata embeds the timezone database in the binary,
+// so the timezone loads even in images without /usr/share/zoneinfo. It adds
+// about 450KB to the binary, which is why it's opt-in; the Dockerfile copies
+// the system zoneinfo instead.
+import _ "time/tzdata"
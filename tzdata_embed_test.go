@@ -0,0 +1,49 @@
+//go:build embedtzdata
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestEmbeddedTZData finds America/Sao_Paulo in the zip time/tzdata links
+// into the binary and loads it from there. time.LoadLocation can't be made
+// to skip the host's zoneinfo, so it would pass without the embedded copy.
+func TestEmbeddedTZData(t *testing.T) {
+	const zone = "America/Sao_Paulo"
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := os.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The zip stores its files uncompressed, so the local header of the
+	// zone, its name and its data appear as they are. The needle is built
+	// at run time, so the binary doesn't contain it as a constant.
+	needle := append([]byte(zone), "TZif"...)
+	i := bytes.Index(bin, needle)
+	header := i - 30
+	if i < 0 || header < 0 || !bytes.HasPrefix(bin[header:], []byte("PK\x03\x04")) {
+		t.Fatal(zone + " isn't in the binary, is time/tzdata linked in?")
+	}
+	size := int(binary.LittleEndian.Uint32(bin[header+18:]))
+	nameLen := int(binary.LittleEndian.Uint16(bin[header+26:]))
+	extraLen := int(binary.LittleEndian.Uint16(bin[header+28:]))
+	start := header + 30 + nameLen + extraLen
+	if nameLen != len(zone) || start+size > len(bin) {
+		t.Fatalf("malformed zip entry for %s", zone)
+	}
+
+	loc, err := time.LoadLocationFromTZData(zone, bin[start:start+size])
+	if err != nil {
+		t.Fatalf("loading the embedded %s: %v", zone, err)
+	}
+	checkSaoPaulo(t, loc)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSaoPauloLocation loads the location from wherever the host has it;
+// TestEmbeddedTZData, built with -tags embedtzdata, checks the copy embedded
+// in the binary.
+func TestSaoPauloLocation(t *testing.T) {
+	loc, err := time.LoadLocation("America/Sao_Paulo")
+	if err != nil {
+		t.Fatalf("loading America/Sao_Paulo: %v", err)
+	}
+	checkSaoPaulo(t, loc)
+}
+
+// checkSaoPaulo checks the offsets of loc against those of
+// America/Sao_Paulo.
+func checkSaoPaulo(t *testing.T, loc *time.Location) {
+	t.Helper()
+	tests := []struct {
+		at         time.Time
+		wantOffset int
+	}{
+		{time.Date(2024, 1, 17, 12, 0, 0, 0, time.UTC), -3 * 60 * 60},
+		{time.Date(2024, 7, 17, 12, 0, 0, 0, time.UTC), -3 * 60 * 60},
+		// Daylight saving time was observed until 2019.
+		{time.Date(2018, 1, 17, 12, 0, 0, 0, time.UTC), -2 * 60 * 60},
+	}
+	for _, tt := range tests {
+		if _, offset := tt.at.In(loc).Zone(); offset != tt.wantOffset {
+			t.Errorf("offset at %s = %ds, want %ds", tt.at, offset, tt.wantOffset)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// recentValidationFailuresSize bounds how many validation failures are kept
+// for /debug/validation.
+const recentValidationFailuresSize = 1024
+
+type validationFailure struct {
+	reason string
+	at     time.Time
+}
+
+// failureRing is a fixed-size ring of the latest validation failures, the
+// oldest overwritten first, for a quick look without going through
+// Prometheus.
+type failureRing struct {
+	mu      sync.Mutex
+	entries [recentValidationFailuresSize]validationFailure
+	next    int
+	full    bool
+}
+
+func (f *failureRing) add(reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries[f.next] = validationFailure{reason: reason, at: time.Now()}
+	f.next = (f.next + 1) % len(f.entries)
+	if f.next == 0 {
+		f.full = true
+	}
+}
+
+// counts returns how many of the kept failures there are per reason, and
+// the time of the oldest, zero if there are none.
+func (f *failureRing) counts() (map[string]int, time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entries := f.entries[:f.next]
+	oldest := 0
+	if f.full {
+		entries = f.entries[:]
+		oldest = f.next
+	}
+	counts := make(map[string]int)
+	for _, e := range entries {
+		counts[e.reason]++
+	}
+	if len(entries) == 0 {
+		return counts, time.Time{}
+	}
+	return counts, f.entries[oldest].at
+}
+
+// handleValidationDebug serves the counts by reason of the last validation
+// failures of transaction requests.
+func (s *Server) handleValidationDebug(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Counts map[string]int `json:"counts"`
+		// Since is when the oldest failure counted happened.
+		Since *string `json:"since"`
+	}
+
+	counts, oldest := s.validationFailures.counts()
+	resp := response{Counts: counts}
+	if !oldest.IsZero() {
+		since := oldest.In(s.location.Load()).Format(time.RFC3339Nano)
+		resp.Since = &since
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
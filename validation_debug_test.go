@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestValidationDebug(t *testing.T) {
+	tests := []struct {
+		name       string
+		bodies     []string
+		wantCounts map[string]int
+	}{
+		{"none", nil, map[string]int{}},
+		{"by reason", []string{
+			`{"valor": 0, "tipo": "c", "descricao": "x"}`,
+			`{"valor": -5, "tipo": "c", "descricao": "x"}`,
+			`{"valor": 1, "tipo": "x", "descricao": "x"}`,
+			`{"valor": 1, "tipo": "c", "descricao": "muito longa demais"}`,
+			`{"valor": 1, "tipo": "c"}`,
+			`{"valor": `,
+			`{"valor": "1", "tipo": "c", "descricao": "x"}`,
+		}, map[string]int{"value": 2, "type": 1, "descricao": 1, "descricao_required": 1, "syntax": 1, "decode": 1}},
+		{"not counting business rejections", []string{
+			`{"valor": 1, "tipo": "c", "descricao": "x"}`,
+			`{"valor": 1000000, "tipo": "d", "descricao": "x"}`,
+			`{"valor": 0, "tipo": "c", "descricao": "x"}`,
+		}, map[string]int{"value": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Server.APIKey = "admin"
+			s := newTestServer(t, cfg, newFakeStore())
+			start := time.Now()
+			for _, body := range tt.bodies {
+				do(s, "POST", "/clientes/1/transacoes", body)
+			}
+
+			w := do(s, "GET", "/debug/validation", "", "X-API-Key", "admin")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			var got struct {
+				Counts map[string]int `json:"counts"`
+				Since  *string        `json:"since"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding %q: %v", w.Body, err)
+			}
+			if !maps.Equal(got.Counts, tt.wantCounts) {
+				t.Errorf("counts = %v, want %v", got.Counts, tt.wantCounts)
+			}
+			if len(tt.wantCounts) == 0 {
+				if got.Since != nil {
+					t.Errorf("since = %s without failures, want null", *got.Since)
+				}
+				return
+			}
+			if got.Since == nil {
+				t.Fatal("since is null with failures")
+			}
+			since, err := time.Parse(time.RFC3339Nano, *got.Since)
+			if err != nil || since.Before(start.Truncate(time.Second)) {
+				t.Errorf("since = %s, want the time of the first failure", *got.Since)
+			}
+		})
+	}
+}
+
+func TestValidationDebugGuard(t *testing.T) {
+	tests := []struct {
+		name       string
+		adminKey   string
+		key        string
+		wantStatus int
+	}{
+		{"admin key", "admin", "admin", http.StatusOK},
+		{"wrong key", "admin", "nope", http.StatusUnauthorized},
+		{"no key", "admin", "", http.StatusUnauthorized},
+		{"no admin key configured", "", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Server.APIKey = tt.adminKey
+			s := newTestServer(t, cfg, newFakeStore())
+			if w := do(s, "GET", "/debug/validation", "", "X-API-Key", tt.key); w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestFailureRing(t *testing.T) {
+	const size = recentValidationFailuresSize
+	tests := []struct {
+		name       string
+		added      int
+		wantCounts map[string]int
+	}{
+		{"empty", 0, map[string]int{}},
+		{"partly filled", 3, map[string]int{"r0": 1, "r1": 1, "r2": 1}},
+		{"exactly full", size, map[string]int{"r0": size / 2, "r1": size / 2}},
+		// Past the size, the ten r2 added last overwrite the ten oldest.
+		{"wrapped", size + 10, map[string]int{"r0": size/2 - 5, "r1": size/2 - 5, "r2": 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f failureRing
+			for i := range tt.added {
+				reason := "r" + strconv.Itoa(i%2)
+				if tt.added < size {
+					reason = "r" + strconv.Itoa(i)
+				}
+				if i >= size {
+					reason = "r2"
+				}
+				f.add(reason)
+			}
+			counts, oldest := f.counts()
+			if !maps.Equal(counts, tt.wantCounts) {
+				t.Errorf("counts = %v, want %v", counts, tt.wantCounts)
+			}
+			if (tt.added == 0) != oldest.IsZero() {
+				t.Errorf("oldest = %s with %d added", oldest, tt.added)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	errQueueFull        = errors.New("transaction queue is full")
+	errWorkerPoolClosed = errors.New("worker pool is stopped")
+)
+
+// workerPoolStore runs credits and debits on a fixed number of workers, so
+// the number of concurrent transactions hitting the database doesn't depend
+// on how many requests are being served. Callers wait for their result;
+// when the queue is full they get errQueueFull right away. A batch, such as
+// a chunk of the transactions stream, holds a worker from BeginBatch until
+// it's committed or rolled back.
+type workerPoolStore struct {
+	Store
+	jobs chan func()
+
+	// mu keeps run from queueing once Close set closed, so jobs can be
+	// closed for the workers to finish what's queued and stop.
+	mu      sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+}
+
+func newWorkerPoolStore(store Store, workers, queueSize int) *workerPoolStore {
+	s := &workerPoolStore{
+		Store: store,
+		jobs:  make(chan func(), queueSize),
+	}
+	s.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer s.workers.Done()
+			for job := range s.jobs {
+				job()
+			}
+		}()
+	}
+	return s
+}
+
+// Close stops the workers once the jobs already queued have run, waiting
+// for the batches holding one to end. Later jobs fail with
+// errWorkerPoolClosed.
+func (s *workerPoolStore) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.jobs)
+	}
+	s.mu.Unlock()
+	s.workers.Wait()
+	return nil
+}
+
+func (s *workerPoolStore) Credit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	return s.run(func() (TransactionResult, error) {
+		return s.Store.Credit(ctx, customerID, value, desc)
+	})
+}
+
+func (s *workerPoolStore) Debit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	return s.run(func() (TransactionResult, error) {
+		return s.Store.Debit(ctx, customerID, value, desc)
+	})
+}
+
+func (s *workerPoolStore) ApplyIfBalance(ctx context.Context, customerID, value int, typ, desc string, expected int) (TransactionResult, error) {
+	return s.run(func() (TransactionResult, error) {
+		return s.Store.ApplyIfBalance(ctx, customerID, value, typ, desc, expected)
+	})
+}
+
+func (s *workerPoolStore) BeginBatch(ctx context.Context) (Batch, error) {
+	var b Batch
+	var err error
+	begun := make(chan struct{})
+	release := make(chan struct{})
+	job := func() {
+		b, err = s.Store.BeginBatch(ctx)
+		close(begun)
+		if err == nil {
+			<-release
+		}
+	}
+
+	if err := s.submit(job); err != nil {
+		return nil, err
+	}
+	<-begun
+	if err != nil {
+		return nil, err
+	}
+	return &workerPoolBatch{Batch: b, release: release}, nil
+}
+
+func (s *workerPoolStore) run(fn func() (TransactionResult, error)) (TransactionResult, error) {
+	var res TransactionResult
+	var err error
+	done := make(chan struct{})
+	job := func() {
+		res, err = fn()
+		close(done)
+	}
+
+	if err := s.submit(job); err != nil {
+		return TransactionResult{}, err
+	}
+	<-done
+	return res, err
+}
+
+// submit queues job, failing right away when the queue is full or the pool
+// is closed.
+func (s *workerPoolStore) submit(job func()) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errWorkerPoolClosed
+	}
+	select {
+	case s.jobs <- job:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// workerPoolBatch gives its worker back once committed or rolled back.
+type workerPoolBatch struct {
+	Batch
+	release chan struct{}
+	once    sync.Once
+}
+
+func (b *workerPoolBatch) Commit(ctx context.Context) error {
+	defer b.once.Do(func() { close(b.release) })
+	return b.Batch.Commit(ctx)
+}
+
+func (b *workerPoolBatch) Rollback(ctx context.Context) error {
+	defer b.once.Do(func() { close(b.release) })
+	return b.Batch.Rollback(ctx)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingCreditStore holds every credit until release is closed, signaling
+// on started as each one begins.
+type blockingCreditStore struct {
+	Store
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingCreditStore) Credit(ctx context.Context, customerID, value int, desc string) (TransactionResult, error) {
+	s.started <- struct{}{}
+	<-s.release
+	return s.Store.Credit(ctx, customerID, value, desc)
+}
+
+func TestWorkerPool(t *testing.T) {
+	tests := []struct {
+		name               string
+		workers, queueSize int
+	}{
+		{"one worker", 1, 100},
+		{"more workers than requests", 100, 1},
+		{"some workers", 4, 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeStore()
+			cfg := testConfig()
+			cfg.Transactions.Workers = tt.workers
+			cfg.Transactions.QueueSize = tt.queueSize
+			s := newTestServer(t, cfg, fake)
+
+			// A queue smaller than the burst may answer some with 503.
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if w := do(s, "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`); w.Code != http.StatusOK && w.Code != http.StatusServiceUnavailable {
+						t.Errorf("status = %d: %s", w.Code, w.Body)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if got, applied := fake.customer(1).Balance, fake.count("Credit"); got != applied {
+				t.Errorf("balance = %d after %d credits", got, applied)
+			}
+			if tt.queueSize >= 50 && fake.count("Credit") != 50 {
+				t.Errorf("applied %d credits, want all 50 with room in the queue", fake.count("Credit"))
+			}
+		})
+	}
+}
+
+func TestWorkerPoolQueueFull(t *testing.T) {
+	blocking := &blockingCreditStore{Store: newFakeStore(), started: make(chan struct{}, 2), release: make(chan struct{})}
+	pool := newWorkerPoolStore(blocking, 1, 1)
+	ctx := context.Background()
+
+	results := make(chan error, 2)
+	credit := func() {
+		_, err := pool.Credit(ctx, 1, 1, "x")
+		results <- err
+	}
+	// The first credit takes the only worker and the second waits in the
+	// queue.
+	go credit()
+	<-blocking.started
+	go credit()
+	for len(pool.jobs) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := pool.Credit(ctx, 1, 1, "x"); !errors.Is(err, errQueueFull) {
+		t.Errorf("credit with a full queue: err = %v, want errQueueFull", err)
+	}
+	s := newTestServer(t, testConfig(), pool)
+	if w := do(s, "POST", "/clientes/1/transacoes", `{"valor": 1, "tipo": "c", "descricao": "x"}`); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status with a full queue = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	close(blocking.release)
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("queued credit: %v", err)
+		}
+	}
+	if got := blocking.Store.(*fakeStore).customer(1).Balance; got != 2 {
+		t.Errorf("balance = %d, want the 2 queued credits", got)
+	}
+}
+
+func TestWorkerPoolBatch(t *testing.T) {
+	pool := newWorkerPoolStore(newFakeStore(), 1, 1)
+	t.Cleanup(func() { pool.Close() })
+	ctx := context.Background()
+
+	batch, err := pool.BeginBatch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := batch.Apply(ctx, 1, 100, "c", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The batch holds the only worker, so a credit waits in the queue and
+	// the next finds it full.
+	credited := make(chan error, 1)
+	go func() {
+		_, err := pool.Credit(ctx, 1, 1, "x")
+		credited <- err
+	}()
+	for len(pool.jobs) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := pool.Credit(ctx, 1, 1, "x"); !errors.Is(err, errQueueFull) {
+		t.Errorf("credit while the batch holds the worker: err = %v, want errQueueFull", err)
+	}
+	select {
+	case err := <-credited:
+		t.Fatalf("credit ran before the batch was committed: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-credited; err != nil {
+		t.Errorf("queued credit: %v", err)
+	}
+	if got := pool.Store.(*fakeStore).customer(1).Balance; got != 101 {
+		t.Errorf("balance = %d, want the batch and the queued credit", got)
+	}
+}
+
+func TestWorkerPoolClose(t *testing.T) {
+	blocking := &blockingCreditStore{Store: newFakeStore(), started: make(chan struct{}, 2), release: make(chan struct{})}
+	pool := newWorkerPoolStore(blocking, 1, 1)
+	ctx := context.Background()
+
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := pool.Credit(ctx, 1, 1, "x")
+			results <- err
+		}()
+		if i == 0 {
+			<-blocking.started
+		}
+	}
+	for len(pool.jobs) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		pool.Close()
+		close(closed)
+	}()
+	// Close waits for the queued credit, so it can't return before the
+	// worker is released.
+	for {
+		if _, err := pool.Credit(ctx, 1, 1, "x"); errors.Is(err, errWorkerPoolClosed) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-closed:
+		t.Fatal("Close returned with a credit still running")
+	default:
+	}
+
+	close(blocking.release)
+	<-closed
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("credit queued before Close: %v", err)
+		}
+	}
+	if got := blocking.Store.(*fakeStore).customer(1).Balance; got != 2 {
+		t.Errorf("balance = %d, want the 2 credits queued before Close", got)
+	}
+	if err := pool.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}